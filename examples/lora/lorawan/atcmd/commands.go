@@ -4,6 +4,7 @@ package main
 
 import (
 	"encoding/hex"
+	"strconv"
 	"strings"
 
 	"tinygo.org/x/wireless/examples/lora/lorawan/common"
@@ -46,6 +47,7 @@ func id(args string) error {
 
 				return err
 			}
+			abp.SetDevAddr(hexdata)
 
 			writeCommandOutput(cmd, "DevAddr, "+session.GetDevAddr())
 		case "DevEui":
@@ -101,14 +103,10 @@ func msg(data string) error {
 	cmd := "MSG"
 	writeCommandOutput(cmd, "Start")
 
-	if err := radio.Tx([]byte(data), defaultTimeout); err != nil {
-		writeCommandOutput(cmd, err.Error())
-
-		return err
-	}
+	// remove leading/trailing quotes
+	data = strings.Trim(data, "\"'")
 
-	writeCommandOutput(cmd, "Done")
-	return nil
+	return sendUnconfirmed(cmd, []byte(data))
 }
 
 // Use to send string format frame which must be confirmed by the server
@@ -116,16 +114,10 @@ func cmsg(data string) error {
 	cmd := "CMSG"
 	writeCommandOutput(cmd, "Start")
 
-	if err := radio.Tx([]byte(data), defaultTimeout); err != nil {
-		writeCommandOutput(cmd, err.Error())
-
-		return err
-	}
-
-	// TODO: confirmation
+	// remove leading/trailing quotes
+	data = strings.Trim(data, "\"'")
 
-	writeCommandOutput(cmd, "Done")
-	return nil
+	return sendConfirmed(cmd, []byte(data))
 }
 
 // Use to send hex format frame which is no need to be confirmed by the server
@@ -133,8 +125,19 @@ func msghex(data string) error {
 	cmd := "MSGHEX"
 	writeCommandOutput(cmd, "Start")
 
-	writeCommandOutput(cmd, "Done")
-	return nil
+	// remove leading/trailing quotes
+	data = strings.Trim(data, "\"'")
+
+	// convert data from hex formatted string
+	data = strings.ReplaceAll(data, " ", "")
+	payload, err := hex.DecodeString(data)
+	if err != nil {
+		writeCommandOutput(cmd, err.Error())
+
+		return err
+	}
+
+	return sendUnconfirmed(cmd, payload)
 }
 
 // Use to send hex format frame which must be confirmed by the server.
@@ -142,6 +145,48 @@ func cmsghex(data string) error {
 	cmd := "CMSGHEX"
 	writeCommandOutput(cmd, "Start")
 
+	// remove leading/trailing quotes
+	data = strings.Trim(data, "\"'")
+
+	// convert data from hex formatted string
+	data = strings.ReplaceAll(data, " ", "")
+	payload, err := hex.DecodeString(data)
+	if err != nil {
+		writeCommandOutput(cmd, err.Error())
+
+		return err
+	}
+
+	return sendConfirmed(cmd, payload)
+}
+
+// sendUnconfirmed sends an unconfirmed uplink on the current port
+func sendUnconfirmed(cmd string, payload []byte) error {
+	if err := lorawan.SendUplinkMessage(&lorawan.Uplink{FPort: fport, Payload: payload}, session); err != nil {
+		writeCommandOutput(cmd, err.Error())
+
+		return err
+	}
+
+	writeCommandOutput(cmd, "Done")
+	return nil
+}
+
+// sendConfirmed sends a confirmed uplink on the current port and reports the acknowledgment
+func sendConfirmed(cmd string, payload []byte) error {
+	writeCommandOutput(cmd, "Wait ACK")
+	dl, err := lorawan.SendConfirmedUplinkMessage(&lorawan.Uplink{FPort: fport, Payload: payload}, session)
+	if err != nil {
+		writeCommandOutput(cmd, err.Error())
+
+		return err
+	}
+
+	writeCommandOutput(cmd, "ACK Received")
+	if len(dl.Payload) > 0 {
+		writeCommandOutput(cmd, "PORT: "+strconv.Itoa(int(dl.FPort))+"; RX: \""+hex.EncodeToString(dl.Payload)+"\"")
+	}
+
 	writeCommandOutput(cmd, "Done")
 	return nil
 }
@@ -169,8 +214,16 @@ func pmsghex(data string) error {
 // message, port number should range from 1 to 255. User should refer to LoRaWAN
 // specification to choose port.
 func port(p string) error {
-	cmd := "PMSG"
-	writeCommandOutput(cmd, p)
+	cmd := "PORT"
+
+	if p != "" {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 1 || v > 255 {
+			return errInvalidCommand
+		}
+		fport = uint8(v)
+	}
+	writeCommandOutput(cmd, strconv.Itoa(int(fport)))
 
 	return nil
 }
@@ -178,7 +231,22 @@ func port(p string) error {
 // Set ADR function of LoRaWAN module
 func adr(state string) error {
 	cmd := "ADR"
-	writeCommandOutput(cmd, state)
+
+	switch state {
+	case "ON":
+		session.ADR = true
+	case "OFF":
+		session.ADR = false
+	case "":
+	default:
+		return errInvalidCommand
+	}
+
+	if session.ADR {
+		writeCommandOutput(cmd, "ON")
+	} else {
+		writeCommandOutput(cmd, "OFF")
+	}
 
 	return nil
 }
@@ -221,7 +289,15 @@ func rept(setting string) error {
 // (band duty cycle limitation has the priority)
 func retry(setting string) error {
 	cmd := "RETRY"
-	writeCommandOutput(cmd, setting)
+
+	if setting != "" {
+		retries, err := strconv.Atoi(setting)
+		if err != nil || retries < 0 || retries > 254 {
+			return errInvalidCommand
+		}
+		lorawan.DefaultStack().Retries = retries
+	}
+	writeCommandOutput(cmd, strconv.Itoa(lorawan.DefaultStack().Retries))
 
 	return nil
 }
@@ -267,6 +343,30 @@ func key(setting string) error {
 			}
 
 			writeCommandOutput(cmd, "APPKEY, "+otaa.GetAppKey())
+		case "NWKKEY":
+			if err := otaa.SetNwkKey(hexdata); err != nil {
+				writeCommandOutput(cmd, err.Error())
+
+				return err
+			}
+
+			writeCommandOutput(cmd, "NWKKEY, "+otaa.GetNwkKey())
+		case "NWKSKEY":
+			if err := abp.SetNwkSKey(hexdata); err != nil {
+				writeCommandOutput(cmd, err.Error())
+
+				return err
+			}
+
+			writeCommandOutput(cmd, "NWKSKEY "+hex.EncodeToString(abp.NwkSKey[:]))
+		case "APPSKEY":
+			if err := abp.SetAppSKey(hexdata); err != nil {
+				writeCommandOutput(cmd, err.Error())
+
+				return err
+			}
+
+			writeCommandOutput(cmd, "APPSKEY "+hex.EncodeToString(abp.AppSKey[:]))
 		default:
 			return errInvalidCommand
 		}
@@ -285,6 +385,19 @@ func fdefault(setting string) error {
 
 func mode(setting string) error {
 	cmd := "MODE"
+
+	switch setting {
+	case "LWABP":
+		if err := abp.Activate(session); err != nil {
+			writeCommandOutput(cmd, err.Error())
+
+			return err
+		}
+	case "LWOTAA", "TEST", "":
+	default:
+		return errInvalidCommand
+	}
+
 	writeCommandOutput(cmd, setting)
 
 	return nil
@@ -315,7 +428,18 @@ func join(setting string) error {
 func beacon(setting string) error {
 	cmd := "BEACON"
 	writeCommandOutput(cmd, "Starting")
+	b, err := lorawan.AcquireBeacon(session)
+	if err != nil {
+		writeCommandOutput(cmd, err.Error())
+
+		return err
+	}
 
+	beaconLocked = true
+	writeCommandOutput(cmd, "Time, "+strconv.FormatUint(uint64(b.Time), 10))
+	if lat, lng, ok := b.Coordinates(); ok {
+		writeCommandOutput(cmd, "GW, "+strconv.FormatFloat(lat, 'f', 5, 64)+", "+strconv.FormatFloat(lng, 'f', 5, 64))
+	}
 	writeCommandOutput(cmd, "Done")
 
 	return nil
@@ -323,13 +447,36 @@ func beacon(setting string) error {
 
 func class(setting string) error {
 	cmd := "CLASS"
-	writeCommandOutput(cmd, "Starting")
 
-	writeCommandOutput(cmd, "Done")
+	switch setting {
+	case "":
+	case "A":
+		session.Class = lorawan.ClassA
+	case "B":
+		// the network server learns the ping slot periodicity with the next
+		// uplink, and gives the time to find the beacon faster
+		session.Class = lorawan.ClassB
+		session.RequestPingSlotInfo(session.PingPeriodicity)
+		session.RequestDeviceTime()
+	case "C":
+		session.Class = lorawan.ClassC
+	default:
+		return errInvalidCommand
+	}
+
+	writeCommandOutput(cmd, string("ABC"[session.Class]))
 
 	return nil
 }
 
+// classDownlink reports a downlink received while listening as a Class B or
+// Class C device
+func classDownlink(dl *lorawan.Downlink) {
+	if len(dl.Payload) > 0 {
+		writeCommandOutput("MSG", "PORT: "+strconv.Itoa(int(dl.FPort))+"; RX: \""+hex.EncodeToString(dl.Payload)+"\"")
+	}
+}
+
 func delay(setting string) error {
 	cmd := "DELAY"
 	writeCommandOutput(cmd, setting)
@@ -390,9 +537,34 @@ func rtc(setting string) error {
 	return nil
 }
 
+// Shows the saved session, LOAD restores it (e.g. before MODE=LWABP), CLEAR erases it
 func eeprom(setting string) error {
 	cmd := "EEPROM"
-	writeCommandOutput(cmd, "Not implemented")
+
+	switch setting {
+	case "":
+		writeCommandOutput(cmd, hex.EncodeToString(eepromStore.Session))
+	case "LOAD":
+		if err := eepromStore.LoadSession(session); err != nil {
+			writeCommandOutput(cmd, err.Error())
+
+			return err
+		}
+		if err := eepromStore.LoadNonces(otaa); err != nil && err != lorawan.ErrNoStoredState {
+			writeCommandOutput(cmd, err.Error())
+
+			return err
+		}
+
+		writeCommandOutput(cmd, setting)
+	case "CLEAR":
+		eepromStore.Nonces = nil
+		eepromStore.Session = nil
+
+		writeCommandOutput(cmd, setting)
+	default:
+		return errInvalidCommand
+	}
 
 	return nil
 }
@@ -30,8 +30,18 @@ var (
 	radio   lora.Radio
 	session *lorawan.Session
 	otaa    *lorawan.Otaa
+	abp     *lorawan.Abp
+
+	// saved nonces and session, backing AT+EEPROM
+	eepromStore = &lorawan.MemoryStore{}
 
 	defaultTimeout uint32 = 1000
+
+	// LoRaWAN application port used by MSG/CMSG/MSGHEX/CMSGHEX
+	fport uint8 = 1
+
+	// a Class B device listens for ping slots once AT+BEACON found the beacon
+	beaconLocked bool
 )
 
 var reg string
@@ -47,13 +57,35 @@ func main() {
 
 	session = &lorawan.Session{}
 	otaa = &lorawan.Otaa{}
+	abp = &lorawan.Abp{}
 	lorawan.UseRadio(radio)
+	lorawan.UseStore(eepromStore)
 
 	switch reg {
+	case "AS923", "AS923-1", "AS923-2", "AS923-3", "AS923-4":
+		group := uint8(1)
+		if len(reg) > len("AS923-") {
+			group = reg[len("AS923-")] - '0'
+		}
+		rs, err := region.AS923(group)
+		if err != nil {
+			fail(err.Error())
+		}
+		lorawan.UseRegionSettings(rs)
 	case "AU915":
 		lorawan.UseRegionSettings(region.AU915())
+	case "CN470":
+		lorawan.UseRegionSettings(region.CN470())
+	case "EU433":
+		lorawan.UseRegionSettings(region.EU433())
 	case "EU868":
 		lorawan.UseRegionSettings(region.EU868())
+	case "IN865":
+		lorawan.UseRegionSettings(region.IN865())
+	case "KR920":
+		lorawan.UseRegionSettings(region.KR920())
+	case "RU864":
+		lorawan.UseRegionSettings(region.RU864())
 	case "US915":
 		lorawan.UseRegionSettings(region.US915())
 	default:
@@ -77,6 +109,20 @@ func main() {
 				// just capture the character
 				input = append(input, data)
 			}
+			continue
+		}
+
+		// Class B and C devices listen for downlinks while the console is idle
+		if session.Class == lorawan.ClassB && session.Activated() && beaconLocked {
+			if err := lorawan.ListenClassB(session, 100*time.Millisecond, classDownlink); err == lorawan.ErrBeaconLost {
+				beaconLocked = false
+				writeCommandOutput("BEACON", err.Error())
+			}
+			continue
+		}
+		if session.Class == lorawan.ClassC && session.Activated() {
+			lorawan.ListenClassC(session, 100*time.Millisecond, classDownlink)
+			continue
 		}
 		time.Sleep(10 * time.Millisecond)
 	}
@@ -76,7 +76,7 @@ func parseCommand(cmd, args string) error {
 	case "JOIN":
 		join(args)
 	case "BEACON":
-		join(args)
+		beacon(args)
 	case "CLASS":
 		class(args)
 	case "DELAY":
@@ -71,10 +71,30 @@ func main() {
 	// Connect the lorawan with the Lora Radio device.
 	lorawan.UseRadio(radio)
 	switch reg {
+	case "AS923", "AS923-1", "AS923-2", "AS923-3", "AS923-4":
+		group := uint8(1)
+		if len(reg) > len("AS923-") {
+			group = reg[len("AS923-")] - '0'
+		}
+		rs, err := region.AS923(group)
+		if err != nil {
+			failMessage(err)
+		}
+		lorawan.UseRegionSettings(rs)
 	case "AU915":
 		lorawan.UseRegionSettings(region.AU915())
+	case "CN470":
+		lorawan.UseRegionSettings(region.CN470())
+	case "EU433":
+		lorawan.UseRegionSettings(region.EU433())
 	case "EU868":
 		lorawan.UseRegionSettings(region.EU868())
+	case "IN865":
+		lorawan.UseRegionSettings(region.IN865())
+	case "KR920":
+		lorawan.UseRegionSettings(region.KR920())
+	case "RU864":
+		lorawan.UseRegionSettings(region.RU864())
 	case "US915":
 		lorawan.UseRegionSettings(region.US915())
 	default:
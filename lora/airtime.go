@@ -0,0 +1,64 @@
+package lora
+
+import "time"
+
+// bandwidthHz gives the bandwidth in Hz of the Bandwidth_* settings
+var bandwidthHz = [...]uint64{7812, 10417, 15625, 20833, 31250, 41667, 62500, 125000, 250000, 500000}
+
+// BandwidthHz returns the bandwidth in Hz of a Bandwidth_* setting, 0 if unknown
+func BandwidthHz(bw uint8) uint32 {
+	if int(bw) >= len(bandwidthHz) {
+		return 0
+	}
+	return uint32(bandwidthHz[bw])
+}
+
+// SymbolTime returns the duration of a LoRa symbol: 2^SF / BW
+func (c *Config) SymbolTime() time.Duration {
+	bw := uint64(BandwidthHz(c.Bw))
+	if bw == 0 {
+		return 0
+	}
+	return time.Duration((uint64(1) << c.Sf) * uint64(time.Second) / bw)
+}
+
+// LowDataRateOptimize reports if low data rate optimization is used, it is
+// mandatory when the symbol time is 16 ms or more
+func (c *Config) LowDataRateOptimize() bool {
+	return c.Ldr == LowDataRateOptimizeOn || c.SymbolTime() >= 16*time.Millisecond
+}
+
+// TimeOnAir returns the duration of the transmission of a payloadLen bytes
+// packet, as computed by Semtech AN1200.13:
+//
+//	Tpreamble = (Preamble + 4.25) * Tsym
+//	Npayload  = 8 + max(ceil((8PL - 4SF + 28 + 16CRC - 20IH) / (4(SF - 2DE))) * (CR + 4), 0)
+//	ToA       = Tpreamble + Npayload * Tsym
+func (c *Config) TimeOnAir(payloadLen int) time.Duration {
+	bw := uint64(BandwidthHz(c.Bw))
+	if bw == 0 {
+		return 0
+	}
+	sf := int(c.Sf)
+
+	crc, ih, de := 0, 0, 0
+	if c.Crc == CRCOn {
+		crc = 1
+	}
+	if c.HeaderType == HeaderImplicit {
+		ih = 1
+	}
+	if c.LowDataRateOptimize() {
+		de = 1
+	}
+
+	symbols := 8
+	n := 8*payloadLen - 4*sf + 28 + 16*crc - 20*ih
+	if d := 4 * (sf - 2*de); n > 0 && d > 0 {
+		symbols += (n + d - 1) / d * (int(c.Cr) + 4)
+	}
+
+	// counted in quarters of symbol for the 4.25 symbols of the preamble
+	quarters := uint64(4*int(c.Preamble)+17) + uint64(4*symbols)
+	return time.Duration(quarters * (uint64(1) << sf) * uint64(time.Second) / (4 * bw))
+}
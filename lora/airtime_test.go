@@ -0,0 +1,72 @@
+package lora
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSymbolTime(t *testing.T) {
+	tests := []struct {
+		sf   uint8
+		bw   uint8
+		want time.Duration
+	}{
+		{SpreadingFactor7, Bandwidth_125_0, 1024 * time.Microsecond},
+		{SpreadingFactor12, Bandwidth_125_0, 32768 * time.Microsecond},
+		{SpreadingFactor8, Bandwidth_500_0, 512 * time.Microsecond},
+		{SpreadingFactor7, 0xFF, 0},
+	}
+
+	for _, tt := range tests {
+		cfg := Config{Sf: tt.sf, Bw: tt.bw}
+		if got := cfg.SymbolTime(); got != tt.want {
+			t.Errorf("SymbolTime(SF%d, BW %d) = %v, want %v", tt.sf, tt.bw, got, tt.want)
+		}
+	}
+}
+
+func TestLowDataRateOptimize(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"SF7BW125", Config{Sf: SpreadingFactor7, Bw: Bandwidth_125_0}, false},
+		{"SF11BW125 automatic", Config{Sf: SpreadingFactor11, Bw: Bandwidth_125_0}, true},
+		{"SF12BW250 automatic", Config{Sf: SpreadingFactor12, Bw: Bandwidth_250_0}, true},
+		{"SF11BW250", Config{Sf: SpreadingFactor11, Bw: Bandwidth_250_0}, false},
+		{"forced", Config{Sf: SpreadingFactor7, Bw: Bandwidth_125_0, Ldr: LowDataRateOptimizeOn}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.LowDataRateOptimize(); got != tt.want {
+				t.Errorf("LowDataRateOptimize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeOnAir(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		len  int
+		want time.Duration
+	}{
+		{"SF7BW125", Config{Sf: SpreadingFactor7, Bw: Bandwidth_125_0, Cr: CodingRate4_5, Preamble: 8, Crc: CRCOn}, 13, 46336 * time.Microsecond},
+		{"SF12BW125", Config{Sf: SpreadingFactor12, Bw: Bandwidth_125_0, Cr: CodingRate4_5, Preamble: 8, Crc: CRCOn}, 13, 1155072 * time.Microsecond},
+		{"SF9BW125 CR4/8", Config{Sf: SpreadingFactor9, Bw: Bandwidth_125_0, Cr: CodingRate4_8, Preamble: 8, Crc: CRCOn}, 23, 279552 * time.Microsecond},
+		{"SF7BW125 no CRC implicit header", Config{Sf: SpreadingFactor7, Bw: Bandwidth_125_0, Cr: CodingRate4_5, Preamble: 8, Crc: CRCOff, HeaderType: HeaderImplicit}, 13, 36096 * time.Microsecond},
+		{"SF8BW500", Config{Sf: SpreadingFactor8, Bw: Bandwidth_500_0, Cr: CodingRate4_5, Preamble: 8, Crc: CRCOn}, 23, 28288 * time.Microsecond},
+		{"empty payload", Config{Sf: SpreadingFactor7, Bw: Bandwidth_125_0, Cr: CodingRate4_5, Preamble: 8, Crc: CRCOn}, 0, 25856 * time.Microsecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.TimeOnAir(tt.len); got != tt.want {
+				t.Errorf("TimeOnAir(%d) = %v, want %v", tt.len, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package lora
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors of the asynchronous operations. ErrRadioBusy is returned by
+// StartTx and StartRx while another operation is in progress.
+var (
+	ErrRadioBusy       = errors.New("radio busy")
+	ErrUnexpectedEvent = errors.New("radio unexpected event")
+)
+
+// AsyncTimeoutMargin is added to the radio timeout by AsyncTx and AsyncRx
+// before they give up waiting for an event and cancel the operation
+const AsyncTimeoutMargin = 100 * time.Millisecond
+
+// AsyncRadio is a Radio able to transmit and receive in the background,
+// letting the caller sleep until the radio interrupt instead of blocking in
+// Tx or Rx.
+//
+// StartTx and StartRx return once the operation is started, its end is sent
+// on the Events channel: RadioEventTxDone, RadioEventRxDone with the packet
+// in EventData, RadioEventTimeout or RadioEventCrcError. A StartRx timeout
+// of 0 listens until a packet is received or Cancel is called. One
+// operation runs at a time, Cancel puts the radio in standby and no event
+// is sent for the aborted operation.
+type AsyncRadio interface {
+	Radio
+	StartTx(pkt []uint8, timeoutMs uint32) error
+	StartRx(timeoutMs uint32) error
+	Cancel()
+	Events() <-chan RadioEvent
+}
+
+// EventError returns the error Tx (with tx set) or Rx returns for the
+// event ending the operation: nil for RadioEventTxDone and
+// RadioEventRxDone, ErrTxTimeout or ErrRxTimeout for RadioEventTimeout and
+// ErrCrcError for RadioEventCrcError, ErrUnexpectedEvent for the others.
+func EventError(ev RadioEvent, tx bool) error {
+	switch ev.EventType {
+	case RadioEventTxDone, RadioEventRxDone:
+		return nil
+	case RadioEventTimeout:
+		if tx {
+			return ErrTxTimeout
+		}
+		return ErrRxTimeout
+	case RadioEventCrcError:
+		return ErrCrcError
+	default:
+		return ErrUnexpectedEvent
+	}
+}
+
+// WaitEvent waits at most timeout for the event ending the operation
+// started on r, 0 waits forever. The operation is cancelled and a
+// RadioEventTimeout returned if the radio did not end it in time.
+func WaitEvent(r AsyncRadio, timeout time.Duration) RadioEvent {
+	if timeout == 0 {
+		return <-r.Events()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ev := <-r.Events():
+		return ev
+	case <-timer.C:
+		r.Cancel()
+		return NewRadioEvent(RadioEventTimeout, 0, nil)
+	}
+}
+
+// AsyncTx transmits pkt with r and waits for the end of the transmission,
+// drivers implement their blocking Tx with it
+func AsyncTx(r AsyncRadio, pkt []uint8, timeoutMs uint32) error {
+	drainEvents(r)
+	if err := r.StartTx(pkt, timeoutMs); err != nil {
+		return err
+	}
+	ev := WaitEvent(r, guardTimeout(timeoutMs))
+	return EventError(ev, true)
+}
+
+// AsyncRx listens with r and waits for a packet, drivers implement their
+// blocking Rx with it
+func AsyncRx(r AsyncRadio, timeoutMs uint32) ([]uint8, error) {
+	pkt, err := AsyncReceive(r, timeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	return pkt.Payload, nil
+}
+
+// guardTimeout returns how long to wait for the event of an operation with
+// the radio timeout timeoutMs, 0 for an operation without timeout
+func guardTimeout(timeoutMs uint32) time.Duration {
+	if timeoutMs == 0 {
+		return 0
+	}
+	return time.Duration(timeoutMs)*time.Millisecond + AsyncTimeoutMargin
+}
+
+// drainEvents drops the events left by operations cancelled while the
+// radio was sending their end
+func drainEvents(r AsyncRadio) {
+	for {
+		select {
+		case <-r.Events():
+		default:
+			return
+		}
+	}
+}
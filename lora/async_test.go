@@ -0,0 +1,123 @@
+package lora
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// asyncRadio answers each operation with the next event of script, a nil
+// event never ends the operation
+type asyncRadio struct {
+	Radio
+	events    chan RadioEvent
+	script    []*RadioEvent
+	busy      bool
+	started   int
+	cancelled int
+}
+
+func newAsyncRadio(script ...*RadioEvent) *asyncRadio {
+	return &asyncRadio{events: make(chan RadioEvent, 2), script: script}
+}
+
+func (r *asyncRadio) start() error {
+	if r.busy {
+		return ErrRadioBusy
+	}
+	r.started++
+	ev := r.script[0]
+	r.script = r.script[1:]
+	if ev == nil {
+		r.busy = true
+		return nil
+	}
+	r.events <- *ev
+	return nil
+}
+
+func (r *asyncRadio) StartTx(pkt []uint8, timeoutMs uint32) error { return r.start() }
+func (r *asyncRadio) StartRx(timeoutMs uint32) error              { return r.start() }
+func (r *asyncRadio) Cancel()                                     { r.busy = false; r.cancelled++ }
+func (r *asyncRadio) Events() <-chan RadioEvent                   { return r.events }
+
+func event(eType int, data []byte) *RadioEvent {
+	ev := NewRadioEvent(eType, 0, data)
+	return &ev
+}
+
+func TestAsyncTx(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   *RadioEvent
+		want error
+	}{
+		{"done", event(RadioEventTxDone, nil), nil},
+		{"timeout", event(RadioEventTimeout, nil), ErrTxTimeout},
+		{"watchdog", event(RadioEventWatchdog, nil), ErrUnexpectedEvent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newAsyncRadio(tt.ev)
+			if err := AsyncTx(r, []uint8{1}, 100); err != tt.want {
+				t.Errorf("AsyncTx() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsyncRx(t *testing.T) {
+	tests := []struct {
+		name    string
+		ev      *RadioEvent
+		want    string
+		wantErr error
+	}{
+		{"done", event(RadioEventRxDone, []byte("hello")), "hello", nil},
+		{"timeout", event(RadioEventTimeout, nil), "", ErrRxTimeout},
+		{"crc error", event(RadioEventCrcError, nil), "", ErrCrcError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newAsyncRadio(tt.ev)
+			pkt, err := AsyncRx(r, 100)
+			if err != tt.wantErr || string(pkt) != tt.want {
+				t.Errorf("AsyncRx() = %q, %v, want %q, %v", pkt, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAsyncRxCancel(t *testing.T) {
+	// The radio never ends the reception, it is cancelled after the margin
+	r := newAsyncRadio(nil)
+	start := time.Now()
+	pkt, err := AsyncRx(r, 10)
+	if err != ErrRxTimeout || pkt != nil {
+		t.Errorf("AsyncRx() = %q, %v, want %v", pkt, err, ErrRxTimeout)
+	}
+	if r.cancelled != 1 || r.busy {
+		t.Errorf("cancelled %d times, busy %v, want the reception cancelled", r.cancelled, r.busy)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond+AsyncTimeoutMargin {
+		t.Errorf("gave up after %v, want at least the timeout and margin", elapsed)
+	}
+}
+
+func TestAsyncStaleEvent(t *testing.T) {
+	// An event sent while the previous operation was cancelled is dropped
+	r := newAsyncRadio(event(RadioEventRxDone, []byte("new")))
+	r.events <- *event(RadioEventRxDone, []byte("old"))
+	pkt, err := AsyncRx(r, 100)
+	if err != nil || string(pkt) != "new" {
+		t.Errorf("AsyncRx() = %q, %v, want new", pkt, err)
+	}
+}
+
+func TestAsyncBusy(t *testing.T) {
+	r := newAsyncRadio()
+	r.busy = true
+	if _, err := AsyncRx(r, 100); !errors.Is(err, ErrRadioBusy) {
+		t.Errorf("AsyncRx() error = %v, want %v", err, ErrRadioBusy)
+	}
+}
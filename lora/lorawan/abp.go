@@ -0,0 +1,113 @@
+package lorawan
+
+import "encoding/hex"
+
+// Session activation methods
+const (
+	ActivationNone = iota
+	ActivationOTAA
+	ActivationABP
+)
+
+// Abp is used to store Activation By Personalization data of a LoRaWAN session
+type Abp struct {
+	DevAddr [4]uint8
+	NwkSKey [16]uint8
+	AppSKey [16]uint8
+}
+
+// Set configures the Abp DevAddr, NwkSKey, AppSKey for the device
+func (a *Abp) Set(devAddr []uint8, nwkSKey []uint8, appSKey []uint8) error {
+	if err := a.SetDevAddr(devAddr); err != nil {
+		return err
+	}
+	if err := a.SetNwkSKey(nwkSKey); err != nil {
+		return err
+	}
+	return a.SetAppSKey(appSKey)
+}
+
+// SetDevAddr configures the Abp DevAddr
+func (a *Abp) SetDevAddr(devAddr []uint8) error {
+	if len(devAddr) != 4 {
+		return ErrInvalidDevAddrLength
+	}
+
+	copy(a.DevAddr[:], devAddr)
+
+	return nil
+}
+
+func (a *Abp) GetDevAddr() string {
+	return hex.EncodeToString(a.DevAddr[:])
+}
+
+// SetNwkSKey configures the Abp NwkSKey
+func (a *Abp) SetNwkSKey(nwkSKey []uint8) error {
+	if len(nwkSKey) != 16 {
+		return ErrInvalidNwkSKeyLength
+	}
+
+	copy(a.NwkSKey[:], nwkSKey)
+
+	return nil
+}
+
+// SetAppSKey configures the Abp AppSKey
+func (a *Abp) SetAppSKey(appSKey []uint8) error {
+	if len(appSKey) != 16 {
+		return ErrInvalidAppSKeyLength
+	}
+
+	copy(a.AppSKey[:], appSKey)
+
+	return nil
+}
+
+// Activate personalizes the session with the Abp DevAddr and session keys.
+// ABP devices never rejoin, the network server expects their frame counters
+// to keep increasing for the whole life of the device: counters are kept
+// when the session is already activated with the same DevAddr (for example
+// after being restored from storage), and only reset for a new DevAddr.
+// The session is a LoRaWAN 1.0 one: the keys and counters of a previous
+// LoRaWAN 1.1 join are cleared.
+func (a *Abp) Activate(s *Session) error {
+	if isZero(a.DevAddr[:]) || isZero(a.NwkSKey[:]) || isZero(a.AppSKey[:]) {
+		return ErrUndefinedSessionKeys
+	}
+
+	if s.Activation != ActivationABP || s.DevAddr != a.DevAddr {
+		s.FCntUp = 0
+		s.FCntDown = 0
+	}
+
+	s.DevAddr = a.DevAddr
+	s.NwkSKey = a.NwkSKey
+	s.AppSKey = a.AppSKey
+	s.Activation = ActivationABP
+
+	s.Version = Version10
+	s.FNwkSIntKey = [16]uint8{}
+	s.SNwkSIntKey = [16]uint8{}
+	s.NwkSEncKey = [16]uint8{}
+	s.AFCntDown = 0
+	s.NFCntDown = 0
+	s.rekeyInd = false
+
+	return nil
+}
+
+// Activated reports if the session was joined (OTAA) or personalized (ABP)
+func (s *Session) Activated() bool {
+	return s.Activation != ActivationNone
+}
+
+// isZero reports if all bytes of b are zero
+func isZero(b []uint8) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package lorawan
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testAbp(t *testing.T) *Abp {
+	s := testDownlinkSession()
+	a := &Abp{}
+	if err := a.Set(s.DevAddr[:], s.NwkSKey[:], s.AppSKey[:]); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	return a
+}
+
+func TestAbpSetErrors(t *testing.T) {
+	a := &Abp{}
+	if err := a.SetDevAddr([]uint8{1, 2, 3}); err != ErrInvalidDevAddrLength {
+		t.Errorf("SetDevAddr() error = %v, want %v", err, ErrInvalidDevAddrLength)
+	}
+	if err := a.SetNwkSKey(make([]uint8, 15)); err != ErrInvalidNwkSKeyLength {
+		t.Errorf("SetNwkSKey() error = %v, want %v", err, ErrInvalidNwkSKeyLength)
+	}
+	if err := a.SetAppSKey(make([]uint8, 17)); err != ErrInvalidAppSKeyLength {
+		t.Errorf("SetAppSKey() error = %v, want %v", err, ErrInvalidAppSKeyLength)
+	}
+}
+
+func TestAbpActivate(t *testing.T) {
+	a := testAbp(t)
+	s := &Session{FCntUp: 10}
+
+	if err := a.Activate(s); err != nil {
+		t.Fatalf("Activate() error = %v", err)
+	}
+	if !s.Activated() || s.Activation != ActivationABP {
+		t.Errorf("Activation = %d, want %d", s.Activation, ActivationABP)
+	}
+	if s.DevAddr != a.DevAddr || s.NwkSKey != a.NwkSKey || s.AppSKey != a.AppSKey {
+		t.Error("session keys not copied from Abp")
+	}
+	if s.FCntUp != 0 {
+		t.Errorf("FCntUp = %d, want 0 for a new DevAddr", s.FCntUp)
+	}
+
+	// Counters of a restored ABP session must not be reset
+	s.FCntUp = 42
+	s.FCntDown = 7
+	if err := a.Activate(s); err != nil {
+		t.Fatalf("Activate() error = %v", err)
+	}
+	if s.FCntUp != 42 || s.FCntDown != 7 {
+		t.Errorf("FCntUp = %d, FCntDown = %d, want 42 and 7", s.FCntUp, s.FCntDown)
+	}
+}
+
+func TestAbpActivateAfterJoin11(t *testing.T) {
+	a := testAbp(t)
+	s := testSession11()
+	s.Activation = ActivationOTAA
+	s.AFCntDown = 5
+	s.NFCntDown = 3
+	s.rekeyInd = true
+
+	if err := a.Activate(s); err != nil {
+		t.Fatalf("Activate() error = %v", err)
+	}
+	if s.Version != Version10 {
+		t.Errorf("Version = %d, want %d", s.Version, Version10)
+	}
+	if s.FNwkSIntKey != [16]uint8{} || s.SNwkSIntKey != [16]uint8{} || s.NwkSEncKey != [16]uint8{} ||
+		s.AFCntDown != 0 || s.NFCntDown != 0 || s.rekeyInd {
+		t.Errorf("session %+v keeps LoRaWAN 1.1 keys or counters", s)
+	}
+
+	// Uplinks are signed with NwkSKey
+	msg, err := s.GenUplink(&Uplink{FPort: 1, Payload: []uint8{0x01}})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	n := len(msg) - 4
+	mic := calcMessageMIC(msg[:n], a.NwkSKey, 0, s.DevAddr[:], 0, uint8(n))
+	if !bytes.Equal(mic[:], msg[n:]) {
+		t.Errorf("MIC = %x, want %x computed with NwkSKey", msg[n:], mic)
+	}
+}
+
+func TestAbpActivateUndefinedKeys(t *testing.T) {
+	a := testAbp(t)
+	a.AppSKey = [16]uint8{}
+	s := &Session{}
+
+	if err := a.Activate(s); err != ErrUndefinedSessionKeys {
+		t.Errorf("Activate() error = %v, want %v", err, ErrUndefinedSessionKeys)
+	}
+	if s.Activated() {
+		t.Error("session activated with undefined keys")
+	}
+}
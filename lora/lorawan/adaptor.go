@@ -2,6 +2,7 @@ package lorawan
 
 import (
 	"errors"
+	"time"
 
 	"tinygo.org/x/wireless/lora"
 	"tinygo.org/x/wireless/lora/lorawan/region"
@@ -20,125 +21,491 @@ var (
 	ErrInvalidNwkSKeyLength    = errors.New("invalid NwkSKey length")
 	ErrInvalidAppSKeyLength    = errors.New("invalid AppSKey length")
 	ErrUndefinedRegionSettings = errors.New("undefined Regionnal Settings ")
+	ErrInvalidMessageType      = errors.New("invalid message type")
+	ErrInvalidDevAddr          = errors.New("DevAddr does not match session")
+	ErrInvalidFCntDown         = errors.New("invalid downlink frame counter")
+	ErrNoAckReceived           = errors.New("no ACK received for confirmed uplink")
+	ErrFOptsTooLarge           = errors.New("FOpts too large")
+	ErrInvalidFPort            = errors.New("invalid FPort")
+	ErrInvalidMACCommand       = errors.New("invalid MAC command")
+	ErrNotActivated            = errors.New("session is not activated")
+	ErrUndefinedSessionKeys    = errors.New("undefined DevAddr or session keys")
+	ErrInvalidNwkKeyLength     = errors.New("invalid NwkKey length")
+	ErrInvalidJoinNonce        = errors.New("JoinNonce was already used")
+	ErrNoStoredState           = errors.New("no stored state")
+	ErrInvalidStoredState      = errors.New("invalid stored state")
+	ErrFCntUpExhausted         = errors.New("uplink frame counter exhausted, rejoin required")
+	ErrFCntDownExhausted       = errors.New("downlink frame counter exhausted, rejoin required")
+	ErrNotClassC               = errors.New("session is not Class C")
+	ErrNotClassB               = errors.New("session is not Class B")
+	ErrClassBUnsupported       = errors.New("Class B is not supported by the region")
+	ErrNoBeaconReceived        = errors.New("no beacon received")
+	ErrBeaconLost              = errors.New("beacon lost, switched back to Class A")
+	ErrTxFailed                = errors.New("radio transmission failed")
+	ErrRxFailed                = errors.New("radio reception failed")
 )
 
+// RadioError is returned when the radio failed during a LoRaWAN operation.
+// Op is the error of the operation, such as ErrTxFailed or
+// ErrNoJoinAcceptReceived, and Err the radio error, such as lora.ErrTxTimeout
+// or lora.ErrRxTimeout: errors.Is matches both.
+type RadioError struct {
+	Op  error
+	Err error
+}
+
+func (e *RadioError) Error() string {
+	return e.Op.Error() + ": " + e.Err.Error()
+}
+
+func (e *RadioError) Unwrap() []error {
+	return []error{e.Op, e.Err}
+}
+
 const (
 	LORA_TX_TIMEOUT = 2000
 	LORA_RX_TIMEOUT = 10000
-)
 
-var (
-	ActiveRadio    lora.Radio
-	Retries        = 15
-	regionSettings region.Settings
+	// Receive windows duration, RX1 must end before RX2 opens one second later
+	LORA_RX1_TIMEOUT = 900
+	LORA_RX2_TIMEOUT = 3000
+
+	// Class C continuous reception is split in receptions of this duration
+	LORA_RXC_SLICE = 1000
+
+	// Class B beacon reception opens LORA_BEACON_MARGIN before the beacon
+	// time, ping slot reception lasts at least one slot
+	LORA_BEACON_MARGIN     = 100
+	LORA_BEACON_TIMEOUT    = 400
+	LORA_PING_SLOT_TIMEOUT = PING_SLOT_LEN
+
+	// Confirmed uplink retransmission delay after RX2, randomized between
+	// ACK_TIMEOUT_MIN and ACK_TIMEOUT_MIN+ACK_TIMEOUT_SPREAD
+	ACK_TIMEOUT_MIN    = 1000
+	ACK_TIMEOUT_SPREAD = 2000
+
+	// Transmissions of a confirmed uplink without ACK
+	DEFAULT_RETRIES = 15
 )
 
+// defaultStack is the Stack used by the package level functions
+var defaultStack = &Stack{Retries: DEFAULT_RETRIES}
+
+// DefaultStack returns the Stack used by the package level functions, such
+// as Join and SendUplink
+func DefaultStack() *Stack {
+	return defaultStack
+}
+
 // UseRegionSettings sets current Lorawan Regional parameters
 func UseRegionSettings(rs region.Settings) {
-	regionSettings = rs
+	defaultStack.Region = rs
+}
+
+// UseStore attaches the Store persisting nonces and frame counters, nil
+// disables persistence
+func UseStore(s Store) {
+	defaultStack.Store = s
 }
 
 // UseRadio attaches Lora radio driver to Lorawan
 func UseRadio(r lora.Radio) {
-	if ActiveRadio != nil {
-		panic("lorawan.ActiveRadio is already set")
+	if defaultStack.Radio != nil {
+		panic("lorawan radio is already set")
 	}
-	ActiveRadio = r
+	defaultStack.Radio = r
 }
 
 // SetPublicNetwork defines Lora Sync Word according to network type (public/private)
 func SetPublicNetwork(enabled bool) {
-	ActiveRadio.SetPublicNetwork(enabled)
+	defaultStack.SetPublicNetwork(enabled)
 }
 
 // ApplyChannelConfig sets current Lora modulation according to current regional settings
-func applyChannelConfig(ch region.Channel) {
-	ActiveRadio.SetFrequency(ch.Frequency())
-	ActiveRadio.SetBandwidth(ch.Bandwidth())
-	ActiveRadio.SetCodingRate(ch.CodingRate())
-	ActiveRadio.SetSpreadingFactor(ch.SpreadingFactor())
-	ActiveRadio.SetPreambleLength(ch.PreambleLength())
-	ActiveRadio.SetTxPower(ch.TxPowerDBm())
+func (st *Stack) applyChannelConfig(ch region.Channel) {
+	st.Radio.SetFrequency(ch.Frequency())
+	st.Radio.SetBandwidth(ch.Bandwidth())
+	st.Radio.SetCodingRate(ch.CodingRate())
+	st.Radio.SetSpreadingFactor(ch.SpreadingFactor())
+	st.Radio.SetPreambleLength(ch.PreambleLength())
+	st.Radio.SetTxPower(ch.TxPowerDBm())
 	// Lorawan defaults to explicit headers
-	ActiveRadio.SetHeaderType(lora.HeaderExplicit)
-	ActiveRadio.SetCrc(true)
+	st.Radio.SetHeaderType(lora.HeaderExplicit)
+	st.Radio.SetCrc(true)
 }
 
-// Join tries to connect Lorawan Gateway
+// Join tries to connect Lorawan Gateway. Join requests follow the region
+// duty cycle and the join back-off, a *DutyCycleError gives the time to
+// wait before the next attempt.
 func Join(otaa *Otaa, session *Session) error {
+	return defaultStack.join(otaa, session)
+}
+
+func (st *Stack) join(otaa *Otaa, session *Session) error {
 	var resp []uint8
 
-	if ActiveRadio == nil {
+	if st.Radio == nil {
 		return ErrNoRadioAttached
 	}
 
-	if regionSettings == nil {
+	if st.Region == nil {
 		return ErrUndefinedRegionSettings
 	}
 
 	otaa.Init()
-
-	// Send join packet
-	payload, err := otaa.GenerateJoinRequest()
-	if err != nil {
-		return err
+	if st.Store != nil {
+		// DevNonce continues from the last join request sent
+		if err := st.Store.LoadNonces(otaa); err != nil && err != ErrNoStoredState {
+			return err
+		}
 	}
 
 	for {
-		joinRequestChannel := regionSettings.JoinRequestChannel()
-		joinAcceptChannel := regionSettings.JoinAcceptChannel()
+		joinRequestChannel := st.Region.JoinRequestChannel()
+		joinAcceptChannel := st.Region.JoinAcceptChannel()
 
-		// Prepare radio for Join Tx
-		applyChannelConfig(joinRequestChannel)
-		ActiveRadio.SetIqMode(lora.IQStandard)
-		ActiveRadio.Tx(payload, LORA_TX_TIMEOUT)
+		if st.joinStart.IsZero() {
+			st.joinStart = time.Now()
+		}
+		if err := st.checkDutyCycle(joinRequestChannel, true); err != nil {
+			return err
+		}
+
+		// Each attempt uses a new DevNonce, saved before it is sent so it
+		// is never reused after a reset
+		payload, err := otaa.GenerateJoinRequest()
 		if err != nil {
 			return err
 		}
+		if st.Store != nil {
+			if err := st.Store.SaveNonces(otaa); err != nil {
+				return err
+			}
+		}
+
+		// Prepare radio for Join Tx
+		st.applyChannelConfig(joinRequestChannel)
+		st.Radio.SetIqMode(lora.IQStandard)
+		if err := st.transmit(payload); err != nil {
+			return &RadioError{ErrTxFailed, err}
+		}
+		st.transmissionDone(joinRequestChannel, len(payload), session, true)
 
 		// Wait for JoinAccept
 		if joinAcceptChannel.Frequency() != 0 {
-			applyChannelConfig(joinAcceptChannel)
+			st.applyChannelConfig(joinAcceptChannel)
 		}
-		ActiveRadio.SetIqMode(lora.IQInverted)
-		resp, err = ActiveRadio.Rx(LORA_RX_TIMEOUT)
-		if err == nil && resp != nil {
+		st.Radio.SetIqMode(lora.IQInverted)
+		pkt, err := st.receive(LORA_RX_TIMEOUT)
+		if err == nil && pkt != nil {
+			resp = pkt.Payload
 			break
 		}
-		if !joinAcceptChannel.Next() {
-			return ErrNoJoinAcceptReceived
+		if err == nil {
+			err = lora.ErrRxTimeout
+		}
+		// Retry on the next join channel of the region
+		if !joinRequestChannel.Next() {
+			return &RadioError{ErrNoJoinAcceptReceived, err}
 		}
 	}
 
-	err = otaa.DecodeJoinAccept(resp, session)
-	if err != nil {
+	if err := otaa.DecodeJoinAccept(resp, session); err != nil {
 		return err
 	}
+	st.joinStart = time.Time{}
+
+	// Channels defined by the network server
+	st.Region.ApplyCFList(session.CFList)
+
+	if st.Store != nil {
+		if err := st.Store.SaveNonces(otaa); err != nil {
+			return err
+		}
+		return st.Store.SaveSession(session)
+	}
 
 	return nil
 }
 
 // SendUplink sends Lorawan Uplink message
 func SendUplink(data []uint8, session *Session) error {
+	return SendUplinkMessage(&Uplink{FPort: 1, Payload: data}, session)
+}
 
-	if regionSettings == nil {
-		return ErrUndefinedRegionSettings
-	}
+// SendUplinkMessage sends an uplink message built from u, see Session.GenUplink.
+// A *DutyCycleError is returned, and nothing sent, when no uplink channel
+// can be used without exceeding the duty cycle. ErrFrmPayloadTooLarge is
+// returned when the payload and FOpts exceed the maximum size of the data rate.
+func SendUplinkMessage(u *Uplink, session *Session) error {
+	return defaultStack.sendUplinkMessage(u, session)
+}
 
-	payload, err := session.GenMessage(0, []byte(data))
+func (st *Stack) sendUplinkMessage(u *Uplink, session *Session) error {
+	payload, err := st.prepareUplink(u, session)
 	if err != nil {
 		return err
 	}
+	if err := st.transmitUplink(payload, session); err != nil {
+		return err
+	}
+	return st.sendMACAnswers(session)
+}
+
+// prepareUplink checks the stack and session can send an uplink, hops to
+// the next uplink channel and builds the frame of u with the ADR state and
+// data rate of the region. The frame counters are saved before the frame
+// is returned.
+func (st *Stack) prepareUplink(u *Uplink, session *Session) ([]uint8, error) {
+	if st.Radio == nil {
+		return nil, ErrNoRadioAttached
+	}
 
-	applyChannelConfig(regionSettings.UplinkChannel())
-	ActiveRadio.SetIqMode(lora.IQStandard)
-	ActiveRadio.Tx(payload, LORA_TX_TIMEOUT)
+	if st.Region == nil {
+		return nil, ErrUndefinedRegionSettings
+	}
+
+	if !session.Activated() {
+		return nil, ErrNotActivated
+	}
+
+	// Hop to another uplink channel, when the region has several
+	st.Region.UplinkChannel().Next()
+	if err := st.checkDutyCycle(st.Region.UplinkChannel(), false); err != nil {
+		return nil, err
+	}
+
+	adr := *u
+	adr.ADR = adr.ADR || session.ADR
+	adr.ADRACKReq = adr.ADRACKReq || session.adrUplink(st.Region)
+	adr.DataRate = st.Region.DataRate()
+	adr.Channel = st.Region.UplinkChannelIndex()
+	adr.MaxPayload = int(st.Region.MaxPayload(adr.DataRate))
+	payload, err := session.GenUplink(&adr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if err := st.saveSession(session); err != nil {
+		return nil, err
+	}
+	return payload, nil
 }
 
-func ListenDownlink() error {
+// transmitUplink sends an uplink frame on the current uplink channel
+func (st *Stack) transmitUplink(payload []uint8, session *Session) error {
+	st.applyChannelConfig(st.Region.UplinkChannel())
+	st.Radio.SetIqMode(lora.IQStandard)
+	if err := st.transmit(payload); err != nil {
+		return &RadioError{ErrTxFailed, err}
+	}
+	session.lastUplinkEnd = time.Now()
+	session.UplinkSent()
+	st.transmissionDone(st.Region.UplinkChannel(), len(payload), session, false)
 	return nil
 }
+
+// sendMACAnswers sends the MAC commands answers too long for FOpts in a MAC
+// only uplink on FPort 0. They stay queued for the next uplink when the
+// duty cycle does not allow it.
+func (st *Stack) sendMACAnswers(session *Session) error {
+	if !session.macOverflow() {
+		return nil
+	}
+	payload, err := st.prepareUplink(&Uplink{}, session)
+	var dcErr *DutyCycleError
+	if errors.As(err, &dcErr) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return st.transmitUplink(payload, session)
+}
+
+// SendConfirmedUplink sends a confirmed uplink message on FPort 1 and waits
+// for the network server acknowledgment, see SendConfirmedUplinkMessage.
+func SendConfirmedUplink(data []uint8, session *Session) (*Downlink, error) {
+	return SendConfirmedUplinkMessage(&Uplink{FPort: 1, Payload: data}, session)
+}
+
+// SendConfirmedUplinkMessage sends u as a confirmed uplink message and waits
+// for the network server acknowledgment in the following receive windows.
+// The frame is transmitted up to Retries times on a new uplink channel,
+// each retransmission keeps the same frame counter and is delayed by a
+// random ACK timeout.
+// It returns the downlink carrying the ACK, or ErrNoAckReceived.
+func SendConfirmedUplinkMessage(u *Uplink, session *Session) (*Downlink, error) {
+	return defaultStack.sendConfirmedUplinkMessage(u, session)
+}
+
+func (st *Stack) sendConfirmedUplinkMessage(u *Uplink, session *Session) (*Downlink, error) {
+	confirmed := *u
+	confirmed.Confirmed = true
+	payload, err := st.prepareUplink(&confirmed, session)
+	if err != nil {
+		return nil, err
+	}
+
+	var dl *Downlink
+	for attempt := 0; attempt < st.Retries || attempt == 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(ackTimeout())
+			st.Region.UplinkChannel().Next()
+			if err := st.checkDutyCycle(st.Region.UplinkChannel(), false); err != nil {
+				return nil, err
+			}
+			session.SignUplink(payload, st.Region.DataRate(), st.Region.UplinkChannelIndex())
+		}
+
+		if err := st.transmitUplink(payload, session); err != nil {
+			return nil, err
+		}
+
+		dl, err = st.listenDownlink(session)
+		if err == nil && dl != nil && dl.ACK {
+			return dl, st.sendMACAnswers(session)
+		}
+	}
+
+	// Tell a missing or failing reception from a downlink without ACK
+	if err == nil && dl == nil {
+		err = lora.ErrRxTimeout
+	}
+	if err != nil {
+		return nil, &RadioError{ErrNoAckReceived, err}
+	}
+	return nil, ErrNoAckReceived
+}
+
+// saveSession persists the session frame counters, if a Store is attached
+func (st *Stack) saveSession(session *Session) error {
+	if st.Store == nil {
+		return nil
+	}
+	return st.Store.SaveSession(session)
+}
+
+// ackTimeout returns the random delay before a confirmed uplink retransmission
+func ackTimeout() time.Duration {
+	rnd, _ := GetRand16()
+	spread := (uint32(rnd[0])<<8 | uint32(rnd[1])) % ACK_TIMEOUT_SPREAD
+	return time.Duration(ACK_TIMEOUT_MIN+spread) * time.Millisecond
+}
+
+// ListenDownlink opens the RX1 and RX2 receive windows following the last
+// uplink sent with SendUplink, and decodes the received frame. The updated
+// downlink frame counters are saved to the Store.
+// RX1 opens RXDelay seconds after the uplink on the region RX1 channel,
+// RX2 one second later on the region RX2 channel. Class C devices also
+// listen on the RX2 channel from the end of the uplink until RX1 opens.
+// A nil Downlink and nil error are returned if nothing was received.
+func ListenDownlink(session *Session) (*Downlink, error) {
+	return defaultStack.listenDownlink(session)
+}
+
+func (st *Stack) listenDownlink(session *Session) (*Downlink, error) {
+	if st.Radio == nil {
+		return nil, ErrNoRadioAttached
+	}
+
+	if st.Region == nil {
+		return nil, ErrUndefinedRegionSettings
+	}
+
+	rxDelay := time.Duration(session.RXDelay&0x0F) * time.Second
+	if rxDelay == 0 {
+		rxDelay = time.Second
+	}
+
+	if session.Class == ClassC {
+		dl, err := st.listenRXC(session, session.lastUplinkEnd.Add(rxDelay))
+		if err != nil {
+			return nil, err
+		}
+		if dl != nil {
+			ProcessMACCommands(dl.MACCommands, session, st.Region)
+			return dl, st.saveSession(session)
+		}
+	}
+
+	// RX1 data rate is the uplink one lowered by RX1DROffset
+	rx1 := st.Region.RX1Channel()
+	if dr, ok := st.Region.RX1DataRate(st.Region.DataRate(), (session.DLSettings>>4)&0x07); ok {
+		st.setChannelDataRate(rx1, dr)
+	}
+
+	dl, rx1Err := st.receiveDownlink(session, rx1, session.lastUplinkEnd.Add(rxDelay), LORA_RX1_TIMEOUT)
+	if dl != nil && rx1Err == nil {
+		ProcessMACCommands(dl.MACCommands, session, st.Region)
+		return dl, st.saveSession(session)
+	}
+
+	dl, err := st.receiveDownlink(session, st.rx2Channel(session), session.lastUplinkEnd.Add(rxDelay+time.Second), LORA_RX2_TIMEOUT)
+	if dl == nil && err == nil {
+		return nil, rx1Err
+	}
+	if err == nil {
+		ProcessMACCommands(dl.MACCommands, session, st.Region)
+		err = st.saveSession(session)
+	}
+	return dl, err
+}
+
+// rx2Channel returns the RX2 channel of the session, the network server may
+// have changed its frequency and data rate
+func (st *Stack) rx2Channel(session *Session) region.Channel {
+	rx2 := st.Region.RX2Channel()
+	if session.RX2Frequency != 0 {
+		rx2.SetFrequency(session.RX2Frequency)
+	}
+	st.setChannelDataRate(rx2, session.DLSettings&0x0F)
+	return rx2
+}
+
+// setChannelDataRate sets the modulation of a receive window channel, unless
+// dr is not a regional downlink data rate
+func (st *Stack) setChannelDataRate(ch region.Channel, dr uint8) {
+	if sf, bw, ok := st.Region.DownlinkDataRate(dr); ok {
+		ch.SetSpreadingFactor(sf)
+		ch.SetBandwidth(bw)
+	}
+}
+
+// receiveDownlink waits for the receive window opening and listens on ch
+func (st *Stack) receiveDownlink(session *Session, ch region.Channel, open time.Time, timeoutMs uint32) (*Downlink, error) {
+	if wait := time.Until(open); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	st.applyChannelConfig(ch)
+	st.Radio.SetIqMode(lora.IQInverted)
+	pkt, err := st.receive(timeoutMs)
+	if err != nil || pkt == nil {
+		return nil, err
+	}
+
+	return session.decodeRxPacket(pkt)
+}
+
+// transmit sends payload with the radio, waiting for the TxDone event of
+// an asynchronous radio
+func (st *Stack) transmit(payload []uint8) error {
+	if r, ok := st.Radio.(lora.AsyncRadio); ok {
+		return lora.AsyncTx(r, payload, LORA_TX_TIMEOUT)
+	}
+	return st.Radio.Tx(payload, LORA_TX_TIMEOUT)
+}
+
+// receive listens with the radio for timeoutMs and returns the packet
+// received with its link quality. A nil packet and nil error are returned
+// if nothing was received, radio failures are returned as a RadioError.
+func (st *Stack) receive(timeoutMs uint32) (*lora.RxPacket, error) {
+	pkt, err := lora.Receive(st.Radio, timeoutMs)
+	if errors.Is(err, lora.ErrRxTimeout) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &RadioError{ErrRxFailed, err}
+	}
+	return pkt, nil
+}
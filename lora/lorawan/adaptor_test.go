@@ -1,8 +1,10 @@
 package lorawan
 
 import (
+	"encoding/binary"
 	"errors"
 	"testing"
+	"time"
 
 	"tinygo.org/x/wireless/lora"
 	"tinygo.org/x/wireless/lora/lorawan/region"
@@ -23,6 +25,7 @@ type mockRadio struct {
 	syncWord        uint16
 
 	txCalled    bool
+	txCount     int
 	txPayload   []uint8
 	txTimeout   uint32
 	txError     error
@@ -49,6 +52,7 @@ func (m *mockRadio) LoraConfig(cnf lora.Config)    {}
 
 func (m *mockRadio) Tx(pkt []uint8, timeout uint32) error {
 	m.txCalled = true
+	m.txCount++
 	m.txPayload = pkt
 	m.txTimeout = timeout
 	return m.txError
@@ -60,6 +64,51 @@ func (m *mockRadio) Rx(timeout uint32) ([]uint8, error) {
 	return m.rxResponse, m.rxError
 }
 
+// mockAsyncRadio implements lora.AsyncRadio interface for testing, the
+// operations end with events built from the mockRadio results, or never
+// when silent is set
+type mockAsyncRadio struct {
+	mockRadio
+	events    chan lora.RadioEvent
+	silent    bool
+	started   int
+	cancelled int
+}
+
+func newMockAsyncRadio() *mockAsyncRadio {
+	return &mockAsyncRadio{events: make(chan lora.RadioEvent, 1)}
+}
+
+func (m *mockAsyncRadio) StartTx(pkt []uint8, timeout uint32) error {
+	m.started++
+	m.txPayload = pkt
+	m.txTimeout = timeout
+	if m.txError != nil {
+		m.events <- lora.NewRadioEvent(lora.RadioEventTimeout, 0, nil)
+	} else {
+		m.events <- lora.NewRadioEvent(lora.RadioEventTxDone, 0, nil)
+	}
+	return nil
+}
+
+func (m *mockAsyncRadio) StartRx(timeout uint32) error {
+	m.started++
+	m.rxTimeout = timeout
+	switch {
+	case m.silent:
+	case m.rxError == lora.ErrCrcError:
+		m.events <- lora.NewRadioEvent(lora.RadioEventCrcError, 0, nil)
+	case m.rxResponse != nil:
+		m.events <- lora.NewRadioEvent(lora.RadioEventRxDone, 0, m.rxResponse)
+	default:
+		m.events <- lora.NewRadioEvent(lora.RadioEventTimeout, 0, nil)
+	}
+	return nil
+}
+
+func (m *mockAsyncRadio) Cancel()                        { m.cancelled++ }
+func (m *mockAsyncRadio) Events() <-chan lora.RadioEvent { return m.events }
+
 // mockChannel implements region.Channel interface for testing
 type mockChannel struct {
 	frequency       uint32
@@ -94,17 +143,62 @@ type mockSettings struct {
 	joinRequestCh region.Channel
 	joinAcceptCh  region.Channel
 	uplinkCh      region.Channel
+	rx1Ch         region.Channel
+	rx2Ch         region.Channel
+	dataRate      uint8
+	txPower       uint8
+	wait          time.Duration
+	maxPayload    uint8
+	beaconCh      region.Channel
+	pingCh        region.Channel
 }
 
 func (m *mockSettings) JoinRequestChannel() region.Channel { return m.joinRequestCh }
 func (m *mockSettings) JoinAcceptChannel() region.Channel  { return m.joinAcceptCh }
 func (m *mockSettings) UplinkChannel() region.Channel      { return m.uplinkCh }
+func (m *mockSettings) UplinkChannelIndex() uint8          { return 0 }
+func (m *mockSettings) RX1Channel() region.Channel         { return m.rx1Ch }
+func (m *mockSettings) RX2Channel() region.Channel         { return m.rx2Ch }
+func (m *mockSettings) DataRate() uint8                    { return m.dataRate }
+func (m *mockSettings) SetDataRate(dr uint8) bool          { m.dataRate = dr; return true }
+func (m *mockSettings) TxPower() uint8                     { return m.txPower }
+func (m *mockSettings) SetTxPower(index uint8) bool        { m.txPower = index; return true }
+func (m *mockSettings) DownlinkDataRate(dr uint8) (uint8, uint8, bool) {
+	return 0, 0, false
+}
+func (m *mockSettings) UplinkDataRate(dr uint8) (uint8, uint8, bool) {
+	return 0, 0, false
+}
+func (m *mockSettings) MaxPayload(dr uint8) uint8                        { return m.maxPayload }
+func (m *mockSettings) RX1DataRate(dr uint8, offset uint8) (uint8, bool) { return 0, false }
+func (m *mockSettings) ValidDownlinkFrequency(freq uint32) bool          { return true }
+func (m *mockSettings) NewChannel(index uint8, freq uint32, minDR uint8, maxDR uint8) (bool, bool) {
+	return true, true
+}
+func (m *mockSettings) DlChannel(index uint8, freq uint32) (bool, bool)     { return true, true }
+func (m *mockSettings) MinDataRate() uint8                                  { return 0 }
+func (m *mockSettings) ApplyCFList(cfList [16]uint8) bool                   { return true }
+func (m *mockSettings) TxParamSetup(up bool, down bool, eirp uint8) bool    { return false }
+func (m *mockSettings) TransmissionDone(freq uint32, airtime time.Duration) {}
+func (m *mockSettings) WaitTime(freq uint32) time.Duration                  { return m.wait }
+func (m *mockSettings) EnableDefaultChannels()                              {}
+func (m *mockSettings) BeaconChannel(beaconTime uint32) (region.Channel, bool) {
+	return m.beaconCh, m.beaconCh != nil
+}
+func (m *mockSettings) PingSlotChannel(devAddr uint32, beaconTime uint32) (region.Channel, bool) {
+	return m.pingCh, m.pingCh != nil
+}
+func (m *mockSettings) SetBeaconFrequency(freq uint32) bool { return m.beaconCh != nil }
+func (m *mockSettings) SetPingSlotChannel(freq uint32, dr uint8) (bool, bool) {
+	return m.pingCh != nil, m.pingCh != nil
+}
+func (m *mockSettings) LinkADR(dr uint8, txPower uint8, masks []region.ChannelMask) (bool, bool, bool) {
+	return true, true, true
+}
 
-// Helper to reset global state before each test
+// Helper to reset the default stack before each test
 func resetGlobalState() {
-	ActiveRadio = nil
-	regionSettings = nil
-	Retries = 15
+	defaultStack = &Stack{Retries: DEFAULT_RETRIES}
 }
 
 func TestErrorDefinitions(t *testing.T) {
@@ -125,6 +219,28 @@ func TestErrorDefinitions(t *testing.T) {
 		{"ErrInvalidNwkSKeyLength", ErrInvalidNwkSKeyLength, "invalid NwkSKey length"},
 		{"ErrInvalidAppSKeyLength", ErrInvalidAppSKeyLength, "invalid AppSKey length"},
 		{"ErrUndefinedRegionSettings", ErrUndefinedRegionSettings, "undefined Regionnal Settings "},
+		{"ErrInvalidMessageType", ErrInvalidMessageType, "invalid message type"},
+		{"ErrInvalidDevAddr", ErrInvalidDevAddr, "DevAddr does not match session"},
+		{"ErrInvalidFCntDown", ErrInvalidFCntDown, "invalid downlink frame counter"},
+		{"ErrNoAckReceived", ErrNoAckReceived, "no ACK received for confirmed uplink"},
+		{"ErrFOptsTooLarge", ErrFOptsTooLarge, "FOpts too large"},
+		{"ErrInvalidFPort", ErrInvalidFPort, "invalid FPort"},
+		{"ErrInvalidMACCommand", ErrInvalidMACCommand, "invalid MAC command"},
+		{"ErrNotActivated", ErrNotActivated, "session is not activated"},
+		{"ErrUndefinedSessionKeys", ErrUndefinedSessionKeys, "undefined DevAddr or session keys"},
+		{"ErrInvalidNwkKeyLength", ErrInvalidNwkKeyLength, "invalid NwkKey length"},
+		{"ErrInvalidJoinNonce", ErrInvalidJoinNonce, "JoinNonce was already used"},
+		{"ErrNoStoredState", ErrNoStoredState, "no stored state"},
+		{"ErrInvalidStoredState", ErrInvalidStoredState, "invalid stored state"},
+		{"ErrFCntUpExhausted", ErrFCntUpExhausted, "uplink frame counter exhausted, rejoin required"},
+		{"ErrFCntDownExhausted", ErrFCntDownExhausted, "downlink frame counter exhausted, rejoin required"},
+		{"ErrNotClassC", ErrNotClassC, "session is not Class C"},
+		{"ErrNotClassB", ErrNotClassB, "session is not Class B"},
+		{"ErrClassBUnsupported", ErrClassBUnsupported, "Class B is not supported by the region"},
+		{"ErrNoBeaconReceived", ErrNoBeaconReceived, "no beacon received"},
+		{"ErrBeaconLost", ErrBeaconLost, "beacon lost, switched back to Class A"},
+		{"ErrTxFailed", ErrTxFailed, "radio transmission failed"},
+		{"ErrRxFailed", ErrRxFailed, "radio reception failed"},
 	}
 
 	for _, tt := range tests {
@@ -153,6 +269,28 @@ func TestErrorsAreDistinct(t *testing.T) {
 		ErrInvalidNwkSKeyLength,
 		ErrInvalidAppSKeyLength,
 		ErrUndefinedRegionSettings,
+		ErrInvalidMessageType,
+		ErrInvalidDevAddr,
+		ErrInvalidFCntDown,
+		ErrNoAckReceived,
+		ErrFOptsTooLarge,
+		ErrInvalidFPort,
+		ErrInvalidMACCommand,
+		ErrNotActivated,
+		ErrUndefinedSessionKeys,
+		ErrInvalidNwkKeyLength,
+		ErrInvalidJoinNonce,
+		ErrNoStoredState,
+		ErrInvalidStoredState,
+		ErrFCntUpExhausted,
+		ErrFCntDownExhausted,
+		ErrNotClassC,
+		ErrNotClassB,
+		ErrClassBUnsupported,
+		ErrNoBeaconReceived,
+		ErrBeaconLost,
+		ErrTxFailed,
+		ErrRxFailed,
 	}
 
 	for i, err1 := range allErrors {
@@ -174,8 +312,8 @@ func TestConstants(t *testing.T) {
 }
 
 func TestDefaultRetries(t *testing.T) {
-	if Retries != 15 {
-		t.Errorf("Retries = %d, want 15", Retries)
+	if defaultStack.Retries != 15 {
+		t.Errorf("Retries = %d, want 15", defaultStack.Retries)
 	}
 }
 
@@ -186,8 +324,8 @@ func TestUseRadio(t *testing.T) {
 	radio := &mockRadio{}
 	UseRadio(radio)
 
-	if ActiveRadio != radio {
-		t.Error("UseRadio did not set ActiveRadio correctly")
+	if defaultStack.Radio != radio {
+		t.Error("UseRadio did not set the default stack radio")
 	}
 }
 
@@ -201,7 +339,7 @@ func TestUseRadioPanicsWhenAlreadySet(t *testing.T) {
 		}
 	}()
 
-	ActiveRadio = &mockRadio{}
+	defaultStack.Radio = &mockRadio{}
 	UseRadio(&mockRadio{})
 }
 
@@ -212,8 +350,8 @@ func TestUseRegionSettings(t *testing.T) {
 	settings := &mockSettings{}
 	UseRegionSettings(settings)
 
-	if regionSettings != settings {
-		t.Error("UseRegionSettings did not set regionSettings correctly")
+	if defaultStack.Region != settings {
+		t.Error("UseRegionSettings did not set defaultStack.Region correctly")
 	}
 }
 
@@ -222,7 +360,7 @@ func TestSetPublicNetworkTrue(t *testing.T) {
 	defer resetGlobalState()
 
 	radio := &mockRadio{}
-	ActiveRadio = radio
+	defaultStack.Radio = radio
 
 	SetPublicNetwork(true)
 	if !radio.publicNetwork {
@@ -235,7 +373,7 @@ func TestSetPublicNetworkFalse(t *testing.T) {
 	defer resetGlobalState()
 
 	radio := &mockRadio{publicNetwork: true}
-	ActiveRadio = radio
+	defaultStack.Radio = radio
 
 	SetPublicNetwork(false)
 	if radio.publicNetwork {
@@ -261,7 +399,7 @@ func TestJoinWithNoRegionSettings(t *testing.T) {
 	defer resetGlobalState()
 
 	radio := &mockRadio{}
-	ActiveRadio = radio
+	defaultStack.Radio = radio
 
 	otaa := &Otaa{}
 	session := &Session{}
@@ -272,10 +410,21 @@ func TestJoinWithNoRegionSettings(t *testing.T) {
 	}
 }
 
+func TestSendUplinkWithNoRadio(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}}
+	if err := SendUplink([]byte("test"), testDownlinkSession()); err != ErrNoRadioAttached {
+		t.Errorf("SendUplink() error = %v, want %v", err, ErrNoRadioAttached)
+	}
+}
+
 func TestSendUplinkWithNoRegionSettings(t *testing.T) {
 	resetGlobalState()
 	defer resetGlobalState()
 
+	defaultStack.Radio = &mockRadio{}
 	session := &Session{}
 	err := SendUplink([]byte("test"), session)
 	if err != ErrUndefinedRegionSettings {
@@ -283,15 +432,375 @@ func TestSendUplinkWithNoRegionSettings(t *testing.T) {
 	}
 }
 
-func TestListenDownlink(t *testing.T) {
-	err := ListenDownlink()
+func TestListenDownlinkWithNoRadio(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	_, err := ListenDownlink(&Session{})
+	if err != ErrNoRadioAttached {
+		t.Errorf("ListenDownlink() error = %v, want %v", err, ErrNoRadioAttached)
+	}
+}
+
+func TestListenDownlinkNothingReceived(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{
+		rx1Ch: &mockChannel{frequency: 868100000},
+		rx2Ch: &mockChannel{frequency: 869525000},
+	}
+	// windows are already open, do not wait for them
+	s := &Session{lastUplinkEnd: time.Now().Add(-5 * time.Second)}
+
+	dl, err := ListenDownlink(s)
+	if err != nil {
+		t.Fatalf("ListenDownlink() error = %v", err)
+	}
+	if dl != nil {
+		t.Errorf("ListenDownlink() = %v, want nil", dl)
+	}
+	// last window listened is RX2
+	if radio.frequency != 869525000 {
+		t.Errorf("radio frequency = %d, want RX2 869525000", radio.frequency)
+	}
+	if radio.iqMode != lora.IQInverted {
+		t.Errorf("radio IQ mode = %d, want inverted", radio.iqMode)
+	}
+}
+
+func TestListenDownlinkReceived(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	s := testDownlinkSession()
+	radio := &mockRadio{rxResponse: genTestDownlink(s, MTypeUnconfirmedDataDown, fCtrlDownACK, nil, 0, 2, []uint8("cfg"))}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{
+		rx1Ch: &mockChannel{frequency: 868100000},
+		rx2Ch: &mockChannel{frequency: 869525000},
+	}
+	s.lastUplinkEnd = time.Now().Add(-5 * time.Second)
+
+	dl, err := ListenDownlink(s)
+	if err != nil {
+		t.Fatalf("ListenDownlink() error = %v", err)
+	}
+	if dl == nil || !dl.ACK || dl.FPort != 2 || string(dl.Payload) != "cfg" {
+		t.Errorf("ListenDownlink() = %+v, want ACK on FPort 2 with payload cfg", dl)
+	}
+	// frame was received in RX1
+	if radio.frequency != 868100000 {
+		t.Errorf("radio frequency = %d, want RX1 868100000", radio.frequency)
+	}
+	if radio.rxTimeout != LORA_RX1_TIMEOUT {
+		t.Errorf("radio rx timeout = %d, want %d", radio.rxTimeout, LORA_RX1_TIMEOUT)
+	}
+}
+
+func TestSendUplinkNotActivated(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}}
+
+	err := SendUplink([]byte("test"), &Session{})
+	if err != ErrNotActivated {
+		t.Errorf("SendUplink() error = %v, want %v", err, ErrNotActivated)
+	}
+	if radio.txCalled {
+		t.Error("SendUplink() transmitted on a session never activated")
+	}
+}
+
+func TestSendUplinkPayloadTooLarge(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}, maxPayload: 11}
+	s := testDownlinkSession()
+
+	err := SendUplink(make([]byte, 12), s)
+	if err != ErrFrmPayloadTooLarge {
+		t.Errorf("SendUplink() error = %v, want %v", err, ErrFrmPayloadTooLarge)
+	}
+	if radio.txCalled {
+		t.Error("SendUplink() transmitted a payload too large for the data rate")
+	}
+	if s.FCntUp != 0 {
+		t.Errorf("FCntUp = %d, want unchanged 0", s.FCntUp)
+	}
+}
+
+func TestSendConfirmedUplinkWithNoRegionSettings(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Radio = &mockRadio{}
+	_, err := SendConfirmedUplink([]byte("test"), &Session{})
+	if err != ErrUndefinedRegionSettings {
+		t.Errorf("SendConfirmedUplink() error = %v, want %v", err, ErrUndefinedRegionSettings)
+	}
+}
+
+func TestSendConfirmedUplinkAcked(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	s := testDownlinkSession()
+	radio := &mockRadio{rxResponse: genTestDownlink(s, MTypeUnconfirmedDataDown, fCtrlDownACK, nil, 0, 0, nil)}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{
+		uplinkCh: &mockChannel{frequency: 868100000},
+		rx1Ch:    &mockChannel{frequency: 868100000},
+		rx2Ch:    &mockChannel{frequency: 869525000},
+	}
+
+	dl, err := SendConfirmedUplink([]byte("test"), s)
 	if err != nil {
-		t.Errorf("ListenDownlink() error = %v, want nil", err)
+		t.Fatalf("SendConfirmedUplink() error = %v", err)
+	}
+	if !dl.ACK {
+		t.Error("downlink ACK = false, want true")
+	}
+	if radio.txPayload[0] != MTypeConfirmedDataUp<<5 {
+		t.Errorf("MHDR = 0x%02X, want 0x%02X", radio.txPayload[0], MTypeConfirmedDataUp<<5)
+	}
+}
+
+func TestSendConfirmedUplinkNoAck(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Retries = 1
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	uplinkCh := &mockChannel{frequency: 868100000}
+	defaultStack.Region = &mockSettings{
+		uplinkCh: uplinkCh,
+		rx1Ch:    &mockChannel{frequency: 868100000},
+		rx2Ch:    &mockChannel{frequency: 869525000},
+	}
+
+	_, err := SendConfirmedUplink([]byte("test"), testDownlinkSession())
+	if !errors.Is(err, ErrNoAckReceived) || !errors.Is(err, lora.ErrRxTimeout) {
+		t.Errorf("SendConfirmedUplink() error = %v, want %v and %v", err, ErrNoAckReceived, lora.ErrRxTimeout)
+	}
+	if radio.txCount != 1 {
+		t.Errorf("transmissions = %d, want 1", radio.txCount)
+	}
+}
+
+func TestSendConfirmedUplinkTxError(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Radio = &mockRadio{txError: lora.ErrTxTimeout}
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}}
+
+	_, err := SendConfirmedUplink([]byte("test"), testDownlinkSession())
+	if !errors.Is(err, ErrTxFailed) || !errors.Is(err, lora.ErrTxTimeout) {
+		t.Errorf("SendConfirmedUplink() error = %v, want %v and %v", err, ErrTxFailed, lora.ErrTxTimeout)
+	}
+}
+
+func TestJoinRadioErrors(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Region = &mockSettings{
+		joinRequestCh: &mockChannel{frequency: 868100000},
+		joinAcceptCh:  &mockChannel{frequency: 868100000},
+	}
+
+	// a dead radio
+	defaultStack.Radio = &mockRadio{txError: lora.ErrTxTimeout}
+	if err := Join(testOtaa(), &Session{}); !errors.Is(err, lora.ErrTxTimeout) || errors.Is(err, ErrNoJoinAcceptReceived) {
+		t.Errorf("Join() error = %v, want %v", err, lora.ErrTxTimeout)
+	}
+
+	// no gateway
+	resetGlobalState()
+	defaultStack.Region = &mockSettings{
+		joinRequestCh: &mockChannel{frequency: 868100000},
+		joinAcceptCh:  &mockChannel{frequency: 868100000},
+	}
+	defaultStack.Radio = &mockRadio{}
+	if err := Join(testOtaa(), &Session{}); !errors.Is(err, ErrNoJoinAcceptReceived) || !errors.Is(err, lora.ErrRxTimeout) {
+		t.Errorf("Join() error = %v, want %v and %v", err, ErrNoJoinAcceptReceived, lora.ErrRxTimeout)
+	}
+}
+
+// hoppingChannel is a mockChannel with hops more channels to try
+type hoppingChannel struct {
+	mockChannel
+	hops int
+}
+
+func (c *hoppingChannel) Next() bool {
+	c.hops--
+	return c.hops >= 0
+}
+
+// recordingRadio is a mockRadio keeping every packet sent, onRx is called
+// when it listens
+type recordingRadio struct {
+	mockRadio
+	sent [][]uint8
+	onRx func()
+}
+
+func (r *recordingRadio) Tx(pkt []uint8, timeout uint32) error {
+	r.sent = append(r.sent, pkt)
+	return r.mockRadio.Tx(pkt, timeout)
+}
+
+func (r *recordingRadio) Rx(timeout uint32) ([]uint8, error) {
+	if r.onRx != nil {
+		r.onRx()
+	}
+	return r.mockRadio.Rx(timeout)
+}
+
+func TestJoinRetriesUseNewDevNonce(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	st := &MemoryStore{}
+	// The join back-off elapses while waiting for the join accept
+	radio := &recordingRadio{onRx: func() { defaultStack.joinAvailableAt = time.Time{} }}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{
+		joinRequestCh: &hoppingChannel{mockChannel: mockChannel{frequency: 868100000}, hops: 2},
+		joinAcceptCh:  &mockChannel{frequency: 868100000},
+	}
+	UseStore(st)
+
+	if err := Join(testOtaa(), &Session{}); !errors.Is(err, ErrNoJoinAcceptReceived) {
+		t.Fatalf("Join() error = %v, want %v", err, ErrNoJoinAcceptReceived)
+	}
+	if len(radio.sent) != 3 {
+		t.Fatalf("sent %d join requests, want 3", len(radio.sent))
+	}
+	first := binary.LittleEndian.Uint16(radio.sent[0][17:19])
+	for i, pkt := range radio.sent {
+		if devNonce := binary.LittleEndian.Uint16(pkt[17:19]); devNonce != first+uint16(i) {
+			t.Errorf("join request %d DevNonce = %d, want %d", i, devNonce, first+uint16(i))
+		}
+	}
+	restored := &Otaa{}
+	st.LoadNonces(restored)
+	if got := binary.LittleEndian.Uint16(restored.devNonce[:]); got != first+2 {
+		t.Errorf("stored DevNonce = %d, want %d", got, first+2)
+	}
+}
+
+func TestSendUplinkTxError(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Radio = &mockRadio{txError: lora.ErrTxTimeout}
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}}
+
+	err := SendUplink([]byte("test"), testDownlinkSession())
+	var radioErr *RadioError
+	if !errors.As(err, &radioErr) || radioErr.Op != ErrTxFailed || radioErr.Err != lora.ErrTxTimeout {
+		t.Errorf("SendUplink() error = %v, want a RadioError", err)
+	}
+	if err.Error() != "radio transmission failed: radio Tx timeout" {
+		t.Errorf("SendUplink() error = %q", err.Error())
+	}
+}
+
+func TestListenDownlinkRadioErrors(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Region = &mockSettings{
+		rx1Ch: &mockChannel{frequency: 868100000},
+		rx2Ch: &mockChannel{frequency: 869525000},
+	}
+	s := testDownlinkSession()
+	s.lastUplinkEnd = time.Now().Add(-5 * time.Second)
+
+	// a driver reporting the timeout as an error is nothing received
+	defaultStack.Radio = &mockRadio{rxError: lora.ErrRxTimeout}
+	if dl, err := ListenDownlink(s); dl != nil || err != nil {
+		t.Errorf("ListenDownlink() = %v, %v, want nothing received", dl, err)
+	}
+
+	defaultStack.Radio = &mockRadio{rxError: lora.ErrCrcError}
+	if _, err := ListenDownlink(s); !errors.Is(err, ErrRxFailed) || !errors.Is(err, lora.ErrCrcError) {
+		t.Errorf("ListenDownlink() error = %v, want %v and %v", err, ErrRxFailed, lora.ErrCrcError)
+	}
+
+	// a frame with a wrong MIC
+	frame := genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 2, []uint8("on"))
+	frame[len(frame)-1] ^= 0xFF
+	defaultStack.Radio = &mockRadio{rxResponse: frame}
+	if _, err := ListenDownlink(s); !errors.Is(err, ErrInvalidMic) {
+		t.Errorf("ListenDownlink() error = %v, want %v", err, ErrInvalidMic)
+	}
+}
+
+func TestAsyncRadio(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	s := testDownlinkSession()
+	radio := newMockAsyncRadio()
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{
+		uplinkCh: &mockChannel{frequency: 868100000},
+		rx1Ch:    &mockChannel{frequency: 868100000},
+		rx2Ch:    &mockChannel{frequency: 869525000},
+	}
+
+	if err := SendUplink([]byte("test"), s); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	if radio.started != 1 || radio.txCalled || radio.txPayload == nil {
+		t.Errorf("%d operations started, Tx called %v, want the uplink sent with StartTx", radio.started, radio.txCalled)
+	}
+
+	radio.rxResponse = genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 2, []uint8("on"))
+	s.lastUplinkEnd = time.Now().Add(-5 * time.Second)
+	dl, err := ListenDownlink(s)
+	if err != nil || dl == nil || string(dl.Payload) != "on" {
+		t.Fatalf("ListenDownlink() = %+v, %v, want payload on", dl, err)
+	}
+	if radio.rxCalled || radio.rxTimeout != LORA_RX1_TIMEOUT {
+		t.Errorf("Rx called %v, timeout %d, want StartRx for RX1", radio.rxCalled, radio.rxTimeout)
+	}
+
+	radio.txError = lora.ErrTxTimeout
+	if err := SendUplink([]byte("test"), s); !errors.Is(err, ErrTxFailed) || !errors.Is(err, lora.ErrTxTimeout) {
+		t.Errorf("SendUplink() error = %v, want %v and %v", err, ErrTxFailed, lora.ErrTxTimeout)
+	}
+	radio.rxError = lora.ErrCrcError
+	if _, err := ListenDownlink(s); !errors.Is(err, ErrRxFailed) || !errors.Is(err, lora.ErrCrcError) {
+		t.Errorf("ListenDownlink() error = %v, want %v and %v", err, ErrRxFailed, lora.ErrCrcError)
+	}
+}
+
+func TestAckTimeout(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := ackTimeout()
+		if d < ACK_TIMEOUT_MIN*time.Millisecond || d >= (ACK_TIMEOUT_MIN+ACK_TIMEOUT_SPREAD)*time.Millisecond {
+			t.Fatalf("ackTimeout() = %v, want within [1s, 3s)", d)
+		}
 	}
 }
 
 func TestMockRadioImplementsInterface(t *testing.T) {
 	var _ lora.Radio = (*mockRadio)(nil)
+	var _ lora.AsyncRadio = (*mockAsyncRadio)(nil)
 }
 
 func TestMockChannelImplementsInterface(t *testing.T) {
@@ -303,16 +812,16 @@ func TestMockSettingsImplementsInterface(t *testing.T) {
 }
 
 func TestRetriesCanBeModified(t *testing.T) {
-	originalRetries := Retries
-	defer func() { Retries = originalRetries }()
+	originalRetries := defaultStack.Retries
+	defer func() { defaultStack.Retries = originalRetries }()
 
-	Retries = 5
-	if Retries != 5 {
-		t.Errorf("Retries = %d, want 5", Retries)
+	defaultStack.Retries = 5
+	if defaultStack.Retries != 5 {
+		t.Errorf("Retries = %d, want 5", defaultStack.Retries)
 	}
 
-	Retries = 20
-	if Retries != 20 {
-		t.Errorf("Retries = %d, want 20", Retries)
+	defaultStack.Retries = 20
+	if defaultStack.Retries != 20 {
+		t.Errorf("Retries = %d, want 20", defaultStack.Retries)
 	}
 }
@@ -0,0 +1,51 @@
+package lorawan
+
+import "tinygo.org/x/wireless/lora/lorawan/region"
+
+// Device side Adaptive Data Rate back-off parameters
+const (
+	ADR_ACK_LIMIT = 64
+	ADR_ACK_DELAY = 32
+)
+
+// adrUplink runs the ADR back-off before an uplink is sent. It returns true
+// when the uplink must request a downlink with ADRACKReq.
+// ADR_ACK_CNT counts uplinks since the last downlink. Once it reaches
+// ADR_ACK_LIMIT ADRACKReq is set, and if the network still does not answer,
+// every ADR_ACK_DELAY uplinks the TX power is raised to its maximum, then the
+// data rate is lowered one step at a time, until the default channels are
+// used at the lowest data rate.
+func (s *Session) adrUplink(rs region.Settings) bool {
+	if !s.ADR {
+		return false
+	}
+
+	if s.ADRAckCnt >= ADR_ACK_LIMIT+ADR_ACK_DELAY && (s.ADRAckCnt-ADR_ACK_LIMIT)%ADR_ACK_DELAY == 0 {
+		adrBackoff(rs)
+	}
+
+	// Nothing more can be done once at maximum power and lowest data rate
+	lowest := rs.TxPower() == 0 && rs.DataRate() == rs.MinDataRate()
+	req := s.ADRAckCnt >= ADR_ACK_LIMIT && !lowest
+	s.ADRAckCnt++
+	return req
+}
+
+// adrBackoff does one step of the ADR back-off
+func adrBackoff(rs region.Settings) {
+	if rs.TxPower() != 0 {
+		rs.SetTxPower(0)
+		return
+	}
+
+	dr := rs.DataRate()
+	if dr == rs.MinDataRate() {
+		rs.EnableDefaultChannels()
+		return
+	}
+	if !rs.SetDataRate(dr - 1) {
+		// lower data rate is not available on the channels in use
+		rs.EnableDefaultChannels()
+		rs.SetDataRate(dr - 1)
+	}
+}
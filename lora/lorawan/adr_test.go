@@ -0,0 +1,119 @@
+package lorawan
+
+import (
+	"testing"
+
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+func TestADRDisabled(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.EU868()
+
+	for i := 0; i < ADR_ACK_LIMIT+2*ADR_ACK_DELAY; i++ {
+		if s.adrUplink(rs) {
+			t.Fatalf("uplink %d requested ADRACKReq with ADR disabled", i)
+		}
+	}
+	if s.ADRAckCnt != 0 {
+		t.Errorf("ADRAckCnt = %d, want 0", s.ADRAckCnt)
+	}
+}
+
+func TestADRAckReq(t *testing.T) {
+	s := testDownlinkSession()
+	s.ADR = true
+	rs := region.EU868()
+	rs.SetDataRate(5)
+	rs.SetTxPower(3)
+
+	for i := 0; i < ADR_ACK_LIMIT; i++ {
+		if s.adrUplink(rs) {
+			t.Fatalf("uplink %d requested ADRACKReq before ADR_ACK_LIMIT", i)
+		}
+	}
+	// ADRACKReq is set from ADR_ACK_LIMIT, settings are kept for ADR_ACK_DELAY uplinks
+	for i := 0; i < ADR_ACK_DELAY; i++ {
+		if !s.adrUplink(rs) {
+			t.Fatalf("uplink %d did not request ADRACKReq", ADR_ACK_LIMIT+i)
+		}
+	}
+	if rs.TxPower() != 3 || rs.DataRate() != 5 {
+		t.Errorf("TxPower = %d, DataRate = %d, want unchanged 3 and 5", rs.TxPower(), rs.DataRate())
+	}
+
+	// TX power is first set to its maximum
+	s.adrUplink(rs)
+	if rs.TxPower() != 0 || rs.DataRate() != 5 {
+		t.Errorf("TxPower = %d, DataRate = %d, want 0 and 5", rs.TxPower(), rs.DataRate())
+	}
+
+	// then data rate is lowered every ADR_ACK_DELAY uplinks
+	for i := 0; i < ADR_ACK_DELAY; i++ {
+		s.adrUplink(rs)
+	}
+	if rs.DataRate() != 4 {
+		t.Errorf("DataRate = %d, want 4", rs.DataRate())
+	}
+
+	// a downlink resets the back-off
+	if _, err := s.DecodeDownlink(genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 0, nil)); err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if s.ADRAckCnt != 0 {
+		t.Errorf("ADRAckCnt = %d, want 0", s.ADRAckCnt)
+	}
+}
+
+func TestADRBackoffStopsAtLowestDataRate(t *testing.T) {
+	s := testDownlinkSession()
+	s.ADR = true
+	rs := region.EU868()
+	rs.SetDataRate(1)
+
+	for i := 0; i < ADR_ACK_LIMIT+3*ADR_ACK_DELAY; i++ {
+		s.adrUplink(rs)
+	}
+	if rs.DataRate() != 0 {
+		t.Errorf("DataRate = %d, want 0", rs.DataRate())
+	}
+	// lowest data rate at maximum power, ADRACKReq is useless
+	if s.adrUplink(rs) {
+		t.Error("ADRACKReq requested at lowest data rate and maximum power")
+	}
+}
+
+func TestADRBackoffEnablesDefaultChannels(t *testing.T) {
+	s := testDownlinkSession()
+	s.ADR = true
+	rs := region.US915()
+
+	// 500 kHz channel 64 only, DR4
+	rs.LinkADR(4, 0, []region.ChannelMask{{Cntl: 7, Mask: 0x0001}})
+	s.ADRAckCnt = ADR_ACK_LIMIT + ADR_ACK_DELAY
+
+	// DR3 needs the 125 kHz channels back
+	s.adrUplink(rs)
+	if rs.DataRate() != 3 {
+		t.Errorf("DataRate = %d, want 3", rs.DataRate())
+	}
+}
+
+func TestSendUplinkSetsADRBits(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}, dataRate: 3, txPower: 1}
+
+	s := testDownlinkSession()
+	s.ADR = true
+	s.ADRAckCnt = ADR_ACK_LIMIT
+	if err := SendUplink([]uint8{0x01}, s); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	if radio.txPayload[5]&(fCtrlUpADR|fCtrlUpADRACKReq) != fCtrlUpADR|fCtrlUpADRACKReq {
+		t.Errorf("FCtrl = 0x%02X, want ADR and ADRACKReq set", radio.txPayload[5])
+	}
+}
@@ -0,0 +1,128 @@
+package lorawan
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Class B timing, in milliseconds
+const (
+	BEACON_RESERVED = 2120 // after the beacon, no ping slot
+	BEACON_GUARD    = 3000 // before the beacon, no ping slot
+	BEACON_WINDOW   = 122880
+	PING_SLOT_LEN   = 30
+
+	// BEACONLESS_LIMIT is the time a device keeps its ping slots without
+	// receiving a beacon, in seconds, before switching back to Class A
+	BEACONLESS_LIMIT = 7200
+)
+
+// GPSLeapSeconds is the difference between GPS time and UTC, since 2017
+const GPSLeapSeconds = 18
+
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// GPSTime returns the GPS time of t, the time elapsed since the GPS epoch
+// without leap seconds, used by beacons and DeviceTimeAns
+func GPSTime(t time.Time) time.Duration {
+	return t.Sub(gpsEpoch) + GPSLeapSeconds*time.Second
+}
+
+// TimeFromGPS returns the time of a GPS time
+func TimeFromGPS(gps time.Duration) time.Time {
+	return gpsEpoch.Add(gps - GPSLeapSeconds*time.Second)
+}
+
+// Beacon is a Class B beacon, broadcast by the gateways every 128 seconds
+type Beacon struct {
+	Time uint32 // GPS time of the beacon, in seconds
+
+	// Gateway specific part, only valid if GwSpecificValid. InfoDesc 0 to 2
+	// give the coordinates of the gateway antenna 1 to 3 in Info.
+	GwSpecificValid bool
+	InfoDesc        uint8
+	Info            [6]uint8
+}
+
+// beaconRFU gives the size of the two RFU fields of the beacon frame formats,
+// indexed by the frame length: 17 bytes for SF9 and SF8 beacons (EU868
+// like), 23 bytes for the SF12 500 kHz beacons (US915 like)
+var beaconRFU = map[int]struct{ rfu1, rfu2 int }{
+	17: {2, 0},
+	23: {5, 3},
+}
+
+// DecodeBeacon decodes a beacon frame. The frame format is selected by its
+// length. ErrInvalidMic is returned if the CRC of the time field is wrong,
+// a wrong CRC of the gateway specific part only clears GwSpecificValid.
+func DecodeBeacon(b []uint8) (*Beacon, error) {
+	format, ok := beaconRFU[len(b)]
+	if !ok {
+		return nil, ErrInvalidPacketLength
+	}
+
+	// RFU | Time | CRC
+	common := b[:format.rfu1+6]
+	if crc16(common[:len(common)-2]) != binary.LittleEndian.Uint16(common[len(common)-2:]) {
+		return nil, ErrInvalidMic
+	}
+	beacon := &Beacon{Time: binary.LittleEndian.Uint32(common[format.rfu1:])}
+
+	// GwSpecific | RFU | CRC
+	gw := b[len(common):]
+	beacon.GwSpecificValid = crc16(gw[:len(gw)-2]) == binary.LittleEndian.Uint16(gw[len(gw)-2:])
+	beacon.InfoDesc = gw[0]
+	copy(beacon.Info[:], gw[1:7])
+	return beacon, nil
+}
+
+// GenBeacon builds a beacon frame of the given length, 17 or 23 bytes, as a
+// gateway would send it
+func (b *Beacon) GenBeacon(length int) ([]uint8, error) {
+	format, ok := beaconRFU[length]
+	if !ok {
+		return nil, ErrInvalidPacketLength
+	}
+
+	buf := make([]uint8, format.rfu1, length)
+	buf = binary.LittleEndian.AppendUint32(buf, b.Time)
+	buf = binary.LittleEndian.AppendUint16(buf, crc16(buf))
+	gw := len(buf)
+	buf = append(buf, b.InfoDesc)
+	buf = append(buf, b.Info[:]...)
+	buf = append(buf, make([]uint8, format.rfu2)...)
+	return binary.LittleEndian.AppendUint16(buf, crc16(buf[gw:])), nil
+}
+
+// Coordinates returns the latitude and longitude of the gateway antenna, in
+// degrees, when InfoDesc is 0 to 2
+func (b *Beacon) Coordinates() (lat float64, lng float64, ok bool) {
+	if !b.GwSpecificValid || b.InfoDesc > 2 {
+		return 0, 0, false
+	}
+	lat = float64(int24(b.Info[0:3])) * 90 / (1 << 23)
+	lng = float64(int24(b.Info[3:6])) * 180 / (1 << 23)
+	return lat, lng, true
+}
+
+// int24 decodes a 24 bits little endian signed integer
+func int24(b []uint8) int32 {
+	return int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+}
+
+// crc16 is the CRC-16/XMODEM of the beacon fields: polynomial 0x1021,
+// initial value 0
+func crc16(b []uint8) uint16 {
+	var crc uint16
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
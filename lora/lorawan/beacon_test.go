@@ -0,0 +1,73 @@
+package lorawan
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	if got := crc16([]uint8("123456789")); got != 0x31C3 {
+		t.Errorf("crc16() = %04x, want 31c3", got)
+	}
+}
+
+func TestGPSTime(t *testing.T) {
+	// 2000-01-01 was 630720013 seconds after the GPS epoch, with 13 leap
+	// seconds at the time: GPSTime uses the current 18
+	utc := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if got := GPSTime(utc); got != (630720000+GPSLeapSeconds)*time.Second {
+		t.Errorf("GPSTime() = %v", got)
+	}
+	if got := TimeFromGPS(GPSTime(utc)); !got.Equal(utc) {
+		t.Errorf("TimeFromGPS() = %v, want %v", got, utc)
+	}
+}
+
+func TestBeaconRoundTrip(t *testing.T) {
+	for _, length := range []int{17, 23} {
+		b := &Beacon{Time: 1334448000, InfoDesc: 0, Info: [6]uint8{0x00, 0x00, 0x20, 0x00, 0x00, 0xF0}}
+		frame, err := b.GenBeacon(length)
+		if err != nil {
+			t.Fatalf("GenBeacon(%d) error = %v", length, err)
+		}
+		if len(frame) != length {
+			t.Fatalf("GenBeacon(%d) length = %d", length, len(frame))
+		}
+
+		got, err := DecodeBeacon(frame)
+		if err != nil {
+			t.Fatalf("DecodeBeacon() error = %v", err)
+		}
+		if got.Time != b.Time || !got.GwSpecificValid || got.Info != b.Info {
+			t.Errorf("DecodeBeacon() = %+v, want %+v", got, b)
+		}
+		lat, lng, ok := got.Coordinates()
+		if !ok || lat != 22.5 || lng != -22.5 {
+			t.Errorf("Coordinates() = %v, %v, %v, want 22.5, -22.5, true", lat, lng, ok)
+		}
+	}
+}
+
+func TestDecodeBeaconErrors(t *testing.T) {
+	b := &Beacon{Time: 1334448000}
+	frame, _ := b.GenBeacon(17)
+
+	if _, err := DecodeBeacon(frame[:16]); err != ErrInvalidPacketLength {
+		t.Errorf("short frame error = %v, want %v", err, ErrInvalidPacketLength)
+	}
+
+	bad := bytes.Clone(frame)
+	bad[3] ^= 0xFF
+	if _, err := DecodeBeacon(bad); err != ErrInvalidMic {
+		t.Errorf("bad time CRC error = %v, want %v", err, ErrInvalidMic)
+	}
+
+	// a wrong gateway specific CRC keeps the time
+	bad = bytes.Clone(frame)
+	bad[10] ^= 0xFF
+	got, err := DecodeBeacon(bad)
+	if err != nil || got.Time != b.Time || got.GwSpecificValid {
+		t.Errorf("DecodeBeacon() = %+v, %v, want time without gateway specific part", got, err)
+	}
+}
@@ -0,0 +1,258 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+// RequestDeviceTime queues a DeviceTimeReq for the next uplink, the answer
+// synchronizes the device clock to the GPS time so that beacons can be found
+// without listening for a whole beacon period
+func (s *Session) RequestDeviceTime() {
+	s.pendingMAC = append(s.pendingMAC, CIDDeviceTime)
+}
+
+// RequestPingSlotInfo sets the ping slot periodicity, ping slots are opened
+// every 2^periodicity seconds, and queues a PingSlotInfoReq to tell it to
+// the network server
+func (s *Session) RequestPingSlotInfo(periodicity uint8) {
+	s.PingPeriodicity = periodicity & 0x07
+	s.pendingMAC = append(s.pendingMAC, CIDPingSlotInfo, s.PingPeriodicity)
+}
+
+// gpsNow returns the GPS time of the device clock, corrected by the last
+// synchronization
+func (s *Session) gpsNow() time.Duration {
+	return GPSTime(time.Now()) + s.gpsOffset
+}
+
+// localTime returns the device clock time of a GPS time
+func (s *Session) localTime(gps time.Duration) time.Time {
+	return TimeFromGPS(gps - s.gpsOffset)
+}
+
+// syncTime corrects the device clock, local is the time of GPS time gps
+func (s *Session) syncTime(gps time.Duration, local time.Time) {
+	s.gpsOffset = gps - GPSTime(local)
+	s.timeSynced = true
+}
+
+// devAddr returns the DevAddr of the session as an integer
+func (s *Session) devAddr() uint32 {
+	return binary.LittleEndian.Uint32(s.DevAddr[:])
+}
+
+// PingOffset returns the randomized offset of the first ping slot of
+// devAddr in the beacon period starting at beaconTime, in slots. pingPeriod
+// is the number of slots between two ping slots, 2^(5+periodicity).
+func PingOffset(beaconTime uint32, devAddr uint32, pingPeriod uint32) uint32 {
+	var block [16]uint8
+	binary.LittleEndian.PutUint32(block[0:4], beaconTime)
+	binary.LittleEndian.PutUint32(block[4:8], devAddr)
+	cipher, err := aes.NewCipher(make([]uint8, 16))
+	if err != nil {
+		panic(err)
+	}
+	cipher.Encrypt(block[:], block[:])
+	return (uint32(block[0]) + uint32(block[1])*256) % pingPeriod
+}
+
+// pingSlots returns the GPS times of the ping slots of the session in the
+// beacon period starting at beaconTime
+func (s *Session) pingSlots(beaconTime uint32) []time.Duration {
+	pingPeriod := uint32(1) << (5 + s.PingPeriodicity&0x07)
+	pingNb := 4096 / pingPeriod
+	offset := PingOffset(beaconTime, s.devAddr(), pingPeriod)
+
+	start := time.Duration(beaconTime)*time.Second + BEACON_RESERVED*time.Millisecond
+	slots := make([]time.Duration, pingNb)
+	for n := range slots {
+		slot := offset + uint32(n)*pingPeriod
+		slots[n] = start + time.Duration(slot)*PING_SLOT_LEN*time.Millisecond
+	}
+	return slots
+}
+
+// AcquireBeacon waits for the next beacon and synchronizes the device clock
+// on it. When the clock was synchronized with DeviceTimeReq, the radio only
+// listens when the beacon is expected. Otherwise it listens for a whole
+// beacon period, which can only find the beacon of regions with a single
+// beacon channel.
+func AcquireBeacon(session *Session) (*Beacon, error) {
+	return defaultStack.acquireBeacon(session)
+}
+
+func (st *Stack) acquireBeacon(session *Session) (*Beacon, error) {
+	if st.Radio == nil {
+		return nil, ErrNoRadioAttached
+	}
+
+	if st.Region == nil {
+		return nil, ErrUndefinedRegionSettings
+	}
+
+	beaconTime := nextBeaconTime(session.gpsNow())
+	open := session.localTime(time.Duration(beaconTime)*time.Second - LORA_BEACON_MARGIN*time.Millisecond)
+	timeout := uint32(LORA_BEACON_TIMEOUT)
+	if !session.timeSynced {
+		open = time.Now()
+		timeout = region.BEACON_PERIOD*1000 + LORA_BEACON_TIMEOUT
+	}
+
+	b, err := st.receiveBeacon(session, beaconTime, open, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, ErrNoBeaconReceived
+	}
+	return b, nil
+}
+
+// ListenClassB opens the ping slots of the session for duration, as a
+// Class B device does between uplinks, and calls handler with each downlink
+// received. Beacons are received to keep the device clock synchronized, the
+// first one is acquired with AcquireBeacon if needed. Without beacon for
+// BEACONLESS_LIMIT the session switches back to Class A and ErrBeaconLost
+// is returned.
+//
+// The radio cannot transmit while listening: uplinks are sent between calls
+// to ListenClassB.
+func ListenClassB(session *Session, duration time.Duration, handler func(*Downlink)) error {
+	return defaultStack.listenClassB(session, duration, handler)
+}
+
+func (st *Stack) listenClassB(session *Session, duration time.Duration, handler func(*Downlink)) error {
+	if st.Radio == nil {
+		return ErrNoRadioAttached
+	}
+
+	if st.Region == nil {
+		return ErrUndefinedRegionSettings
+	}
+
+	if session.Class != ClassB {
+		return ErrNotClassB
+	}
+
+	if session.lastBeacon == 0 {
+		if _, err := st.acquireBeacon(session); err != nil {
+			return err
+		}
+	}
+
+	until := time.Now().Add(duration)
+	for {
+		now := session.gpsNow()
+		beaconTime := nextBeaconTime(now) - region.BEACON_PERIOD
+
+		for _, slot := range session.pingSlots(beaconTime) {
+			if slot <= now {
+				continue
+			}
+			open := session.localTime(slot)
+			if open.After(until) {
+				return nil
+			}
+			dl, err := st.receivePingSlot(session, beaconTime, open)
+			if err != nil {
+				return err
+			}
+			if dl == nil {
+				continue
+			}
+			ProcessMACCommands(dl.MACCommands, session, st.Region)
+			if err := st.saveSession(session); err != nil {
+				return err
+			}
+			if handler != nil {
+				handler(dl)
+			}
+		}
+
+		// Track the next beacon
+		next := beaconTime + region.BEACON_PERIOD
+		open := session.localTime(time.Duration(next)*time.Second - LORA_BEACON_MARGIN*time.Millisecond)
+		if open.After(until) {
+			return nil
+		}
+		b, err := st.receiveBeacon(session, next, open, LORA_BEACON_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		if b == nil && next-session.lastBeacon > BEACONLESS_LIMIT {
+			session.Class = ClassA
+			return ErrBeaconLost
+		}
+	}
+}
+
+// nextBeaconTime returns the GPS time of the first beacon after gps, in seconds
+func nextBeaconTime(gps time.Duration) uint32 {
+	return (uint32(gps/time.Second)/region.BEACON_PERIOD + 1) * region.BEACON_PERIOD
+}
+
+// receiveBeacon listens for the beacon of beaconTime from open, and
+// synchronizes the device clock on it. A nil Beacon and nil error are
+// returned if no valid beacon was received.
+func (st *Stack) receiveBeacon(session *Session, beaconTime uint32, open time.Time, timeoutMs uint32) (*Beacon, error) {
+	ch, ok := st.Region.BeaconChannel(beaconTime)
+	if !ok {
+		return nil, ErrClassBUnsupported
+	}
+	if wait := time.Until(open); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	// Beacons have no LoRa header and CRC, and are not IQ inverted
+	st.applyChannelConfig(ch)
+	st.Radio.SetHeaderType(lora.HeaderImplicit)
+	st.Radio.SetCrc(false)
+	st.Radio.SetIqMode(lora.IQStandard)
+	pkt, err := st.receive(timeoutMs)
+	if err != nil || pkt == nil {
+		return nil, err
+	}
+
+	b, err := DecodeBeacon(pkt.Payload)
+	if err != nil {
+		return nil, nil
+	}
+	// The beacon transmission started at the beacon time
+	session.syncTime(time.Duration(b.Time)*time.Second, pkt.Time.Add(-timeOnAir(ch, len(pkt.Payload))))
+	session.lastBeacon = b.Time
+	return b, nil
+}
+
+// receivePingSlot listens for a downlink in the ping slot opening at open.
+// Frames of other devices, with a CRC error or failing the MIC or frame
+// counter checks are ignored.
+func (st *Stack) receivePingSlot(session *Session, beaconTime uint32, open time.Time) (*Downlink, error) {
+	ch, ok := st.Region.PingSlotChannel(session.devAddr(), beaconTime)
+	if !ok {
+		return nil, ErrClassBUnsupported
+	}
+	if wait := time.Until(open); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	st.applyChannelConfig(ch)
+	st.Radio.SetIqMode(lora.IQInverted)
+	pkt, err := st.receive(LORA_PING_SLOT_TIMEOUT)
+	if errors.Is(err, lora.ErrCrcError) {
+		return nil, nil
+	}
+	if err != nil || pkt == nil {
+		return nil, err
+	}
+	dl, err := session.decodeRxPacket(pkt)
+	if err != nil {
+		return nil, nil
+	}
+	return dl, nil
+}
@@ -0,0 +1,125 @@
+package lorawan
+
+import (
+	"testing"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+func TestPingOffset(t *testing.T) {
+	devAddr := uint32(0x26011BDA)
+	seen := map[uint32]bool{}
+	for beaconTime := uint32(0); beaconTime < 10*128; beaconTime += 128 {
+		offset := PingOffset(beaconTime, devAddr, 32)
+		if offset >= 32 {
+			t.Fatalf("PingOffset(%d) = %d, want less than 32", beaconTime, offset)
+		}
+		seen[offset] = true
+	}
+	// the offset is randomized at each beacon period
+	if len(seen) < 2 {
+		t.Error("PingOffset() does not change with the beacon time")
+	}
+	if PingOffset(128, devAddr, 4096) != PingOffset(128, devAddr, 4096) {
+		t.Error("PingOffset() is not deterministic")
+	}
+}
+
+func TestPingSlots(t *testing.T) {
+	s := testDownlinkSession()
+	s.PingPeriodicity = 7 // one slot each 128 seconds
+
+	slots := s.pingSlots(1280)
+	if len(slots) != 1 {
+		t.Fatalf("len(pingSlots()) = %d, want 1", len(slots))
+	}
+	offset := PingOffset(1280, s.devAddr(), 4096)
+	want := 1280*time.Second + BEACON_RESERVED*time.Millisecond + time.Duration(offset)*PING_SLOT_LEN*time.Millisecond
+	if slots[0] != want {
+		t.Errorf("pingSlots() = %v, want %v", slots[0], want)
+	}
+
+	s.PingPeriodicity = 0 // 128 slots, every 32 slots
+	slots = s.pingSlots(1280)
+	if len(slots) != 128 || slots[1]-slots[0] != 32*PING_SLOT_LEN*time.Millisecond {
+		t.Errorf("pingSlots() = %d slots, %v apart, want 128 slots 960ms apart", len(slots), slots[1]-slots[0])
+	}
+}
+
+func TestRequestPingSlotInfo(t *testing.T) {
+	s := testDownlinkSession()
+	s.RequestPingSlotInfo(3)
+	s.RequestDeviceTime()
+	if s.PingPeriodicity != 3 {
+		t.Errorf("PingPeriodicity = %d, want 3", s.PingPeriodicity)
+	}
+	got := s.macAnswers()
+	if len(got) != 3 || got[0] != CIDPingSlotInfo || got[1] != 3 || got[2] != CIDDeviceTime {
+		t.Errorf("answers = %x, want 10030d", got)
+	}
+}
+
+func TestListenClassBNotClassB(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Radio = &mockRadio{}
+	defaultStack.Region = &mockSettings{}
+
+	if err := ListenClassB(testDownlinkSession(), time.Millisecond, nil); err != ErrNotClassB {
+		t.Errorf("ListenClassB() error = %v, want %v", err, ErrNotClassB)
+	}
+}
+
+func TestAcquireBeacon(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	s := testDownlinkSession()
+	gps := nextBeaconTime(GPSTime(time.Now()))
+	frame, _ := (&Beacon{Time: gps}).GenBeacon(17)
+	radio := &mockRadio{rxResponse: frame}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{beaconCh: &mockChannel{
+		frequency:       869525000,
+		bandwidth:       lora.Bandwidth_125_0,
+		spreadingFactor: lora.SpreadingFactor9,
+		preambleLength:  10,
+	}}
+
+	b, err := AcquireBeacon(s)
+	if err != nil {
+		t.Fatalf("AcquireBeacon() error = %v", err)
+	}
+	if b.Time != gps || s.lastBeacon != gps || !s.timeSynced {
+		t.Errorf("AcquireBeacon() = %+v, lastBeacon = %d, want beacon %d", b, s.lastBeacon, gps)
+	}
+	if radio.headerType != lora.HeaderImplicit || radio.crcEnabled || radio.iqMode != lora.IQStandard {
+		t.Error("beacon not received with implicit header, no CRC and standard IQ")
+	}
+	// the whole period is listened to without time synchronization
+	if radio.rxTimeout <= 128000 {
+		t.Errorf("rxTimeout = %d, want more than a beacon period", radio.rxTimeout)
+	}
+	// the device clock now has the beacon time
+	if now := s.gpsNow(); now < time.Duration(gps)*time.Second || now > time.Duration(gps+1)*time.Second {
+		t.Errorf("gpsNow() = %v, want %ds", now, gps)
+	}
+}
+
+func TestAcquireBeaconErrors(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Radio = &mockRadio{}
+	defaultStack.Region = &mockSettings{}
+	if _, err := AcquireBeacon(testDownlinkSession()); err != ErrClassBUnsupported {
+		t.Errorf("AcquireBeacon() error = %v, want %v", err, ErrClassBUnsupported)
+	}
+
+	defaultStack.Region = &mockSettings{beaconCh: &mockChannel{frequency: 869525000}}
+	if _, err := AcquireBeacon(testDownlinkSession()); err != ErrNoBeaconReceived {
+		t.Errorf("AcquireBeacon() error = %v, want %v", err, ErrNoBeaconReceived)
+	}
+}
@@ -0,0 +1,111 @@
+package lorawan
+
+import (
+	"errors"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+// Device classes, the receive windows opened by the device
+const (
+	ClassA = iota // RX1 and RX2 after each uplink
+	ClassB        // Class A and ping slots synchronized on beacons
+	ClassC        // Class A and RX2 continuously open between uplinks
+)
+
+// ListenClassC listens for downlinks on the RX2 channel for duration, as a
+// Class C device does between uplinks, and calls handler with each of them.
+// MAC commands are processed and the frame counters saved before handler is
+// called, a confirmed downlink is acknowledged by the next uplink.
+//
+// The radio cannot transmit while listening: uplinks are sent between calls
+// to ListenClassC, followed by ListenDownlink which listens on the RX2
+// channel until RX1 opens.
+func ListenClassC(session *Session, duration time.Duration, handler func(*Downlink)) error {
+	return defaultStack.listenClassC(session, duration, handler)
+}
+
+func (st *Stack) listenClassC(session *Session, duration time.Duration, handler func(*Downlink)) error {
+	if st.Radio == nil {
+		return ErrNoRadioAttached
+	}
+
+	if st.Region == nil {
+		return ErrUndefinedRegionSettings
+	}
+
+	if session.Class != ClassC {
+		return ErrNotClassC
+	}
+
+	until := time.Now().Add(duration)
+	for {
+		dl, err := st.listenRXC(session, until)
+		if err != nil || dl == nil {
+			return err
+		}
+		ProcessMACCommands(dl.MACCommands, session, st.Region)
+		if err := st.saveSession(session); err != nil {
+			return err
+		}
+		if handler != nil {
+			handler(dl)
+		}
+	}
+}
+
+// listenRXC listens on the RX2 channel until the deadline and returns the
+// first downlink of the session. Frames of other devices, with a CRC error
+// or failing the MIC or frame counter checks are ignored. A nil Downlink
+// and nil error are returned if nothing was received.
+func (st *Stack) listenRXC(session *Session, until time.Time) (*Downlink, error) {
+	st.applyChannelConfig(st.rx2Channel(session))
+	st.Radio.SetIqMode(lora.IQInverted)
+	for {
+		timeout := time.Until(until).Milliseconds()
+		if timeout <= 0 {
+			return nil, nil
+		}
+		var pkt *lora.RxPacket
+		var err error
+		if r, ok := st.Radio.(lora.AsyncRadio); ok {
+			pkt, err = st.receiveUntil(r, until)
+		} else {
+			pkt, err = st.receive(uint32(min(timeout, LORA_RXC_SLICE)))
+		}
+		if errors.Is(err, lora.ErrCrcError) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pkt == nil {
+			continue
+		}
+		if dl, err := session.decodeRxPacket(pkt); err == nil {
+			return dl, nil
+		}
+	}
+}
+
+// receiveUntil listens with an asynchronous radio without timeout and
+// cancels the reception at the deadline, instead of slicing it. A nil
+// packet and nil error are returned if nothing was received.
+func (st *Stack) receiveUntil(r lora.AsyncRadio, until time.Time) (*lora.RxPacket, error) {
+	wait := time.Until(until)
+	if wait <= 0 {
+		return nil, nil
+	}
+	if err := r.StartRx(0); err != nil {
+		return nil, &RadioError{ErrRxFailed, err}
+	}
+	ev := lora.WaitEvent(r, wait)
+	if ev.EventType == lora.RadioEventTimeout {
+		return nil, nil
+	}
+	if err := lora.EventError(ev, false); err != nil {
+		return nil, &RadioError{ErrRxFailed, err}
+	}
+	return ev.RxPacket(), nil
+}
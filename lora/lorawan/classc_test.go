@@ -0,0 +1,100 @@
+package lorawan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListenClassCNotClassC(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Radio = &mockRadio{}
+	defaultStack.Region = &mockSettings{rx2Ch: &mockChannel{frequency: 869525000}}
+
+	if err := ListenClassC(testDownlinkSession(), time.Millisecond, nil); err != ErrNotClassC {
+		t.Errorf("ListenClassC() error = %v, want %v", err, ErrNotClassC)
+	}
+}
+
+func TestListenClassC(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	s := testDownlinkSession()
+	s.Class = ClassC
+	// the same frame is received again and again, replays are ignored
+	radio := &mockRadio{rxResponse: genTestDownlink(s, MTypeConfirmedDataDown, 0, nil, 0, 2, []uint8("on"))}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{rx2Ch: &mockChannel{frequency: 869525000}}
+
+	var received []*Downlink
+	err := ListenClassC(s, 20*time.Millisecond, func(dl *Downlink) {
+		received = append(received, dl)
+	})
+	if err != nil {
+		t.Fatalf("ListenClassC() error = %v", err)
+	}
+	if len(received) != 1 || received[0].FPort != 2 || string(received[0].Payload) != "on" {
+		t.Fatalf("received %+v, want one downlink on FPort 2 with payload on", received)
+	}
+	if radio.frequency != 869525000 || radio.rxTimeout > LORA_RXC_SLICE {
+		t.Errorf("radio listening on %d for %d ms, want RX2 869525000 for at most %d ms",
+			radio.frequency, radio.rxTimeout, LORA_RXC_SLICE)
+	}
+	if !s.pendingACK {
+		t.Error("confirmed downlink not acknowledged by the next uplink")
+	}
+}
+
+func TestListenClassCAsync(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	s := testDownlinkSession()
+	s.Class = ClassC
+	radio := newMockAsyncRadio()
+	radio.silent = true
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{rx2Ch: &mockChannel{frequency: 869525000}}
+
+	// a single reception without timeout, cancelled at the deadline
+	if err := ListenClassC(s, 20*time.Millisecond, nil); err != nil {
+		t.Fatalf("ListenClassC() error = %v", err)
+	}
+	if radio.started != 1 || radio.rxTimeout != 0 || radio.cancelled != 1 {
+		t.Errorf("%d receptions started with timeout %d, %d cancelled, want 1 without timeout cancelled",
+			radio.started, radio.rxTimeout, radio.cancelled)
+	}
+}
+
+func TestListenDownlinkClassCBeforeRX1(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	s := testDownlinkSession()
+	s.Class = ClassC
+	s.RXDelay = 1
+	radio := &mockRadio{rxResponse: genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 2, []uint8("on"))}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{
+		rx1Ch: &mockChannel{frequency: 868100000},
+		rx2Ch: &mockChannel{frequency: 869525000},
+	}
+	s.lastUplinkEnd = time.Now()
+
+	dl, err := ListenDownlink(s)
+	if err != nil {
+		t.Fatalf("ListenDownlink() error = %v", err)
+	}
+	if dl == nil || string(dl.Payload) != "on" {
+		t.Fatalf("ListenDownlink() = %+v, want payload on", dl)
+	}
+	// received on the RX2 channel before RX1 opens
+	if radio.frequency != 869525000 {
+		t.Errorf("radio frequency = %d, want RX2 869525000", radio.frequency)
+	}
+	if time.Since(s.lastUplinkEnd) >= time.Second {
+		t.Error("ListenDownlink() waited for RX1")
+	}
+}
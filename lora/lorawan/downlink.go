@@ -0,0 +1,180 @@
+package lorawan
+
+import (
+	"math"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+// FCtrl bits of a downlink frame
+const (
+	fCtrlDownADR      = 0x80
+	fCtrlDownACK      = 0x20
+	fCtrlDownFPending = 0x10
+	fCtrlFOptsLen     = 0x0F
+)
+
+const (
+	// MAX_FCNT_GAP is the largest number of downlinks that can be lost
+	// between two received ones
+	MAX_FCNT_GAP = 16384
+)
+
+// Downlink is a decoded LoRaWAN downlink data message
+type Downlink struct {
+	Confirmed bool    // Confirmed data down, an ACK is expected in next uplink
+	ADR       bool    // Network server ADR bit
+	ACK       bool    // Acknowledges the last confirmed uplink
+	FPending  bool    // Network server has more data pending
+	FCnt      uint32  // Downlink frame counter
+	FOpts     []uint8 // MAC commands piggybacked in the frame header
+	FPort     uint8   // 0 means MAC commands only, valid only if HasFPort is true
+	HasFPort  bool    // FPort (and FRMPayload) are present in the frame
+	Payload   []uint8 // Decrypted FRMPayload
+
+	MACCommands []MACCommand // MAC commands from FOpts or from FPort 0 FRMPayload
+
+	// Link quality measured by the radio, set when the downlink is received
+	// by the stack
+	RSSI      int16     // in dBm
+	SNR       int8      // in dB
+	FreqError int32     // in Hz
+	RxTime    time.Time // end of the reception
+}
+
+// DecodeDownlink verifies and decrypts a downlink PHYPayload received for
+// this session. The MIC is checked with NwkSKey, FOpts are in clear,
+// FRMPayload is decrypted with AppSKey (or NwkSKey for FPort 0) and
+// FCntDown is updated.
+// LoRaWAN 1.1 sessions check the MIC with SNwkSIntKey, decrypt FOpts with
+// NwkSEncKey, use it in place of NwkSKey and update AFCntDown or NFCntDown,
+// depending on FPort.
+// A frame counted 0xFFFFFFFF is rejected with ErrFCntDownExhausted, the
+// device must rejoin.
+func (s *Session) DecodeDownlink(phyPload []uint8) (*Downlink, error) {
+	// MHDR(1) + DevAddr(4) + FCtrl(1) + FCnt(2) + MIC(4)
+	if len(phyPload) < 12 {
+		return nil, ErrInvalidPacketLength
+	}
+
+	dl := &Downlink{}
+	switch phyPload[0] >> 5 {
+	case MTypeUnconfirmedDataDown:
+	case MTypeConfirmedDataDown:
+		dl.Confirmed = true
+	default:
+		return nil, ErrInvalidMessageType
+	}
+
+	p := &PHYPayload{}
+	if err := p.UnmarshalBinary(phyPload); err != nil {
+		return nil, err
+	}
+	mac := p.MACPayload.(*MACPayload)
+	if mac.FHDR.DevAddr != s.DevAddr {
+		return nil, ErrInvalidDevAddr
+	}
+
+	dl.ADR = mac.FHDR.FCtrl.ADR
+	dl.ACK = mac.FHDR.FCtrl.ACK
+	dl.FPending = mac.FHDR.FCtrl.FPending
+	if mac.FPort != nil {
+		dl.HasFPort = true
+		dl.FPort = *mac.FPort
+	}
+
+	fCntDown := &s.FCntDown
+	if s.Version == Version11 {
+		fCntDown = &s.NFCntDown
+		if dl.HasFPort && dl.FPort != 0 {
+			fCntDown = &s.AFCntDown
+		}
+	}
+
+	fCnt, err := nextFCnt(*fCntDown, uint16(mac.FHDR.FCnt))
+	if err != nil {
+		return nil, err
+	}
+	mac.FHDR.FCnt = fCnt
+
+	confFCnt := uint16(0)
+	if s.Version == Version11 && dl.ACK {
+		confFCnt = uint16(s.confFCntUp)
+	}
+	if ok, err := p.ValidateDataMIC(s.sNwkSIntKey(), confFCnt); err != nil || !ok {
+		return nil, ErrInvalidMic
+	}
+	// The counter cannot wrap around, frames already received would be
+	// accepted again
+	if fCnt == math.MaxUint32 {
+		return nil, ErrFCntDownExhausted
+	}
+
+	if s.Version == Version11 {
+		if err := p.DecryptFOpts(s.NwkSEncKey); err != nil {
+			return nil, err
+		}
+	}
+	dl.FCnt = fCnt
+	dl.FOpts = mac.FHDR.FOpts
+
+	if dl.HasFPort {
+		key := s.AppSKey
+		if dl.FPort == 0 {
+			key = s.nwkSEncKey()
+		}
+		if err := p.DecryptFRMPayload(key); err != nil {
+			return nil, err
+		}
+		dl.Payload = mac.FRMPayload
+	}
+
+	if dl.HasFPort && dl.FPort == 0 {
+		dl.MACCommands, _ = DecodeMACCommands(dl.Payload, false)
+	} else {
+		dl.MACCommands, _ = DecodeMACCommands(dl.FOpts, false)
+	}
+
+	*fCntDown = fCnt + 1
+	s.pendingACK = dl.Confirmed
+	if dl.Confirmed {
+		s.confFCntDown = fCnt
+	}
+	s.ADRAckCnt = 0
+	// Sticky MAC answers were received by the network server
+	s.stickyMAC = nil
+
+	return dl, nil
+}
+
+// nextFCnt rebuilds the 32 bits frame counter of a downlink from the 16 least
+// significant bits transmitted, next being the lowest counter expected.
+// Replayed frames and frames beyond MAX_FCNT_GAP are rejected.
+func nextFCnt(next uint32, fCnt16 uint16) (uint32, error) {
+	gap := fCnt16 - uint16(next)
+	if gap >= MAX_FCNT_GAP {
+		return 0, ErrInvalidFCntDown
+	}
+	fCnt := uint64(next) + uint64(gap)
+	if fCnt > math.MaxUint32 {
+		return 0, ErrInvalidFCntDown
+	}
+	return uint32(fCnt), nil
+}
+
+// decodeRxPacket decodes the downlink of a received packet and records its
+// link quality, the SNR is the margin reported by DevStatusAns
+func (s *Session) decodeRxPacket(pkt *lora.RxPacket) (*Downlink, error) {
+	dl, err := s.DecodeDownlink(pkt.Payload)
+	if err != nil {
+		return nil, err
+	}
+	dl.RSSI = pkt.RSSI
+	dl.SNR = pkt.SNR
+	dl.FreqError = pkt.FreqError
+	dl.RxTime = pkt.Time
+	s.RSSI = pkt.RSSI
+	s.SNR = pkt.SNR
+	return dl, nil
+}
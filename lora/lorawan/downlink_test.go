@@ -0,0 +1,318 @@
+package lorawan
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+func testDownlinkSession() *Session {
+	return &Session{
+		NwkSKey:    [16]uint8{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
+		AppSKey:    [16]uint8{0xA1, 0xA2, 0xA3, 0xA4, 0xA5, 0xA6, 0xA7, 0xA8, 0xA9, 0xAA, 0xAB, 0xAC, 0xAD, 0xAE, 0xAF, 0xB0},
+		DevAddr:    [4]uint8{0xDE, 0xAD, 0xBE, 0xEF},
+		Activation: ActivationABP,
+	}
+}
+
+// genTestDownlink builds a downlink frame as the network server would
+func genTestDownlink(s *Session, mType uint8, fCtrl uint8, fOpts []uint8, fCnt uint32, fPort uint8, payload []uint8) []uint8 {
+	var buf []uint8
+	buf = append(buf, mType<<5)
+	buf = append(buf, s.DevAddr[:]...)
+	buf = append(buf, fCtrl|uint8(len(fOpts)))
+	buf = append(buf, uint8(fCnt), uint8(fCnt>>8))
+	// FOpts are encrypted by LoRaWAN 1.1 only
+	if s.Version == Version11 {
+		fOpts, _ = s.genFRMPayload(s.NwkSEncKey, 1, fCnt, fOpts, true)
+	}
+	buf = append(buf, fOpts...)
+	if payload != nil {
+		key := s.AppSKey
+		if fPort == 0 {
+			key = s.nwkSEncKey()
+		}
+		data, _ := s.genFRMPayload(key, 1, fCnt, payload, false)
+		buf = append(buf, fPort)
+		buf = append(buf, data...)
+	}
+	confFCnt := uint16(0)
+	if s.Version == Version11 && fCtrl&fCtrlDownACK != 0 {
+		confFCnt = uint16(s.confFCntUp)
+	}
+	mic := calcMessageMIC11(buf, s.sNwkSIntKey(), confFCnt, 1, s.DevAddr[:], fCnt, uint8(len(buf)))
+	return append(buf, mic[:]...)
+}
+
+func TestDecodeDownlink(t *testing.T) {
+	s := testDownlinkSession()
+	payload := []uint8{0x01, 0x02, 0x03, 0x04}
+	phy := genTestDownlink(s, MTypeConfirmedDataDown, fCtrlDownACK|fCtrlDownFPending, nil, 0, 10, payload)
+
+	dl, err := s.DecodeDownlink(phy)
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if !dl.Confirmed {
+		t.Error("Confirmed = false, want true")
+	}
+	if !dl.ACK {
+		t.Error("ACK = false, want true")
+	}
+	if !dl.FPending {
+		t.Error("FPending = false, want true")
+	}
+	if !dl.HasFPort || dl.FPort != 10 {
+		t.Errorf("FPort = %d (present %v), want 10", dl.FPort, dl.HasFPort)
+	}
+	if !bytes.Equal(dl.Payload, payload) {
+		t.Errorf("Payload = %x, want %x", dl.Payload, payload)
+	}
+	if s.FCntDown != 1 {
+		t.Errorf("FCntDown = %d, want 1", s.FCntDown)
+	}
+}
+
+func TestDecodeDownlinkFPort0UsesNwkSKey(t *testing.T) {
+	s := testDownlinkSession()
+	payload := []uint8{0x02, 0x05, 0x01}
+	phy := genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 0, payload)
+
+	dl, err := s.DecodeDownlink(phy)
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if !bytes.Equal(dl.Payload, payload) {
+		t.Errorf("Payload = %x, want %x", dl.Payload, payload)
+	}
+}
+
+func TestDecodeDownlinkNoPayload(t *testing.T) {
+	s := testDownlinkSession()
+	phy := genTestDownlink(s, MTypeUnconfirmedDataDown, fCtrlDownACK, nil, 0, 0, nil)
+
+	dl, err := s.DecodeDownlink(phy)
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if dl.HasFPort {
+		t.Error("HasFPort = true, want false")
+	}
+	if !dl.ACK {
+		t.Error("ACK = false, want true")
+	}
+}
+
+func TestDecodeDownlinkFOpts(t *testing.T) {
+	s := testDownlinkSession()
+	fOpts := []uint8{0x02, 0x05, 0x01}
+	phy := genTestDownlink(s, MTypeConfirmedDataDown, 0, fOpts, 0, 1, []uint8{0x10})
+
+	dl, err := s.DecodeDownlink(phy)
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if !bytes.Equal(dl.FOpts, fOpts) {
+		t.Errorf("FOpts = %x, want %x", dl.FOpts, fOpts)
+	}
+	if !bytes.Equal(dl.Payload, []uint8{0x10}) {
+		t.Errorf("Payload = %x, want 10", dl.Payload)
+	}
+	// confirmed downlink must be acknowledged by the next uplink
+	up, err := s.GenUplink(&Uplink{FPort: 1})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	if up[5]&fCtrlUpACK == 0 {
+		t.Errorf("uplink FCtrl = 0x%02X, want ACK set", up[5])
+	}
+}
+
+func TestDecodeDownlinkFOptsVector(t *testing.T) {
+	// LoRaWAN 1.0 LinkCheckAns in clear FOpts, no FPort, FCnt 2
+	phy := []uint8{0x60, 0xF1, 0x7D, 0xBE, 0x49, 0x03, 0x02, 0x00, 0x02, 0x14, 0x01, 0xC3, 0x4C, 0x94, 0xC7}
+	s := &Session{
+		DevAddr: [4]uint8{0xF1, 0x7D, 0xBE, 0x49},
+		NwkSKey: [16]uint8{0x44, 0x02, 0x42, 0x41, 0xED, 0x4C, 0xE9, 0xA6, 0x8C, 0x6A, 0x8B, 0xC0, 0x55, 0x23, 0x3F, 0xD3},
+		AppSKey: [16]uint8{0xEC, 0x92, 0x58, 0x02, 0xAE, 0x43, 0x0C, 0xA7, 0x7F, 0xD3, 0xDD, 0x73, 0xCB, 0x2C, 0xC5, 0x88},
+	}
+
+	dl, err := s.DecodeDownlink(phy)
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if !bytes.Equal(dl.FOpts, []uint8{0x02, 0x14, 0x01}) || len(dl.MACCommands) != 1 ||
+		dl.MACCommands[0].CID != CIDLinkCheck {
+		t.Errorf("FOpts = %x, MAC commands %+v, want LinkCheckAns 021401", dl.FOpts, dl.MACCommands)
+	}
+}
+
+func TestDecodeDownlinkErrors(t *testing.T) {
+	s := testDownlinkSession()
+	valid := genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 3, 1, []uint8{0xAA})
+
+	badMic := append([]uint8{}, valid...)
+	badMic[len(badMic)-1] ^= 0xFF
+
+	otherDevice := testDownlinkSession()
+	otherDevice.DevAddr = [4]uint8{0x01, 0x02, 0x03, 0x04}
+
+	tests := []struct {
+		name    string
+		fCnt    uint32
+		phy     []uint8
+		wantErr error
+	}{
+		{"too short", 0, valid[:11], ErrInvalidPacketLength},
+		{"uplink message type", 0, genTestDownlink(s, MTypeUnconfirmedDataUp, 0, nil, 3, 1, []uint8{0xAA}), ErrInvalidMessageType},
+		{"other device", 0, genTestDownlink(otherDevice, MTypeUnconfirmedDataDown, 0, nil, 3, 1, []uint8{0xAA}), ErrInvalidDevAddr},
+		{"bad mic", 0, badMic, ErrInvalidMic},
+		{"replayed counter", 4, valid, ErrInvalidFCntDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.FCntDown = tt.fCnt
+			_, err := s.DecodeDownlink(tt.phy)
+			if err != tt.wantErr {
+				t.Errorf("DecodeDownlink() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeDownlink11(t *testing.T) {
+	s := testSession11()
+	if _, err := s.GenUplink(&Uplink{Confirmed: true, FPort: 1}); err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+
+	// The ACK of the confirmed uplink is part of the MIC
+	dl, err := s.DecodeDownlink(genTestDownlink(s, MTypeUnconfirmedDataDown, fCtrlDownACK, nil, 4, 2, []uint8{0x10}))
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if !dl.ACK || !bytes.Equal(dl.Payload, []uint8{0x10}) {
+		t.Errorf("Downlink = %+v, want ACK and payload 10", dl)
+	}
+	if s.AFCntDown != 5 || s.NFCntDown != 0 || s.FCntDown != 0 {
+		t.Errorf("AFCntDown = %d, NFCntDown = %d, FCntDown = %d, want 5, 0, 0", s.AFCntDown, s.NFCntDown, s.FCntDown)
+	}
+
+	// MAC only downlinks use their own counter
+	phy := genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 1, 0, []uint8{CIDDevStatus})
+	if dl, err = s.DecodeDownlink(phy); err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if len(dl.MACCommands) != 1 || dl.MACCommands[0].CID != CIDDevStatus {
+		t.Errorf("MACCommands = %+v, want DevStatusReq", dl.MACCommands)
+	}
+	if s.AFCntDown != 5 || s.NFCntDown != 2 {
+		t.Errorf("AFCntDown = %d, NFCntDown = %d, want 5 and 2", s.AFCntDown, s.NFCntDown)
+	}
+	if _, err = s.DecodeDownlink(phy); err != ErrInvalidFCntDown {
+		t.Errorf("replayed DecodeDownlink() error = %v, want %v", err, ErrInvalidFCntDown)
+	}
+}
+
+func TestDecodeDownlinkFCntDownExhausted(t *testing.T) {
+	s := testDownlinkSession()
+	s.FCntDown = 0xFFFFFFFE
+	phy, _ := s.GenMessage(1, []uint8("on"))
+	if _, err := s.DecodeDownlink(phy); err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if s.FCntDown != 0xFFFFFFFF {
+		t.Fatalf("FCntDown = 0x%08X, want 0xFFFFFFFF", s.FCntDown)
+	}
+
+	// The last counter value is never used, the counter does not wrap
+	phy, _ = s.GenMessage(1, []uint8("on"))
+	if _, err := s.DecodeDownlink(phy); err != ErrFCntDownExhausted {
+		t.Errorf("DecodeDownlink() error = %v, want %v", err, ErrFCntDownExhausted)
+	}
+	s.FCntDown = 0
+	old, _ := s.GenMessage(1, []uint8("on"))
+	s.FCntDown = 0xFFFFFFFF
+	if _, err := s.DecodeDownlink(old); err == nil {
+		t.Error("DecodeDownlink() accepted a replayed frame")
+	}
+	if s.FCntDown != 0xFFFFFFFF {
+		t.Errorf("FCntDown = 0x%08X, want unchanged 0xFFFFFFFF", s.FCntDown)
+	}
+}
+
+func TestNextFCnt(t *testing.T) {
+	tests := []struct {
+		name    string
+		next    uint32
+		fCnt16  uint16
+		want    uint32
+		wantErr error
+	}{
+		{"first downlink", 0, 0, 0, nil},
+		{"lost downlinks", 10, 25, 25, nil},
+		{"16 bits rollover", 0x0000FFFE, 0x0003, 0x00010003, nil},
+		{"high bits kept", 0x00050010, 0x0012, 0x00050012, nil},
+		{"replayed", 0x00010005, 0x0004, 0, ErrInvalidFCntDown},
+		{"gap too large", 0, MAX_FCNT_GAP, 0, ErrInvalidFCntDown},
+		{"largest gap", 0, MAX_FCNT_GAP - 1, MAX_FCNT_GAP - 1, nil},
+		{"32 bits overflow", 0xFFFFFFF0, 0x0010, 0, ErrInvalidFCntDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextFCnt(tt.next, tt.fCnt16)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("nextFCnt(0x%08X, 0x%04X) = 0x%08X, %v, want 0x%08X, %v", tt.next, tt.fCnt16, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeDownlinkFCntRollover(t *testing.T) {
+	s := testDownlinkSession()
+	s.FCntDown = 0x0000FFFF
+
+	// The MIC is computed over the full 32 bits counter
+	dl, err := s.DecodeDownlink(genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0x00010001, 1, []uint8{0x42}))
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if dl.FCnt != 0x00010001 || s.FCntDown != 0x00010002 {
+		t.Errorf("FCnt = 0x%08X, FCntDown = 0x%08X, want 0x00010001 and 0x00010002", dl.FCnt, s.FCntDown)
+	}
+	if !bytes.Equal(dl.Payload, []uint8{0x42}) {
+		t.Errorf("Payload = %x, want 42", dl.Payload)
+	}
+}
+
+func TestDecodeRxPacket(t *testing.T) {
+	s := testDownlinkSession()
+	now := time.Now()
+	frame := genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 2, []uint8("on"))
+
+	// a frame failing the MIC does not change the link quality
+	bad := append([]uint8{}, frame...)
+	bad[len(bad)-1] ^= 0xFF
+	if _, err := s.decodeRxPacket(&lora.RxPacket{Payload: bad, RSSI: -40, SNR: 12}); err != ErrInvalidMic {
+		t.Fatalf("decodeRxPacket() error = %v, want %v", err, ErrInvalidMic)
+	}
+	if s.RSSI != 0 || s.SNR != 0 {
+		t.Errorf("session RSSI %d SNR %d after an invalid frame, want 0", s.RSSI, s.SNR)
+	}
+
+	dl, err := s.decodeRxPacket(&lora.RxPacket{Payload: frame, RSSI: -110, SNR: -40, FreqError: -800, Time: now})
+	if err != nil {
+		t.Fatalf("decodeRxPacket() error = %v", err)
+	}
+	if dl.RSSI != -110 || dl.SNR != -40 || dl.FreqError != -800 || !dl.RxTime.Equal(now) {
+		t.Errorf("downlink %+v, want the metadata of the packet", dl)
+	}
+	// DevStatusAns margin saturates at -32
+	if s.RSSI != -110 || s.SNR != -40 || s.margin() != 0x20 {
+		t.Errorf("session RSSI %d SNR %d margin %#x, want -110, -40 and 0x20", s.RSSI, s.SNR, s.margin())
+	}
+}
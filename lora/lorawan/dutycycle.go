@@ -0,0 +1,75 @@
+package lorawan
+
+import (
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+// DutyCycleError is returned when a transmission would exceed a duty cycle
+// limit, it can be retried after Wait.
+type DutyCycleError struct {
+	Wait time.Duration
+}
+
+func (e *DutyCycleError) Error() string {
+	return "duty cycle limit reached, retry in " + e.Wait.String()
+}
+
+// checkDutyCycle returns a DutyCycleError if a transmission on ch would
+// exceed the region sub-band, aggregated or join back-off duty cycle
+func (st *Stack) checkDutyCycle(ch region.Channel, join bool) error {
+	now := time.Now()
+	wait := st.Region.WaitTime(ch.Frequency())
+	wait = max(wait, st.aggregatedAvailableAt.Sub(now))
+	if join {
+		wait = max(wait, st.joinAvailableAt.Sub(now))
+	}
+	if wait > 0 {
+		return &DutyCycleError{Wait: wait}
+	}
+	return nil
+}
+
+// transmissionDone accounts the time on air of the payloadLen bytes frame
+// that was just sent on ch
+func (st *Stack) transmissionDone(ch region.Channel, payloadLen int, session *Session, join bool) {
+	now := time.Now()
+	airtime := timeOnAir(ch, payloadLen)
+	st.Region.TransmissionDone(ch.Frequency(), airtime)
+
+	// Aggregated duty cycle is 1/2^MaxDutyCycle
+	st.aggregatedAvailableAt = now.Add(airtime * time.Duration(1<<(session.MaxDutyCycle&0x0F)-1))
+
+	if join {
+		st.joinAvailableAt = now.Add(airtime * time.Duration(st.joinDutyCycle(now)-1))
+	}
+}
+
+// joinDutyCycle returns the join requests back-off factor, their duty cycle
+// is limited to 1% in the first hour, 0.1% in the next 10 hours and 0.01% after.
+func (st *Stack) joinDutyCycle(now time.Time) uint32 {
+	switch elapsed := now.Sub(st.joinStart); {
+	case elapsed < time.Hour:
+		return 100
+	case elapsed < 11*time.Hour:
+		return 1000
+	default:
+		return 10000
+	}
+}
+
+// timeOnAir returns the duration of the transmission of a payloadLen bytes
+// frame on ch, with explicit header and CRC
+func timeOnAir(ch region.Channel, payloadLen int) time.Duration {
+	cfg := lora.Config{
+		Sf:         ch.SpreadingFactor(),
+		Bw:         ch.Bandwidth(),
+		Cr:         ch.CodingRate(),
+		Preamble:   ch.PreambleLength(),
+		HeaderType: lora.HeaderExplicit,
+		Crc:        lora.CRCOn,
+	}
+	return cfg.TimeOnAir(payloadLen)
+}
@@ -0,0 +1,137 @@
+package lorawan
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+func TestTimeOnAir(t *testing.T) {
+	tests := []struct {
+		name string
+		sf   uint8
+		bw   uint8
+		len  int
+		want time.Duration
+	}{
+		{"SF7BW125", lora.SpreadingFactor7, lora.Bandwidth_125_0, 13, 46336 * time.Microsecond},
+		{"SF9BW125", lora.SpreadingFactor9, lora.Bandwidth_125_0, 23, 205824 * time.Microsecond},
+		{"SF12BW125", lora.SpreadingFactor12, lora.Bandwidth_125_0, 13, 1155072 * time.Microsecond},
+		{"SF8BW500", lora.SpreadingFactor8, lora.Bandwidth_500_0, 23, 28288 * time.Microsecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := &mockChannel{bandwidth: tt.bw, spreadingFactor: tt.sf, codingRate: lora.CodingRate4_5, preambleLength: 8}
+			if got := timeOnAir(ch, tt.len); got != tt.want {
+				t.Errorf("timeOnAir() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinDutyCycle(t *testing.T) {
+	defaultStack.joinStart = time.Now()
+	defer func() { defaultStack.joinStart = time.Time{} }()
+
+	if got := defaultStack.joinDutyCycle(defaultStack.joinStart.Add(30 * time.Minute)); got != 100 {
+		t.Errorf("first hour = 1/%d, want 1/100", got)
+	}
+	if got := defaultStack.joinDutyCycle(defaultStack.joinStart.Add(5 * time.Hour)); got != 1000 {
+		t.Errorf("next 10 hours = 1/%d, want 1/1000", got)
+	}
+	if got := defaultStack.joinDutyCycle(defaultStack.joinStart.Add(24 * time.Hour)); got != 10000 {
+		t.Errorf("after 11 hours = 1/%d, want 1/10000", got)
+	}
+}
+
+func TestSendUplinkSubBandDutyCycle(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}, wait: 3 * time.Second}
+
+	s := testDownlinkSession()
+	err := SendUplink([]byte("test"), s)
+	var dcErr *DutyCycleError
+	if !errors.As(err, &dcErr) || dcErr.Wait != 3*time.Second {
+		t.Fatalf("SendUplink() error = %v, want a 3s DutyCycleError", err)
+	}
+	if radio.txCalled || s.FCntUp != 0 {
+		t.Error("SendUplink() transmitted over the duty cycle limit")
+	}
+}
+
+func TestSendUplinkAggregatedDutyCycle(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	defaultStack.Radio = &mockRadio{}
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000,
+		bandwidth: lora.Bandwidth_125_0, spreadingFactor: lora.SpreadingFactor7,
+		codingRate: lora.CodingRate4_5, preambleLength: 8}}
+
+	// DutyCycleReq limits transmissions to 1/16 of the time
+	s := testDownlinkSession()
+	s.MaxDutyCycle = 4
+	if err := SendUplink([]byte("test"), s); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	err := SendUplink([]byte("test"), s)
+	var dcErr *DutyCycleError
+	if !errors.As(err, &dcErr) {
+		t.Fatalf("second SendUplink() error = %v, want DutyCycleError", err)
+	}
+	if dcErr.Wait <= 0 || dcErr.Wait > 15*timeOnAir(defaultStack.Region.UplinkChannel(), 17) {
+		t.Errorf("Wait = %v, want 15 times the time on air at most", dcErr.Wait)
+	}
+}
+
+func TestEU868SubBands(t *testing.T) {
+	rs := region.EU868()
+	rs.TransmissionDone(868100000, 100*time.Millisecond)
+
+	// 868.1, 868.3 and 868.5 MHz share the 1% sub-band
+	if wait := rs.WaitTime(868500000); wait <= 9*time.Second || wait > 10*time.Second {
+		t.Errorf("WaitTime(868.5 MHz) = %v, want about 9.9s", wait)
+	}
+	if wait := rs.WaitTime(867100000); wait != 0 {
+		t.Errorf("WaitTime(867.1 MHz) = %v, want 0", wait)
+	}
+	if wait := rs.WaitTime(902300000); wait != 0 {
+		t.Errorf("WaitTime(902.3 MHz) = %v, want 0 outside of the sub-bands", wait)
+	}
+}
+
+func TestJoinBackoff(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{
+		joinRequestCh: &mockChannel{frequency: 868100000, bandwidth: lora.Bandwidth_125_0,
+			spreadingFactor: lora.SpreadingFactor9, codingRate: lora.CodingRate4_5, preambleLength: 8},
+		joinAcceptCh: &mockChannel{frequency: 868100000},
+	}
+
+	if err := Join(testOtaa(), &Session{}); !errors.Is(err, ErrNoJoinAcceptReceived) {
+		t.Fatalf("Join() error = %v, want %v", err, ErrNoJoinAcceptReceived)
+	}
+
+	// Join requests are limited to 1% during the first hour
+	radio.txCount = 0
+	err := Join(testOtaa(), &Session{})
+	var dcErr *DutyCycleError
+	if !errors.As(err, &dcErr) {
+		t.Fatalf("second Join() error = %v, want DutyCycleError", err)
+	}
+	if radio.txCount != 0 {
+		t.Errorf("transmissions = %d, want 0", radio.txCount)
+	}
+}
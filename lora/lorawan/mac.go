@@ -0,0 +1,237 @@
+package lorawan
+
+import (
+	"encoding/binary"
+	"time"
+
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+// MAC command identifiers (CID)
+const (
+	CIDLinkCheck     = 0x02
+	CIDLinkADR       = 0x03
+	CIDDutyCycle     = 0x04
+	CIDRXParamSetup  = 0x05
+	CIDDevStatus     = 0x06
+	CIDNewChannel    = 0x07
+	CIDRXTimingSetup = 0x08
+	CIDTxParamSetup  = 0x09 // AS923 and AU915 only
+	CIDDlChannel     = 0x0A
+	CIDRekey         = 0x0B // LoRaWAN 1.1 RekeyInd/RekeyConf
+	CIDDeviceTime    = 0x0D
+	CIDPingSlotInfo  = 0x10 // Class B
+	CIDPingSlotChan  = 0x11 // Class B
+	CIDBeaconFreq    = 0x13 // Class B
+)
+
+// macPayloadLen gives the payload size of the MAC commands, indexed by CID,
+// for commands sent by the network server (downlink) and by the end-device (uplink)
+var macPayloadLen = map[uint8]struct{ down, up int }{
+	CIDLinkCheck:     {2, 0},
+	CIDLinkADR:       {4, 1},
+	CIDDutyCycle:     {1, 0},
+	CIDRXParamSetup:  {4, 1},
+	CIDDevStatus:     {0, 2},
+	CIDNewChannel:    {5, 1},
+	CIDRXTimingSetup: {1, 0},
+	CIDTxParamSetup:  {1, 0},
+	CIDDlChannel:     {4, 1},
+	CIDRekey:         {1, 1},
+	CIDDeviceTime:    {5, 0},
+	CIDPingSlotInfo:  {0, 1},
+	CIDPingSlotChan:  {4, 1},
+	CIDBeaconFreq:    {3, 1},
+}
+
+var (
+	// BatteryLevel is reported to the network server in DevStatusAns:
+	// 0 for external power, 1 (min) to 254 (max), 255 if unknown
+	BatteryLevel uint8 = 255
+)
+
+// MACCommand is a LoRaWAN MAC command, carried in FOpts or in a FPort 0 FRMPayload
+type MACCommand struct {
+	CID     uint8
+	Payload []uint8
+}
+
+// DecodeMACCommands splits b in MAC commands. uplink selects the direction
+// the commands were sent in. Decoding stops at the first unknown CID, as
+// the size of its payload cannot be known, and the commands decoded so far
+// are returned with ErrInvalidMACCommand.
+func DecodeMACCommands(b []uint8, uplink bool) ([]MACCommand, error) {
+	var cmds []MACCommand
+	for len(b) > 0 {
+		size, ok := macPayloadLen[b[0]]
+		if !ok {
+			return cmds, ErrInvalidMACCommand
+		}
+		n := size.down
+		if uplink {
+			n = size.up
+		}
+		if len(b) < 1+n {
+			return cmds, ErrInvalidMACCommand
+		}
+		cmds = append(cmds, MACCommand{CID: b[0], Payload: b[1 : 1+n]})
+		b = b[1+n:]
+	}
+	return cmds, nil
+}
+
+// EncodeMACCommands serializes MAC commands
+func EncodeMACCommands(cmds []MACCommand) []uint8 {
+	var buf []uint8
+	for _, c := range cmds {
+		buf = append(buf, c.CID)
+		buf = append(buf, c.Payload...)
+	}
+	return buf
+}
+
+// RequestLinkCheck queues a LinkCheckReq for the next uplink, the answer
+// updates LinkMargin and GatewayCount.
+func (s *Session) RequestLinkCheck() {
+	s.pendingMAC = append(s.pendingMAC, CIDLinkCheck)
+}
+
+// ProcessMACCommands applies the MAC commands sent by the network server
+// to the session and to the region settings, and queues their answers for
+// the next uplink. Commands with a payload shorter than their CID requires
+// are ignored.
+func ProcessMACCommands(cmds []MACCommand, s *Session, rs region.Settings) {
+	valid := make([]MACCommand, 0, len(cmds))
+	for _, c := range cmds {
+		if size, ok := macPayloadLen[c.CID]; !ok || len(c.Payload) >= size.down {
+			valid = append(valid, c)
+		}
+	}
+	cmds = valid
+
+	for i := 0; i < len(cmds); i++ {
+		c := cmds[i]
+		switch c.CID {
+		case CIDLinkCheck:
+			s.LinkMargin = c.Payload[0]
+			s.GatewayCount = c.Payload[1]
+
+		case CIDLinkADR:
+			// Contiguous LinkADRReq commands are a single atomic request,
+			// the data rate and TX power of the last one are used
+			masks := []region.ChannelMask{}
+			last := c
+			for ; i < len(cmds) && cmds[i].CID == CIDLinkADR; i++ {
+				last = cmds[i]
+				masks = append(masks, region.ChannelMask{
+					Cntl: (last.Payload[3] >> 4) & 0x07,
+					Mask: binary.LittleEndian.Uint16(last.Payload[1:3]),
+				})
+			}
+			i--
+			powerOK, drOK, maskOK := rs.LinkADR(last.Payload[0]>>4, last.Payload[0]&0x0F, masks)
+			status := ackBits(powerOK, drOK, maskOK)
+			for range masks {
+				s.pendingMAC = append(s.pendingMAC, CIDLinkADR, status)
+			}
+
+		case CIDDutyCycle:
+			s.MaxDutyCycle = c.Payload[0] & 0x0F
+			s.pendingMAC = append(s.pendingMAC, CIDDutyCycle)
+
+		case CIDRXParamSetup:
+			rx1DROffset := (c.Payload[0] >> 4) & 0x07
+			rx2DataRate := c.Payload[0] & 0x0F
+			freq := macFrequency(c.Payload[1:4])
+
+			_, offsetOK := rs.RX1DataRate(rs.DataRate(), rx1DROffset)
+			_, _, drOK := rs.DownlinkDataRate(rx2DataRate)
+			freqOK := rs.ValidDownlinkFrequency(freq)
+			if offsetOK && drOK && freqOK {
+				s.DLSettings = rx1DROffset<<4 | rx2DataRate
+				s.RX2Frequency = freq
+			}
+			s.stickyMAC = append(s.stickyMAC, CIDRXParamSetup, ackBits(offsetOK, drOK, freqOK))
+
+		case CIDDevStatus:
+			s.pendingMAC = append(s.pendingMAC, CIDDevStatus, BatteryLevel, s.margin())
+
+		case CIDNewChannel:
+			drRange := c.Payload[4]
+			freqOK, drOK := rs.NewChannel(c.Payload[0], macFrequency(c.Payload[1:4]), drRange&0x0F, drRange>>4)
+			s.pendingMAC = append(s.pendingMAC, CIDNewChannel, ackBits(false, drOK, freqOK))
+
+		case CIDRXTimingSetup:
+			s.RXDelay = c.Payload[0] & 0x0F
+			s.stickyMAC = append(s.stickyMAC, CIDRXTimingSetup)
+
+		case CIDTxParamSetup:
+			// Regions not supporting TxParamSetupReq do not answer it
+			p := c.Payload[0]
+			if rs.TxParamSetup(p&0x10 != 0, p&0x20 != 0, p&0x0F) {
+				s.pendingMAC = append(s.pendingMAC, CIDTxParamSetup)
+			}
+
+		case CIDDlChannel:
+			freqOK, chOK := rs.DlChannel(c.Payload[0], macFrequency(c.Payload[1:4]))
+			s.stickyMAC = append(s.stickyMAC, CIDDlChannel, ackBits(false, chOK, freqOK))
+
+		case CIDRekey:
+			s.rekeyInd = false
+
+		case CIDDeviceTime:
+			// The answer gives the GPS time of the end of the uplink
+			// transmission, in seconds and 1/256 second
+			gps := time.Duration(binary.LittleEndian.Uint32(c.Payload[0:4]))*time.Second +
+				time.Duration(c.Payload[4])*time.Second/256
+			s.syncTime(gps, s.lastUplinkEnd)
+
+		case CIDPingSlotChan:
+			freqOK, drOK := rs.SetPingSlotChannel(macFrequency(c.Payload[0:3]), c.Payload[3]&0x0F)
+			s.pendingMAC = append(s.pendingMAC, CIDPingSlotChan, ackBits(false, drOK, freqOK))
+
+		case CIDBeaconFreq:
+			freqOK := rs.SetBeaconFrequency(macFrequency(c.Payload[0:3]))
+			s.pendingMAC = append(s.pendingMAC, CIDBeaconFreq, ackBits(false, false, freqOK))
+		}
+	}
+}
+
+// macFrequency decodes a 24 bits frequency, in multiple of 100 Hz
+func macFrequency(b []uint8) uint32 {
+	return (uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16) * 100
+}
+
+// ackBits builds the status byte of a MAC command answer
+func ackBits(bit2, bit1, bit0 bool) uint8 {
+	var status uint8
+	if bit2 {
+		status |= 0x04
+	}
+	if bit1 {
+		status |= 0x02
+	}
+	if bit0 {
+		status |= 0x01
+	}
+	return status
+}
+
+// margin returns the demodulation margin of the last downlink for DevStatusAns,
+// as a 6 bits signed integer
+func (s *Session) margin() uint8 {
+	return uint8(max(min(s.SNR, 31), -32)) & 0x3F
+}
+
+// macAnswers returns the MAC commands to send in the next uplink
+func (s *Session) macAnswers() []uint8 {
+	var rekey []uint8
+	if s.rekeyInd {
+		// RekeyInd carries the LoRaWAN minor version of the device
+		rekey = []uint8{CIDRekey, 0x01}
+	}
+	if len(s.pendingMAC) == 0 && rekey == nil {
+		return s.stickyMAC
+	}
+	return append(append(rekey, s.stickyMAC...), s.pendingMAC...)
+}
@@ -0,0 +1,500 @@
+package lorawan
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+func TestDecodeMACCommands(t *testing.T) {
+	b := []uint8{CIDLinkADR, 0x52, 0x01, 0x00, 0x00, CIDDevStatus, CIDRXTimingSetup, 0x03}
+
+	cmds, err := DecodeMACCommands(b, false)
+	if err != nil {
+		t.Fatalf("DecodeMACCommands() error = %v", err)
+	}
+	if len(cmds) != 3 {
+		t.Fatalf("DecodeMACCommands() got %d commands, want 3", len(cmds))
+	}
+	if cmds[0].CID != CIDLinkADR || !bytes.Equal(cmds[0].Payload, []uint8{0x52, 0x01, 0x00, 0x00}) {
+		t.Errorf("command 0 = %+v, want LinkADRReq", cmds[0])
+	}
+	if cmds[1].CID != CIDDevStatus || len(cmds[1].Payload) != 0 {
+		t.Errorf("command 1 = %+v, want DevStatusReq", cmds[1])
+	}
+	if cmds[2].CID != CIDRXTimingSetup || !bytes.Equal(cmds[2].Payload, []uint8{0x03}) {
+		t.Errorf("command 2 = %+v, want RXTimingSetupReq", cmds[2])
+	}
+
+	if got := EncodeMACCommands(cmds); !bytes.Equal(got, b) {
+		t.Errorf("EncodeMACCommands() = %x, want %x", got, b)
+	}
+}
+
+func TestDecodeMACCommandsUplink(t *testing.T) {
+	b := []uint8{CIDLinkADR, 0x07, CIDDevStatus, 0xFF, 0x0A, CIDLinkCheck}
+
+	cmds, err := DecodeMACCommands(b, true)
+	if err != nil {
+		t.Fatalf("DecodeMACCommands() error = %v", err)
+	}
+	if len(cmds) != 3 || cmds[2].CID != CIDLinkCheck {
+		t.Errorf("DecodeMACCommands() = %+v, want LinkADRAns, DevStatusAns, LinkCheckReq", cmds)
+	}
+}
+
+func TestDecodeMACCommandsErrors(t *testing.T) {
+	cmds, err := DecodeMACCommands([]uint8{CIDDutyCycle, 0x01, 0x80, 0x01}, false)
+	if err != ErrInvalidMACCommand {
+		t.Errorf("unknown CID error = %v, want %v", err, ErrInvalidMACCommand)
+	}
+	if len(cmds) != 1 {
+		t.Errorf("commands before unknown CID = %d, want 1", len(cmds))
+	}
+
+	_, err = DecodeMACCommands([]uint8{CIDLinkADR, 0x52}, false)
+	if err != ErrInvalidMACCommand {
+		t.Errorf("truncated command error = %v, want %v", err, ErrInvalidMACCommand)
+	}
+}
+
+func TestProcessLinkADRReq(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.EU868()
+
+	// DR5, TXPower 2, channel 0 enabled
+	ProcessMACCommands([]MACCommand{{CIDLinkADR, []uint8{0x52, 0x01, 0x00, 0x00}}}, s, rs)
+
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDLinkADR, 0x07}) {
+		t.Errorf("answers = %x, want 0307", got)
+	}
+	if rs.DataRate() != 5 {
+		t.Errorf("DataRate() = %d, want 5", rs.DataRate())
+	}
+	if rs.UplinkChannel().SpreadingFactor() != lora.SpreadingFactor7 {
+		t.Errorf("uplink SF = %d, want 7", rs.UplinkChannel().SpreadingFactor())
+	}
+	if rs.UplinkChannel().TxPowerDBm() != region.EU868_MAX_EIRP_DBM-4 {
+		t.Errorf("uplink TX power = %d, want %d", rs.UplinkChannel().TxPowerDBm(), region.EU868_MAX_EIRP_DBM-4)
+	}
+}
+
+func TestProcessLinkADRReqRejected(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.EU868()
+
+	// DR5, TXPower 2, undefined channel 3 enabled: nothing must change
+	ProcessMACCommands([]MACCommand{{CIDLinkADR, []uint8{0x52, 0x08, 0x00, 0x00}}}, s, rs)
+
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDLinkADR, 0x06}) {
+		t.Errorf("answers = %x, want 0306", got)
+	}
+	if rs.DataRate() != 3 {
+		t.Errorf("DataRate() = %d, want unchanged 3", rs.DataRate())
+	}
+}
+
+func TestProcessLinkADRReqBlock(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.US915()
+
+	// All 125 kHz channels off, 500 kHz channel 64 on, then channels 0-7 on, DR3
+	ProcessMACCommands([]MACCommand{
+		{CIDLinkADR, []uint8{0xFF, 0x01, 0x00, 0x70}},
+		{CIDLinkADR, []uint8{0x3F, 0x00, 0xFF, 0x00}},
+	}, s, rs)
+
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDLinkADR, 0x07, CIDLinkADR, 0x07}) {
+		t.Errorf("answers = %x, want 03070307", got)
+	}
+	if rs.DataRate() != 3 {
+		t.Errorf("DataRate() = %d, want 3", rs.DataRate())
+	}
+}
+
+func TestProcessLinkADRReqSubBands(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.US915()
+
+	// ChMaskCntl 5: sub-band 2, channels 8-15 and 65, DR3
+	ProcessMACCommands([]MACCommand{{CIDLinkADR, []uint8{0x30, 0x02, 0x00, 0x50}}}, s, rs)
+
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDLinkADR, 0x07}) {
+		t.Errorf("answers = %x, want 0307", got)
+	}
+	up := rs.UplinkChannel()
+	for i := 0; i < 32; i++ {
+		up.Next()
+		if f := up.Frequency(); f < 903900000 || f > 905300000 {
+			t.Fatalf("uplink on %d Hz, want sub-band 2", f)
+		}
+	}
+	if !rs.SetDataRate(4) || !up.Next() || up.Frequency() != 904600000 {
+		t.Errorf("DR4 uplink on %d Hz, want 500 kHz channel 65", up.Frequency())
+	}
+}
+
+func TestUS915DefaultDataRate(t *testing.T) {
+	// Uplinks start on the 125 kHz channels, not only the 8 500 kHz ones
+	rs := region.US915()
+	if rs.DataRate() != 3 {
+		t.Errorf("DataRate() = %d, want 3", rs.DataRate())
+	}
+	if up := rs.UplinkChannel(); up.Bandwidth() != lora.Bandwidth_125_0 {
+		t.Errorf("uplink bandwidth = %d, want 125 kHz", up.Bandwidth())
+	}
+}
+
+func TestProcessNewChannelReq(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.EU868()
+
+	// Channel 3 at 867.1 MHz, DR0 to DR5
+	freq := uint32(867100000 / 100)
+	ProcessMACCommands([]MACCommand{
+		{CIDNewChannel, []uint8{0x03, uint8(freq), uint8(freq >> 8), uint8(freq >> 16), 0x50}},
+		// default channel cannot be changed
+		{CIDNewChannel, []uint8{0x00, uint8(freq), uint8(freq >> 8), uint8(freq >> 16), 0x50}},
+		// channels 0 and 3 enabled
+		{CIDLinkADR, []uint8{0xFF, 0x09, 0x00, 0x00}},
+	}, s, rs)
+
+	want := []uint8{CIDNewChannel, 0x03, CIDNewChannel, 0x00, CIDLinkADR, 0x07}
+	if got := s.macAnswers(); !bytes.Equal(got, want) {
+		t.Errorf("answers = %x, want %x", got, want)
+	}
+}
+
+func TestProcessDlChannelReq(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.EU868()
+
+	// Commands after a DlChannelReq are decoded
+	freq := uint32(869525000 / 100)
+	cmds, err := DecodeMACCommands([]uint8{
+		CIDDlChannel, 0x00, uint8(freq), uint8(freq >> 8), uint8(freq >> 16),
+		// undefined channel
+		CIDDlChannel, 0x05, uint8(freq), uint8(freq >> 8), uint8(freq >> 16),
+		// out of the band
+		CIDDlChannel, 0x01, 0x00, 0x00, 0x00,
+		CIDDutyCycle, 0x01,
+	}, false)
+	if err != nil || len(cmds) != 4 {
+		t.Fatalf("DecodeMACCommands() = %d commands, %v, want 4", len(cmds), err)
+	}
+	ProcessMACCommands(cmds, s, rs)
+
+	want := []uint8{CIDDlChannel, 0x03, CIDDlChannel, 0x01, CIDDlChannel, 0x02, CIDDutyCycle}
+	if got := s.macAnswers(); !bytes.Equal(got, want) {
+		t.Errorf("answers = %x, want %x", got, want)
+	}
+	if got := rs.RX1Channel().Frequency(); got != 869525000 {
+		t.Errorf("RX1 frequency = %d, want 869525000", got)
+	}
+}
+
+func TestProcessRXSettings(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.EU868()
+
+	freq := uint32(869525000 / 100)
+	ProcessMACCommands([]MACCommand{
+		{CIDRXParamSetup, []uint8{0x13, uint8(freq), uint8(freq >> 8), uint8(freq >> 16)}},
+		{CIDRXTimingSetup, []uint8{0x05}},
+		{CIDDutyCycle, []uint8{0x07}},
+	}, s, rs)
+
+	if s.DLSettings != 0x13 {
+		t.Errorf("DLSettings = 0x%02X, want 0x13", s.DLSettings)
+	}
+	if s.RX2Frequency != 869525000 {
+		t.Errorf("RX2Frequency = %d, want 869525000", s.RX2Frequency)
+	}
+	if s.RXDelay != 5 {
+		t.Errorf("RXDelay = %d, want 5", s.RXDelay)
+	}
+	if s.MaxDutyCycle != 7 {
+		t.Errorf("MaxDutyCycle = %d, want 7", s.MaxDutyCycle)
+	}
+
+	// RXParamSetupAns and RXTimingSetupAns are repeated until a downlink is received
+	want := []uint8{CIDRXParamSetup, 0x07, CIDRXTimingSetup, CIDDutyCycle}
+	if got := s.macAnswers(); !bytes.Equal(got, want) {
+		t.Errorf("answers = %x, want %x", got, want)
+	}
+	if _, err := s.GenUplink(&Uplink{FPort: 1}); err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	s.UplinkSent()
+	want = []uint8{CIDRXParamSetup, 0x07, CIDRXTimingSetup}
+	if got := s.macAnswers(); !bytes.Equal(got, want) {
+		t.Errorf("answers after uplink = %x, want %x", got, want)
+	}
+	if _, err := s.DecodeDownlink(genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 0, nil)); err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if got := s.macAnswers(); len(got) != 0 {
+		t.Errorf("answers after downlink = %x, want none", got)
+	}
+}
+
+func TestProcessRXParamSetupRejected(t *testing.T) {
+	s := testDownlinkSession()
+	s.DLSettings = 0x00
+	rs := region.EU868()
+
+	// 915 MHz is outside of EU868
+	freq := uint32(915000000 / 100)
+	ProcessMACCommands([]MACCommand{{CIDRXParamSetup, []uint8{0x13, uint8(freq), uint8(freq >> 8), uint8(freq >> 16)}}}, s, rs)
+
+	if s.DLSettings != 0 || s.RX2Frequency != 0 {
+		t.Errorf("DLSettings = 0x%02X, RX2Frequency = %d, want unchanged", s.DLSettings, s.RX2Frequency)
+	}
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDRXParamSetup, 0x06}) {
+		t.Errorf("answers = %x, want 0506", got)
+	}
+}
+
+func TestRegionInitialTxPower(t *testing.T) {
+	// TX power index 0 until a LinkADRReq, the regional EIRP limit
+	as923, _ := region.AS923(1)
+	tests := []struct {
+		name    string
+		rs      region.Settings
+		maxEIRP int8
+	}{
+		{"AS923", as923, region.AS923_MAX_EIRP_DBM},
+		{"AU915", region.AU915(), region.AU915_MAX_EIRP_DBM},
+		{"CN470", region.CN470(), region.CN470_MAX_EIRP_DBM},
+		{"EU433", region.EU433(), region.EU433_MAX_EIRP_DBM},
+		{"EU868", region.EU868(), region.EU868_MAX_EIRP_DBM},
+		{"IN865", region.IN865(), region.IN865_MAX_EIRP_DBM},
+		{"KR920", region.KR920(), region.KR920_MAX_EIRP_DBM},
+		{"RU864", region.RU864(), region.RU864_MAX_EIRP_DBM},
+		{"US915", region.US915(), region.US915_MAX_EIRP_DBM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rs.TxPower() != 0 {
+				t.Errorf("TxPower() = %d, want 0", tt.rs.TxPower())
+			}
+			if got := tt.rs.UplinkChannel().TxPowerDBm(); got != tt.maxEIRP {
+				t.Errorf("uplink TxPowerDBm() = %d, want %d", got, tt.maxEIRP)
+			}
+			if got := tt.rs.JoinRequestChannel().TxPowerDBm(); got != tt.maxEIRP {
+				t.Errorf("join request TxPowerDBm() = %d, want %d", got, tt.maxEIRP)
+			}
+		})
+	}
+}
+
+func TestProcessTxParamSetupReq(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.AU915()
+
+	// Uplink dwell time, max EIRP 16 dBm
+	ProcessMACCommands([]MACCommand{{CIDTxParamSetup, []uint8{0x15}}}, s, rs)
+
+	if up, down := rs.DwellTime(); !up || down {
+		t.Errorf("DwellTime() = %v, %v, want true, false", up, down)
+	}
+	if rs.UplinkChannel().TxPowerDBm() != 16 {
+		t.Errorf("TxPowerDBm() = %d, want 16", rs.UplinkChannel().TxPowerDBm())
+	}
+	// DR0 and DR1 cannot be used with an uplink dwell time
+	if rs.SetDataRate(1) {
+		t.Error("SetDataRate(1) accepted with an uplink dwell time")
+	}
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDTxParamSetup}) {
+		t.Errorf("answers = %x, want 09", got)
+	}
+
+	// EU868 ignores it
+	s = testDownlinkSession()
+	ProcessMACCommands([]MACCommand{{CIDTxParamSetup, []uint8{0x15}}}, s, region.EU868())
+	if got := s.macAnswers(); len(got) != 0 {
+		t.Errorf("EU868 answers = %x, want none", got)
+	}
+}
+
+func TestProcessClassBCommands(t *testing.T) {
+	s := testDownlinkSession()
+	rs := region.EU868()
+
+	// PingSlotChannelReq 869.525 MHz DR3, BeaconFreqReq 869.0 MHz
+	ProcessMACCommands([]MACCommand{
+		{CIDPingSlotChan, []uint8{0xD2, 0xAD, 0x84, 0x03}},
+		{CIDBeaconFreq, []uint8{0x50, 0x99, 0x84}},
+	}, s, rs)
+
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDPingSlotChan, 0x03, CIDBeaconFreq, 0x01}) {
+		t.Errorf("answers = %x, want 11031301", got)
+	}
+	ch, ok := rs.BeaconChannel(0)
+	if !ok || ch.Frequency() != 869000000 {
+		t.Errorf("BeaconChannel() frequency = %d, want 869000000", ch.Frequency())
+	}
+
+	// Outside of the region band
+	s = testDownlinkSession()
+	ProcessMACCommands([]MACCommand{{CIDBeaconFreq, []uint8{0x30, 0x9E, 0x8B}}}, s, rs)
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDBeaconFreq, 0x00}) {
+		t.Errorf("answers = %x, want 1300", got)
+	}
+}
+
+func TestProcessDeviceTimeAns(t *testing.T) {
+	s := testDownlinkSession()
+	s.lastUplinkEnd = time.Now()
+
+	// 1e9 seconds and a half since the GPS epoch
+	ProcessMACCommands([]MACCommand{{CIDDeviceTime, []uint8{0x00, 0xCA, 0x9A, 0x3B, 0x80}}}, s, region.EU868())
+
+	if !s.timeSynced {
+		t.Fatal("device clock not synchronized")
+	}
+	want := 1000000000*time.Second + 500*time.Millisecond
+	if got := GPSTime(s.lastUplinkEnd) + s.gpsOffset; got != want {
+		t.Errorf("GPS time of the uplink = %v, want %v", got, want)
+	}
+}
+
+func TestProcessLinkCheckAndDevStatus(t *testing.T) {
+	s := testDownlinkSession()
+	s.SNR = -5
+	BatteryLevel = 200
+	defer func() { BatteryLevel = 255 }()
+
+	ProcessMACCommands([]MACCommand{
+		{CIDLinkCheck, []uint8{12, 3}},
+		{CIDDevStatus, nil},
+	}, s, region.EU868())
+
+	if s.LinkMargin != 12 || s.GatewayCount != 3 {
+		t.Errorf("LinkMargin = %d, GatewayCount = %d, want 12 and 3", s.LinkMargin, s.GatewayCount)
+	}
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDDevStatus, 200, 0x3B}) {
+		t.Errorf("answers = %x, want 06c83b", got)
+	}
+}
+
+func TestMACAnswersSentInFOpts(t *testing.T) {
+	s := testDownlinkSession()
+	s.RequestLinkCheck()
+
+	msg, err := s.GenUplink(&Uplink{FPort: 1, Payload: []uint8{0x01}})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	if msg[5]&fCtrlFOptsLen != 1 {
+		t.Fatalf("FOptsLen = %d, want 1", msg[5]&fCtrlFOptsLen)
+	}
+	if msg[8] != CIDLinkCheck {
+		t.Errorf("FOpts = %x, want LinkCheckReq", msg[8:9])
+	}
+	// answers are dequeued once the frame is sent
+	if len(s.macAnswers()) != 1 {
+		t.Errorf("answers before the uplink is sent = %x, want LinkCheckReq", s.macAnswers())
+	}
+	s.UplinkSent()
+	if len(s.macAnswers()) != 0 {
+		t.Errorf("answers after uplink = %x, want none", s.macAnswers())
+	}
+}
+
+func TestMACAnswersKeptOnTxError(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{txError: lora.ErrTxTimeout}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}}
+	s := testDownlinkSession()
+	s.RequestLinkCheck()
+
+	if err := SendUplink([]uint8{0x01}, s); !errors.Is(err, lora.ErrTxTimeout) {
+		t.Fatalf("SendUplink() error = %v, want %v", err, lora.ErrTxTimeout)
+	}
+	if !bytes.Equal(s.macAnswers(), []uint8{CIDLinkCheck}) {
+		t.Errorf("answers after a failed Tx = %x, want LinkCheckReq", s.macAnswers())
+	}
+
+	radio.txError = nil
+	if err := SendUplink([]uint8{0x01}, s); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	if radio.txPayload[8] != CIDLinkCheck || len(s.macAnswers()) != 0 {
+		t.Errorf("uplink % X, answers %x, want LinkCheckReq sent and dequeued", radio.txPayload, s.macAnswers())
+	}
+}
+
+func TestMACAnswersOnFPort0(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	radio := &mockRadio{}
+	defaultStack.Radio = radio
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}}
+	s := testDownlinkSession()
+	// 8 NewChannelAns do not fit in FOpts
+	var answers []uint8
+	for i := 0; i < 8; i++ {
+		answers = append(answers, CIDNewChannel, 0x03)
+	}
+	s.pendingMAC = append([]uint8{}, answers...)
+
+	if err := SendUplink([]uint8("data"), s); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	if radio.txCount != 2 {
+		t.Fatalf("%d uplinks sent, want the data and the answers", radio.txCount)
+	}
+	msg := radio.txPayload
+	if msg[5]&fCtrlFOptsLen != 0 || msg[8] != 0 {
+		t.Fatalf("uplink % X, want the answers on FPort 0", msg)
+	}
+	clear, _ := s.genFRMPayload(s.NwkSKey, 0, 1, msg[9:len(msg)-4], false)
+	if !bytes.Equal(clear, answers) {
+		t.Errorf("FRMPayload = %x, want %x", clear, answers)
+	}
+	if len(s.macAnswers()) != 0 {
+		t.Errorf("answers after uplink = %x, want none", s.macAnswers())
+	}
+}
+
+func TestProcessShortMACCommands(t *testing.T) {
+	s := testDownlinkSession()
+
+	// hand built commands without their payload are ignored
+	ProcessMACCommands([]MACCommand{
+		{CIDLinkCheck, nil},
+		{CIDLinkADR, []uint8{0x50}},
+		{CIDNewChannel, []uint8{3, 0x18, 0x4F}},
+		{CIDDevStatus, nil},
+	}, s, region.EU868())
+
+	if s.LinkMargin != 0 || s.GatewayCount != 0 {
+		t.Errorf("LinkMargin = %d, GatewayCount = %d, want unchanged", s.LinkMargin, s.GatewayCount)
+	}
+	if got := s.macAnswers(); len(got) != 3 || got[0] != CIDDevStatus {
+		t.Errorf("answers = %x, want DevStatusAns only", got)
+	}
+}
+
+func TestMACCommandsOnFPort0(t *testing.T) {
+	s := testDownlinkSession()
+	phy := genTestDownlink(s, MTypeUnconfirmedDataDown, 0, nil, 0, 0, []uint8{CIDRXTimingSetup, 0x02})
+
+	dl, err := s.DecodeDownlink(phy)
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	ProcessMACCommands(dl.MACCommands, s, region.EU868())
+	if s.RXDelay != 2 {
+		t.Errorf("RXDelay = %d, want 2", s.RXDelay)
+	}
+}
@@ -15,8 +15,33 @@ func genPayloadMIC(payload []uint8, key [16]uint8) [4]uint8 {
 }
 
 func calcMessageMIC(payload []uint8, key [16]uint8, dir uint8, addr []byte, fCnt uint32, lenMessage uint8) [4]uint8 {
+	return calcMessageMIC11(payload, key, 0, dir, addr, fCnt, lenMessage)
+}
+
+// calcMessageMIC11 computes the MIC of a LoRaWAN 1.1 downlink, or the
+// FNwkSIntKey half of an uplink MIC. confFCnt is the frame counter of the
+// acknowledged confirmed frame, 0 if the ACK bit is not set.
+func calcMessageMIC11(payload []uint8, key [16]uint8, confFCnt uint16, dir uint8, addr []byte, fCnt uint32, lenMessage uint8) [4]uint8 {
+	b0 := micBlock(confFCnt, 0, 0, dir, addr, fCnt, lenMessage)
+	return genPayloadMIC(append(b0, payload...), key)
+}
+
+// calcUplinkMIC11 computes the MIC of a LoRaWAN 1.1 uplink. It is made of
+// two bytes computed with SNwkSIntKey over the B1 block, carrying the data
+// rate and channel index of the transmission, and two bytes computed with
+// FNwkSIntKey over the B0 block.
+func calcUplinkMIC11(payload []uint8, fKey [16]uint8, sKey [16]uint8, confFCnt uint16, txDR uint8, txCh uint8, addr []byte, fCnt uint32, lenMessage uint8) [4]uint8 {
+	b1 := micBlock(confFCnt, txDR, txCh, 0, addr, fCnt, lenMessage)
+	cmacS := genPayloadMIC(append(b1, payload...), sKey)
+	cmacF := calcMessageMIC11(payload, fKey, 0, 0, addr, fCnt, lenMessage)
+	return [4]uint8{cmacS[0], cmacS[1], cmacF[0], cmacF[1]}
+}
+
+// micBlock builds the B0 (or LoRaWAN 1.1 B1) block prepended to a data
+// message to compute its MIC
+func micBlock(confFCnt uint16, txDR uint8, txCh uint8, dir uint8, addr []byte, fCnt uint32, lenMessage uint8) []byte {
 	var b0 []byte
-	b0 = append(b0, 0x49, 0x00, 0x00, 0x00, 0x00)
+	b0 = append(b0, 0x49, uint8(confFCnt), uint8(confFCnt>>8), txDR, txCh)
 	b0 = append(b0, dir)
 	b0 = append(b0, addr[:]...)
 	var b [4]byte
@@ -24,15 +49,5 @@ func calcMessageMIC(payload []uint8, key [16]uint8, dir uint8, addr []byte, fCnt
 	b0 = append(b0, b[:]...)
 	b0 = append(b0, 0x00)
 	b0 = append(b0, lenMessage)
-
-	var full []byte
-	full = append(full, b0...)
-	full = append(full, payload...)
-
-	var mic [4]uint8
-	hash, _ := NewCmac(key[:])
-	hash.Write(full)
-	hb := hash.Sum([]byte{})
-	copy(mic[:], hb[0:4])
-	return mic
+	return b0
 }
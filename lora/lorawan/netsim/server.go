@@ -0,0 +1,588 @@
+package netsim
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+	"tinygo.org/x/wireless/lora/lorawan"
+)
+
+var (
+	ErrUnknownDevice  = errors.New("unknown device")
+	ErrInvalidMic     = errors.New("invalid Mic")
+	ErrDevNonceReused = errors.New("DevNonce was already used")
+	ErrInvalidFCntUp  = errors.New("invalid uplink frame counter")
+	ErrInvalidFrame   = errors.New("invalid frame")
+	ErrQueueFull      = errors.New("downlink does not fit in one frame")
+)
+
+// Server is an in-process LoRaWAN network server, join server and
+// application server, seen by the end-device through the lora.PacketRadio
+// it implements. It can be attached to a lorawan.Stack to run Join, uplinks
+// and downlinks on a host, without hardware.
+//
+// Frames sent with Tx are processed at once: join requests of the
+// provisioned devices are answered with a join accept, data uplinks are
+// checked (MIC and frame counter), decrypted and recorded. The answer, if
+// any, is returned by the next Rx with inverted IQ, whatever the receive
+// window: the server does not model frequencies, data rates or timing.
+//
+// The LoRaWAN 1.1 uplink MIC covers the data rate and channel index of the
+// transmission, which depend on the region channel plan: the server accepts
+// any data rate and channel index.
+type Server struct {
+	// Join accept parameters
+	NetID      [3]uint8
+	DLSettings uint8   // RX1DROffset and RX2 data rate, OptNeg is set for LoRaWAN 1.1 devices
+	RXDelay    uint8   // RX1 delay in seconds, 0 is 1 second
+	CFList     []uint8 // nil or the 16 bytes CFList of the region
+
+	// LinkCheckAns parameters
+	Margin       uint8
+	GatewayCount uint8
+
+	// Link quality of the frames received by the device, from RxPacket
+	RSSI int16 // in dBm
+	SNR  int8  // in dB
+
+	mu        sync.Mutex
+	devices   []*Device
+	uplinks   []Uplink
+	errs      []error
+	joinNonce uint32
+	devAddr   uint32
+
+	iqMode  uint8
+	pending []uint8       // answer to the last uplink
+	wakeup  chan struct{} // a Class C downlink was queued
+}
+
+// Device is an end-device provisioned on the server. DevEUI, JoinEUI
+// (AppEUI for LoRaWAN 1.0) and the root keys must match the lorawan.Otaa
+// of the device, a non zero NwkKey selects LoRaWAN 1.1.
+type Device struct {
+	DevEUI  [8]uint8
+	JoinEUI [8]uint8
+	AppKey  [16]uint8
+	NwkKey  [16]uint8
+	Class   uint8 // lorawan.ClassC devices get downlinks outside receive windows
+
+	// Session is the network side of the session established by the last
+	// join: keys, DevAddr and frame counters. FCntUp is the next uplink
+	// counter expected, FCntDown, NFCntDown and AFCntDown the next downlink
+	// counters.
+	Session *lorawan.Session
+
+	devNonces map[uint16]bool
+	lastNonce uint16
+	lastFCnt  uint32
+	uplinks   uint32 // data uplinks received in the session
+	confFCnt  uint32 // counter of the last confirmed downlink
+	queue     []downlink
+	mac       []uint8
+}
+
+// Uplink is a data uplink received from a device, decrypted
+type Uplink struct {
+	DevEUI         [8]uint8
+	Confirmed      bool
+	ADR            bool
+	ADRACKReq      bool
+	ACK            bool
+	FCnt           uint32
+	FPort          uint8
+	HasFPort       bool
+	Payload        []uint8
+	MACCommands    []lorawan.MACCommand
+	Retransmission bool // same frame counter as the previous uplink
+}
+
+type downlink struct {
+	confirmed bool
+	fPort     uint8
+	payload   []uint8
+}
+
+// NewServer returns a network server without devices. Join accepts give
+// the NetID 0x000013, LinkCheckAns a 20 dB margin with one gateway. The
+// device receives its frames at -80 dBm with a 7 dB SNR.
+func NewServer() *Server {
+	return &Server{
+		NetID:        [3]uint8{0x13, 0x00, 0x00},
+		Margin:       20,
+		GatewayCount: 1,
+		RSSI:         -80,
+		SNR:          7,
+		devAddr:      1,
+		wakeup:       make(chan struct{}, 1),
+	}
+}
+
+// AddDevice provisions d, it can then join the network
+func (srv *Server) AddDevice(d *Device) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	d.devNonces = make(map[uint16]bool)
+	srv.devices = append(srv.devices, d)
+}
+
+// Uplinks returns the data uplinks received so far
+func (srv *Server) Uplinks() []Uplink {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]Uplink{}, srv.uplinks...)
+}
+
+// Errors returns the errors of the frames rejected so far, such as
+// ErrInvalidMic or ErrInvalidFCntUp
+func (srv *Server) Errors() []error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]error{}, srv.errs...)
+}
+
+// Enqueue queues a downlink on fPort for the device devEUI, sent in the
+// receive windows of its next uplink. Downlinks of Class C devices are
+// sent by the next Rx.
+func (srv *Server) Enqueue(devEUI [8]uint8, fPort uint8, payload []uint8, confirmed bool) error {
+	if fPort == 0 {
+		return lorawan.ErrInvalidFPort
+	}
+	return srv.enqueue(devEUI, downlink{confirmed: confirmed, fPort: fPort, payload: payload}, nil)
+}
+
+// EnqueueMACCommands queues MAC commands for the device devEUI, sent in
+// FOpts of its next downlink
+func (srv *Server) EnqueueMACCommands(devEUI [8]uint8, cmds ...lorawan.MACCommand) error {
+	return srv.enqueue(devEUI, downlink{}, lorawan.EncodeMACCommands(cmds))
+}
+
+func (srv *Server) enqueue(devEUI [8]uint8, dl downlink, mac []uint8) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	d := srv.device(devEUI)
+	if d == nil || d.Session == nil {
+		return ErrUnknownDevice
+	}
+	if len(d.mac)+len(mac) > lorawan.FOptsMaxLen {
+		return ErrQueueFull
+	}
+	d.mac = append(d.mac, mac...)
+	if dl.fPort != 0 {
+		d.queue = append(d.queue, dl)
+	}
+
+	if d.Class == lorawan.ClassC && srv.pending == nil {
+		if phy, err := srv.genDownlink(d, false, 0); err == nil {
+			srv.pending = phy
+			select {
+			case srv.wakeup <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (srv *Server) device(devEUI [8]uint8) *Device {
+	for _, d := range srv.devices {
+		if d.DevEUI == devEUI {
+			return d
+		}
+	}
+	return nil
+}
+
+func (srv *Server) deviceByAddr(devAddr [4]uint8) *Device {
+	for _, d := range srv.devices {
+		if d.Session != nil && d.Session.DevAddr == devAddr {
+			return d
+		}
+	}
+	return nil
+}
+
+// Tx processes a frame sent by the device, frames sent with inverted IQ
+// are ignored as the gateway does not receive them
+func (srv *Server) Tx(pkt []uint8, timeoutMs uint32) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.iqMode == lora.IQInverted {
+		return nil
+	}
+
+	srv.pending = nil
+	p := &lorawan.PHYPayload{}
+	if err := p.UnmarshalBinary(pkt); err != nil {
+		srv.errs = append(srv.errs, err)
+		return nil
+	}
+	var err error
+	switch p.MType {
+	case lorawan.MTypeJoinRequest:
+		srv.pending, err = srv.join(p)
+	case lorawan.MTypeUnconfirmedDataUp, lorawan.MTypeConfirmedDataUp:
+		srv.pending, err = srv.uplink(p)
+	default:
+		err = ErrInvalidFrame
+	}
+	if err != nil {
+		srv.errs = append(srv.errs, err)
+	}
+	return nil
+}
+
+// Rx returns the answer to the last frame sent, or a downlink queued for a
+// Class C device. It waits up to timeoutMs and returns lora.ErrRxTimeout
+// when there is nothing to receive.
+func (srv *Server) Rx(timeoutMs uint32) ([]uint8, error) {
+	timeout := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer timeout.Stop()
+	for {
+		srv.mu.Lock()
+		if srv.iqMode == lora.IQInverted && srv.pending != nil {
+			pkt := srv.pending
+			srv.pending = nil
+			srv.mu.Unlock()
+			return pkt, nil
+		}
+		srv.mu.Unlock()
+
+		select {
+		case <-srv.wakeup:
+		case <-timeout.C:
+			return nil, lora.ErrRxTimeout
+		}
+	}
+}
+
+// RxPacket is Rx returning the frame with the RSSI and SNR of the server
+func (srv *Server) RxPacket(timeoutMs uint32) (*lora.RxPacket, error) {
+	pkt, err := srv.Rx(timeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return &lora.RxPacket{Payload: pkt, RSSI: srv.RSSI, SNR: srv.SNR, Time: time.Now()}, nil
+}
+
+// join answers a join request with a join accept and derives the session
+func (srv *Server) join(p *lorawan.PHYPayload) ([]uint8, error) {
+	jr := p.MACPayload.(*lorawan.JoinRequest)
+	d := srv.device(jr.DevEUI)
+	if d == nil || d.JoinEUI != jr.JoinEUI {
+		return nil, ErrUnknownDevice
+	}
+	v11 := d.NwkKey != [16]uint8{}
+	rootKey := d.AppKey
+	if v11 {
+		rootKey = d.NwkKey
+	}
+	if ok, err := p.ValidateMIC(rootKey); err != nil || !ok {
+		return nil, ErrInvalidMic
+	}
+	// LoRaWAN 1.1 DevNonce is a counter, LoRaWAN 1.0 ones are random
+	if d.devNonces[jr.DevNonce] || v11 && len(d.devNonces) > 0 && jr.DevNonce <= d.lastNonce {
+		return nil, ErrDevNonceReused
+	}
+	d.devNonces[jr.DevNonce] = true
+	d.lastNonce = jr.DevNonce
+
+	srv.joinNonce++
+	// Type 0 NetID: the 7 bits NwkID of the DevAddr are the NetID LSBs
+	addr := uint32(srv.NetID[0]&0x7F)<<25 | srv.devAddr&0x01FFFFFF
+	srv.devAddr++
+	ja := &lorawan.JoinAccept{
+		JoinNonce:  srv.joinNonce,
+		NetID:      srv.NetID,
+		DLSettings: srv.DLSettings &^ 0x80,
+		RXDelay:    srv.RXDelay,
+		CFList:     srv.CFList,
+	}
+	binary.LittleEndian.PutUint32(ja.DevAddr[:], addr)
+
+	s := &lorawan.Session{
+		DevAddr:    ja.DevAddr,
+		DLSettings: ja.DLSettings,
+		RXDelay:    ja.RXDelay,
+		Activation: lorawan.ActivationOTAA,
+	}
+	joinNonce := []uint8{uint8(ja.JoinNonce), uint8(ja.JoinNonce >> 8), uint8(ja.JoinNonce >> 16)}
+	devNonce := binary.LittleEndian.AppendUint16(nil, jr.DevNonce)
+	reply := &lorawan.PHYPayload{MType: lorawan.MTypeJoinAccept, MACPayload: ja}
+	if v11 {
+		ja.DLSettings |= 0x80 // OptNeg
+		nonces := append(append(joinNonce, reverse(d.JoinEUI[:])...), devNonce...)
+		s.AppSKey = deriveKey(d.AppKey, 0x02, nonces)
+		s.FNwkSIntKey = deriveKey(d.NwkKey, 0x01, nonces)
+		s.SNwkSIntKey = deriveKey(d.NwkKey, 0x03, nonces)
+		s.NwkSEncKey = deriveKey(d.NwkKey, 0x04, nonces)
+		s.Version = lorawan.Version11
+		jsIntKey := deriveKey(d.NwkKey, 0x06, reverse(d.DevEUI[:]))
+		if err := reply.SetJoinAcceptMIC11(jsIntKey, 0xFF, d.JoinEUI, jr.DevNonce); err != nil {
+			return nil, err
+		}
+	} else {
+		nonces := append(append(joinNonce, srv.NetID[:]...), devNonce...)
+		s.NwkSKey = deriveKey(d.AppKey, 0x01, nonces)
+		s.AppSKey = deriveKey(d.AppKey, 0x02, nonces)
+		s.Version = lorawan.Version10
+		if err := reply.SetMIC(d.AppKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := reply.EncryptJoinAccept(rootKey); err != nil {
+		return nil, err
+	}
+
+	d.Session = s
+	d.lastFCnt = 0
+	d.uplinks = 0
+	d.queue = nil
+	d.mac = nil
+	return reply.MarshalBinary()
+}
+
+// uplink checks, decrypts and records a data uplink, and returns the
+// downlink answering it, if any
+func (srv *Server) uplink(p *lorawan.PHYPayload) ([]uint8, error) {
+	mac := p.MACPayload.(*lorawan.MACPayload)
+	d := srv.deviceByAddr(mac.FHDR.DevAddr)
+	if d == nil {
+		return nil, ErrUnknownDevice
+	}
+	s := d.Session
+
+	// A retransmission keeps the frame counter of the previous uplink
+	next := s.FCntUp
+	if d.uplinks > 0 {
+		next = d.lastFCnt
+	}
+	gap := uint16(mac.FHDR.FCnt) - uint16(next)
+	if gap >= lorawan.MAX_FCNT_GAP || uint64(next)+uint64(gap) > math.MaxUint32 {
+		return nil, ErrInvalidFCntUp
+	}
+	fCnt := next + uint32(gap)
+	mac.FHDR.FCnt = fCnt
+
+	confFCnt := uint16(0)
+	if s.Version == lorawan.Version11 && mac.FHDR.FCtrl.ACK {
+		confFCnt = uint16(d.confFCnt)
+	}
+	if !srv.validUplinkMIC(p, s, confFCnt) {
+		return nil, ErrInvalidMic
+	}
+
+	retransmission := d.uplinks > 0 && fCnt == d.lastFCnt
+	up := Uplink{
+		DevEUI:         d.DevEUI,
+		Confirmed:      p.MType == lorawan.MTypeConfirmedDataUp,
+		ADR:            mac.FHDR.FCtrl.ADR,
+		ADRACKReq:      mac.FHDR.FCtrl.ADRACKReq,
+		ACK:            mac.FHDR.FCtrl.ACK,
+		FCnt:           fCnt,
+		Retransmission: retransmission,
+	}
+	if s.Version == lorawan.Version11 {
+		if err := p.DecryptFOpts(s.NwkSEncKey); err != nil {
+			return nil, err
+		}
+	}
+	macCmds := mac.FHDR.FOpts
+	if mac.FPort != nil {
+		key := s.AppSKey
+		if *mac.FPort == 0 {
+			key = nwkSEncKey(s)
+		}
+		if err := p.DecryptFRMPayload(key); err != nil {
+			return nil, err
+		}
+		up.HasFPort = true
+		up.FPort = *mac.FPort
+		up.Payload = mac.FRMPayload
+		if up.FPort == 0 {
+			macCmds = mac.FRMPayload
+		}
+	}
+	up.MACCommands, _ = lorawan.DecodeMACCommands(macCmds, true)
+	srv.uplinks = append(srv.uplinks, up)
+
+	d.lastFCnt = fCnt
+	d.uplinks++
+	s.FCntUp = fCnt + 1
+	if !retransmission {
+		srv.answerMACCommands(d, up.MACCommands)
+	}
+
+	if !up.Confirmed && !up.ADRACKReq && len(d.queue) == 0 && len(d.mac) == 0 {
+		return nil, nil
+	}
+	return srv.genDownlink(d, up.Confirmed, fCnt)
+}
+
+// maxChannels is the largest number of uplink channels of a region, CN470
+const maxChannels = 96
+
+// validUplinkMIC checks the MIC of a data uplink. The LoRaWAN 1.1 MIC is
+// checked against every data rate and channel index.
+func (srv *Server) validUplinkMIC(p *lorawan.PHYPayload, s *lorawan.Session, confFCnt uint16) bool {
+	if s.Version != lorawan.Version11 {
+		ok, err := p.ValidateDataMIC(s.NwkSKey, 0)
+		return err == nil && ok
+	}
+	for dr := 0; dr < 16; dr++ {
+		for ch := 0; ch < maxChannels; ch++ {
+			ok, err := p.ValidateUplinkDataMIC11(s.FNwkSIntKey, s.SNwkSIntKey, confFCnt, uint8(dr), uint8(ch))
+			if err != nil {
+				return false
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answerMACCommands queues the answers to the MAC commands of an uplink
+func (srv *Server) answerMACCommands(d *Device, cmds []lorawan.MACCommand) {
+	for _, c := range cmds {
+		var ans []uint8
+		switch c.CID {
+		case lorawan.CIDLinkCheck:
+			ans = []uint8{lorawan.CIDLinkCheck, srv.Margin, srv.GatewayCount}
+		case lorawan.CIDDeviceTime:
+			gps := lorawan.GPSTime(time.Now())
+			ans = binary.LittleEndian.AppendUint32([]uint8{lorawan.CIDDeviceTime}, uint32(gps/time.Second))
+			ans = append(ans, uint8(gps%time.Second*256/time.Second))
+		case lorawan.CIDRekey:
+			// RekeyConf with the LoRaWAN 1.1 minor version of the server
+			ans = []uint8{lorawan.CIDRekey, 0x01}
+		}
+		// Answers that do not fit in FOpts are dropped
+		if len(d.mac)+len(ans) <= lorawan.FOptsMaxLen {
+			d.mac = append(d.mac, ans...)
+		}
+	}
+}
+
+// genDownlink builds the next downlink of d: the first queued application
+// payload and the queued MAC commands. ack acknowledges the confirmed
+// uplink confFCnt.
+func (srv *Server) genDownlink(d *Device, ack bool, confFCnt uint32) ([]uint8, error) {
+	s := d.Session
+	mac := &lorawan.MACPayload{
+		FHDR: lorawan.FHDR{
+			DevAddr: s.DevAddr,
+			FCtrl:   lorawan.FCtrl{ACK: ack},
+			FOpts:   d.mac,
+		},
+	}
+	mType := uint8(lorawan.MTypeUnconfirmedDataDown)
+	confirmed := false
+	fCntDown := &s.FCntDown
+	if s.Version == lorawan.Version11 {
+		fCntDown = &s.NFCntDown
+	}
+	if len(d.queue) > 0 {
+		dl := d.queue[0]
+		d.queue = d.queue[1:]
+		confirmed = dl.confirmed
+		fPort := dl.fPort
+		mac.FPort = &fPort
+		mac.FRMPayload = dl.payload
+		if s.Version == lorawan.Version11 {
+			fCntDown = &s.AFCntDown
+		}
+	}
+	mac.FHDR.FCtrl.FPending = len(d.queue) > 0
+	mac.FHDR.FCnt = *fCntDown
+	if confirmed {
+		mType = lorawan.MTypeConfirmedDataDown
+		d.confFCnt = *fCntDown
+	}
+	d.mac = nil
+
+	p := &lorawan.PHYPayload{MType: mType, MACPayload: mac}
+	if s.Version == lorawan.Version11 {
+		if err := p.EncryptFOpts(s.NwkSEncKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.EncryptFRMPayload(s.AppSKey); err != nil {
+		return nil, err
+	}
+	micConfFCnt := uint16(0)
+	if s.Version == lorawan.Version11 && ack {
+		micConfFCnt = uint16(confFCnt)
+	}
+	key := s.NwkSKey
+	if s.Version == lorawan.Version11 {
+		key = s.SNwkSIntKey
+	}
+	if err := p.SetDataMIC(key, micConfFCnt); err != nil {
+		return nil, err
+	}
+	*fCntDown++
+	return p.MarshalBinary()
+}
+
+// Reset does nothing, the server has no radio to reset
+func (srv *Server) Reset() {}
+
+// SetIqMode selects the direction of the next Tx or Rx, only frames sent
+// with standard IQ are received by the server and its answers are only
+// received with inverted IQ
+func (srv *Server) SetIqMode(mode uint8) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.iqMode = mode
+}
+
+func (srv *Server) SetFrequency(freq uint32)       {}
+func (srv *Server) SetCodingRate(cr uint8)         {}
+func (srv *Server) SetBandwidth(bw uint8)          {}
+func (srv *Server) SetCrc(enable bool)             {}
+func (srv *Server) SetSpreadingFactor(sf uint8)    {}
+func (srv *Server) SetHeaderType(headerType uint8) {}
+func (srv *Server) SetPreambleLength(pLen uint16)  {}
+func (srv *Server) SetPublicNetwork(enabled bool)  {}
+func (srv *Server) SetSyncWord(syncWord uint16)    {}
+func (srv *Server) SetTxPower(txPower int8)        {}
+func (srv *Server) LoraConfig(cnf lora.Config)     {}
+
+// nwkSEncKey returns the key of FPort 0 payloads, NwkSKey for LoRaWAN 1.0
+// sessions
+func nwkSEncKey(s *lorawan.Session) [16]uint8 {
+	if s.Version == lorawan.Version11 {
+		return s.NwkSEncKey
+	}
+	return s.NwkSKey
+}
+
+// deriveKey returns aes128_encrypt(key, prefix|data|pad16)
+func deriveKey(key [16]uint8, prefix uint8, data []uint8) [16]uint8 {
+	var block, out [16]uint8
+	block[0] = prefix
+	copy(block[1:], data)
+	cipher, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	cipher.Encrypt(out[:], block[:])
+	return out
+}
+
+func reverse(b []uint8) []uint8 {
+	r := make([]uint8, len(b))
+	for i := range b {
+		r[i] = b[len(b)-1-i]
+	}
+	return r
+}
@@ -0,0 +1,189 @@
+package netsim
+
+import (
+	"testing"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+	"tinygo.org/x/wireless/lora/lorawan"
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+var (
+	testJoinEUI = [8]uint8{0x70, 0xB3, 0xD5, 0x7E, 0xD0, 0x00, 0x00, 0x01}
+	testDevEUI  = [8]uint8{0x00, 0x04, 0xA3, 0x0B, 0x00, 0x1C, 0x05, 0x30}
+	testAppKey  = [16]uint8{0x2B, 0x7E, 0x15, 0x16, 0x28, 0xAE, 0xD2, 0xA6, 0xAB, 0xF7, 0x15, 0x88, 0x09, 0xCF, 0x4F, 0x3C}
+	testNwkKey  = [16]uint8{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10}
+)
+
+// testStack returns a US915 stack, without duty cycle limits, joined to
+// a new server. A LoRaWAN 1.1 device is provisioned when v11 is set.
+func testStack(t *testing.T, v11 bool) (*lorawan.Stack, *Server, *Device) {
+	t.Helper()
+	srv := NewServer()
+	// Channel mask of sub-band 2
+	srv.CFList = []uint8{0x00, 0xFF, 0, 0, 0, 0, 0, 0, 0x02, 0, 0, 0, 0, 0, 0, 0x01}
+	d := &Device{DevEUI: testDevEUI, JoinEUI: testJoinEUI, AppKey: testAppKey}
+	if v11 {
+		d.NwkKey = testNwkKey
+	}
+	srv.AddDevice(d)
+
+	st := lorawan.NewStack(srv, region.US915())
+	st.Otaa.AppEUI = testJoinEUI
+	st.Otaa.DevEUI = testDevEUI
+	st.Otaa.AppKey = testAppKey
+	if v11 {
+		st.Otaa.NwkKey = testNwkKey
+	}
+	if err := st.Join(); err != nil {
+		t.Fatalf("Join() error = %v, server errors %v", err, srv.Errors())
+	}
+	return st, srv, d
+}
+
+func TestJoinUplink(t *testing.T) {
+	st, srv, d := testStack(t, false)
+
+	if d.Session.DevAddr != st.Session.DevAddr || d.Session.NwkSKey != st.Session.NwkSKey ||
+		d.Session.AppSKey != st.Session.AppSKey {
+		t.Fatalf("server session %+v does not match device session %+v", d.Session, st.Session)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		if err := st.SendUplink([]uint8(msg)); err != nil {
+			t.Fatalf("SendUplink() error = %v", err)
+		}
+	}
+	if idx := st.Region.UplinkChannelIndex(); idx < 8 || idx > 15 && idx != 65 {
+		t.Errorf("uplink channel %d, want sub-band 2 from the CFList", idx)
+	}
+	ups := srv.Uplinks()
+	if len(ups) != 2 {
+		t.Fatalf("received %d uplinks, want 2, errors %v", len(ups), srv.Errors())
+	}
+	for i, msg := range []string{"hello", "world"} {
+		if ups[i].FCnt != uint32(i) || ups[i].FPort != 1 || string(ups[i].Payload) != msg {
+			t.Errorf("uplink %d = %+v, want %q with FCnt %d", i, ups[i], msg, i)
+		}
+	}
+}
+
+func TestJoinUplink11(t *testing.T) {
+	st, srv, d := testStack(t, true)
+
+	if st.Session.Version != lorawan.Version11 || d.Session.SNwkSIntKey != st.Session.SNwkSIntKey ||
+		d.Session.AppSKey != st.Session.AppSKey {
+		t.Fatalf("server session %+v does not match device session %+v", d.Session, st.Session)
+	}
+	if err := st.SendUplink([]uint8("hello")); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	ups := srv.Uplinks()
+	if len(ups) != 1 || string(ups[0].Payload) != "hello" {
+		t.Fatalf("uplinks %+v, want hello, errors %v", ups, srv.Errors())
+	}
+	// The device indicates its LoRaWAN 1.1 session until RekeyConf
+	if len(ups[0].MACCommands) != 1 || ups[0].MACCommands[0].CID != lorawan.CIDRekey {
+		t.Errorf("MAC commands %+v, want RekeyInd", ups[0].MACCommands)
+	}
+}
+
+func TestConfirmedUplinkDownlink(t *testing.T) {
+	st, srv, _ := testStack(t, false)
+
+	if err := srv.Enqueue(testDevEUI, 2, []uint8("on"), false); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	st.Session.RequestLinkCheck()
+	dl, err := st.SendConfirmedUplink([]uint8("hello"))
+	if err != nil {
+		t.Fatalf("SendConfirmedUplink() error = %v, server errors %v", err, srv.Errors())
+	}
+	if !dl.ACK || dl.FPort != 2 || string(dl.Payload) != "on" {
+		t.Errorf("downlink %+v, want ACK and payload on on FPort 2", dl)
+	}
+	if st.Session.LinkMargin != 20 || st.Session.GatewayCount != 1 {
+		t.Errorf("LinkCheckAns margin %d, %d gateways, want 20 and 1",
+			st.Session.LinkMargin, st.Session.GatewayCount)
+	}
+	if dl.RSSI != -80 || dl.SNR != 7 || st.Session.SNR != 7 || dl.RxTime.IsZero() {
+		t.Errorf("downlink RSSI %d SNR %d at %v, session SNR %d, want -80, 7 and 7",
+			dl.RSSI, dl.SNR, dl.RxTime, st.Session.SNR)
+	}
+	if ups := srv.Uplinks(); len(ups) != 1 || !ups[0].Confirmed {
+		t.Errorf("uplinks %+v, want one confirmed uplink", ups)
+	}
+}
+
+func TestClassCDownlink(t *testing.T) {
+	st, srv, d := testStack(t, false)
+	d.Class = lorawan.ClassC
+	st.Session.Class = lorawan.ClassC
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		srv.Enqueue(testDevEUI, 3, []uint8("push"), false)
+	}()
+	var received []*lorawan.Downlink
+	err := st.ListenClassC(200*time.Millisecond, func(dl *lorawan.Downlink) {
+		received = append(received, dl)
+	})
+	if err != nil {
+		t.Fatalf("ListenClassC() error = %v", err)
+	}
+	if len(received) != 1 || received[0].FPort != 3 || string(received[0].Payload) != "push" {
+		t.Errorf("received %+v, want push on FPort 3", received)
+	}
+}
+
+func TestRejectedFrames(t *testing.T) {
+	st, srv, _ := testStack(t, false)
+	s := *st.Session
+	srv.SetIqMode(lora.IQStandard)
+
+	// A retransmission is accepted, an older frame counter is not
+	up, _ := s.GenMessage(0, []uint8("1"))
+	srv.Tx(up, 0)
+	srv.Tx(up, 0)
+	replay := s
+	replay.FCntUp = 0
+	up, _ = s.GenMessage(0, []uint8("2"))
+	srv.Tx(up, 0)
+	old, _ := replay.GenMessage(0, []uint8("3"))
+	srv.Tx(old, 0)
+
+	bad, _ := s.GenMessage(0, []uint8("4"))
+	bad[len(bad)-1] ^= 0xFF
+	srv.Tx(bad, 0)
+
+	o := &lorawan.Otaa{AppEUI: testJoinEUI, DevEUI: testDevEUI, AppKey: testAppKey}
+	o.Init()
+	jr, _ := o.GenerateJoinRequest()
+	srv.Tx(jr, 0)
+	srv.Tx(jr, 0)
+
+	ups := srv.Uplinks()
+	if len(ups) != 3 || !ups[1].Retransmission || ups[2].FCnt != 1 {
+		t.Errorf("uplinks %+v, want FCnt 0, its retransmission and FCnt 1", ups)
+	}
+	errs := srv.Errors()
+	want := []error{ErrInvalidFCntUp, ErrInvalidMic, ErrDevNonceReused}
+	if len(errs) != len(want) {
+		t.Fatalf("errors %v, want %v", errs, want)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d = %v, want %v", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestEnqueueErrors(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Enqueue(testDevEUI, 1, nil, false); err != ErrUnknownDevice {
+		t.Errorf("Enqueue() error = %v, want %v", err, ErrUnknownDevice)
+	}
+	if err := srv.Enqueue(testDevEUI, 0, nil, false); err != lorawan.ErrInvalidFPort {
+		t.Errorf("Enqueue() error = %v, want %v", err, lorawan.ErrInvalidFPort)
+	}
+}
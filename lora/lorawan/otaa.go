@@ -1,26 +1,47 @@
 package lorawan
 
 import (
-	"bytes"
 	"crypto/aes"
+	"encoding/binary"
 	"encoding/hex"
 )
 
-// Otaa is used to store Over The Air Activation data of a LoRaWAN session
+// Otaa is used to store Over The Air Activation data of a LoRaWAN session.
+// A device is a LoRaWAN 1.1 device when its NwkKey is set, AppEUI is then
+// called JoinEUI.
 type Otaa struct {
 	DevEUI   [8]uint8
 	AppEUI   [8]uint8
 	AppKey   [16]uint8
+	NwkKey   [16]uint8
 	devNonce [2]uint8
 	appNonce [3]uint8
 	NetID    [3]uint8
-	buf      []uint8
+
+	// lowest JoinNonce accepted by a LoRaWAN 1.1 device
+	minJoinNonce uint32
 }
 
-// Initialize DevNonce
+// Initialize DevNonce. LoRaWAN 1.1 DevNonce is a counter that must never be
+// reused, it is not randomized.
 func (o *Otaa) Init() {
-	o.buf = make([]uint8, 0)
-	o.generateDevNonce()
+	if !o.lorawan11() {
+		o.generateDevNonce()
+	}
+}
+
+// lorawan11 reports if the device implements LoRaWAN 1.1
+func (o *Otaa) lorawan11() bool {
+	return !isZero(o.NwkKey[:])
+}
+
+// rootNwkKey returns the key of the join procedure MIC and encryption,
+// LoRaWAN 1.0 devices only have an AppKey
+func (o *Otaa) rootNwkKey() [16]uint8 {
+	if o.lorawan11() {
+		return o.NwkKey
+	}
+	return o.AppKey
 }
 
 func (o *Otaa) generateDevNonce() {
@@ -37,10 +58,14 @@ func (o *Otaa) incrementDevNonce() {
 }
 
 // Set configures the Otaa AppEUI, DevEUI, AppKey for the device
-func (o *Otaa) Set(appEUI []uint8, devEUI []uint8, appKey []uint8) {
-	o.SetAppEUI(appEUI)
-	o.SetDevEUI(devEUI)
-	o.SetAppKey(appKey)
+func (o *Otaa) Set(appEUI []uint8, devEUI []uint8, appKey []uint8) error {
+	if err := o.SetAppEUI(appEUI); err != nil {
+		return err
+	}
+	if err := o.SetDevEUI(devEUI); err != nil {
+		return err
+	}
+	return o.SetAppKey(appKey)
 }
 
 // SetAppEUI configures the Otaa AppEUI
@@ -58,6 +83,15 @@ func (o *Otaa) GetAppEUI() string {
 	return hex.EncodeToString(o.AppEUI[:])
 }
 
+// SetJoinEUI configures the Otaa JoinEUI, the LoRaWAN 1.1 name of AppEUI
+func (o *Otaa) SetJoinEUI(joinEUI []uint8) error {
+	return o.SetAppEUI(joinEUI)
+}
+
+func (o *Otaa) GetJoinEUI() string {
+	return o.GetAppEUI()
+}
+
 // SetDevEUI configures the Otaa DevEUI
 func (o *Otaa) SetDevEUI(devEUI []uint8) error {
 	if len(devEUI) != 8 {
@@ -88,6 +122,21 @@ func (o *Otaa) GetAppKey() string {
 	return hex.EncodeToString(o.AppKey[:])
 }
 
+// SetNwkKey configures the Otaa NwkKey of a LoRaWAN 1.1 device
+func (o *Otaa) SetNwkKey(nwkKey []uint8) error {
+	if len(nwkKey) != 16 {
+		return ErrInvalidNwkKeyLength
+	}
+
+	copy(o.NwkKey[:], nwkKey)
+
+	return nil
+}
+
+func (o *Otaa) GetNwkKey() string {
+	return hex.EncodeToString(o.NwkKey[:])
+}
+
 func (o *Otaa) GetNetID() string {
 	return hex.EncodeToString(o.NetID[:])
 }
@@ -106,80 +155,122 @@ func (o *Otaa) SetNetID(netID []uint8) error {
 func (o *Otaa) GenerateJoinRequest() ([]uint8, error) {
 	o.incrementDevNonce()
 
-	// TODO: Add checks
-	o.buf = o.buf[:0]
-	o.buf = append(o.buf, 0x00)
-	o.buf = append(o.buf, reverseBytes(o.AppEUI[:])...)
-	o.buf = append(o.buf, reverseBytes(o.DevEUI[:])...)
-	o.buf = append(o.buf, o.devNonce[:]...)
-	mic := genPayloadMIC(o.buf, o.AppKey)
-	o.buf = append(o.buf, mic[:]...)
-
-	return o.buf, nil
+	p := &PHYPayload{
+		MType: MTypeJoinRequest,
+		MACPayload: &JoinRequest{
+			JoinEUI:  o.AppEUI,
+			DevEUI:   o.DevEUI,
+			DevNonce: binary.LittleEndian.Uint16(o.devNonce[:]),
+		},
+	}
+	if err := p.SetMIC(o.rootNwkKey()); err != nil {
+		return nil, err
+	}
+	return p.MarshalBinary()
 }
 
-// DecodeJoinAccept Decodes a Lora Join Accept packet
+// DecodeJoinAccept Decodes a Lora Join Accept packet.
+// A LoRaWAN 1.1 device joining a LoRaWAN 1.1 network server (OptNeg bit of
+// DLSettings set) derives the LoRaWAN 1.1 session keys, otherwise the
+// LoRaWAN 1.0 NwkSKey and AppSKey are derived from the root key.
 func (o *Otaa) DecodeJoinAccept(phyPload []uint8, s *Session) error {
-	if len(phyPload) < 12 {
+	if len(phyPload) < 17 {
 		return ErrInvalidPacketLength
 	}
-	data := phyPload[1:] // Remove trailing 0x20
-
-	// Prepare AES Cipher
-	block, err := aes.NewCipher(o.AppKey[:])
-	if err != nil {
+	p := &PHYPayload{}
+	if err := p.UnmarshalBinary(phyPload); err != nil {
 		return err
 	}
-	buf := make([]byte, len(data))
-	for k := 0; k < len(data)/aes.BlockSize; k++ {
-		block.Encrypt(buf[k*aes.BlockSize:], data[k*aes.BlockSize:])
+	rootKey := o.rootNwkKey()
+	if err := p.DecryptJoinAccept(rootKey); err != nil {
+		return err
+	}
+	ja := p.MACPayload.(*JoinAccept)
+	optNeg := o.lorawan11() && ja.DLSettings&0x80 != 0
+
+	// LoRaWAN 1.1 MIC adds the join request type, JoinEUI and DevNonce in
+	// front of the message
+	var ok bool
+	var err error
+	if optNeg {
+		// JSIntKey = aes128_encrypt(NwkKey, 0x06|DevEUI|pad16)
+		jsIntKey := deriveKey(o.NwkKey, 0x06, reverseBytes(o.DevEUI[:]))
+		devNonce := binary.LittleEndian.Uint16(o.devNonce[:])
+		ok, err = p.ValidateJoinAcceptMIC11(jsIntKey, 0xFF, o.AppEUI, devNonce)
+	} else {
+		ok, err = p.ValidateMIC(rootKey)
+	}
+	if err != nil || !ok {
+		return ErrInvalidMic
 	}
 
-	copy(o.appNonce[:], buf[0:3])
-	copy(o.NetID[:], buf[3:6])
-	copy(s.DevAddr[:], buf[6:10])
-	s.DLSettings = buf[10]
-	s.RXDelay = buf[11]
-
-	if len(buf) > 16 {
-		copy(s.CFList[:], buf[12:28])
+	if optNeg {
+		// JoinNonce must increase to prevent replay of join accepts
+		if ja.JoinNonce < o.minJoinNonce {
+			return ErrInvalidJoinNonce
+		}
+		o.minJoinNonce = ja.JoinNonce + 1
 	}
-	rxMic := buf[len(buf)-4:]
 
-	dataMic := []byte{}
-	dataMic = append(dataMic, phyPload[0])
-	dataMic = append(dataMic, o.appNonce[:]...)
-	dataMic = append(dataMic, o.NetID[:]...)
-	dataMic = append(dataMic, s.DevAddr[:]...)
-	dataMic = append(dataMic, s.DLSettings)
-	dataMic = append(dataMic, s.RXDelay)
-	dataMic = append(dataMic, s.CFList[:]...)
-	computedMic := genPayloadMIC(dataMic[:], o.AppKey)
-	if !bytes.Equal(computedMic[:], rxMic[:]) {
-		return ErrInvalidMic
+	o.appNonce = [3]uint8{uint8(ja.JoinNonce), uint8(ja.JoinNonce >> 8), uint8(ja.JoinNonce >> 16)}
+	o.NetID = ja.NetID
+	s.DevAddr = ja.DevAddr
+	s.DLSettings = ja.DLSettings
+	s.RXDelay = ja.RXDelay
+
+	s.CFList = [16]uint8{}
+	copy(s.CFList[:], ja.CFList)
+
+	if optNeg {
+		// LoRaWAN 1.1 keys: aes128_encrypt(key, prefix|JoinNonce|JoinEUI|DevNonce|pad16)
+		nonces := append(append(append([]uint8{}, o.appNonce[:]...), reverseBytes(o.AppEUI[:])...), o.devNonce[:]...)
+		s.AppSKey = deriveKey(o.AppKey, 0x02, nonces)
+		s.FNwkSIntKey = deriveKey(o.NwkKey, 0x01, nonces)
+		s.SNwkSIntKey = deriveKey(o.NwkKey, 0x03, nonces)
+		s.NwkSEncKey = deriveKey(o.NwkKey, 0x04, nonces)
+		s.NwkSKey = [16]uint8{}
+		s.Version = Version11
+	} else {
+		// NwkSKey = aes128_encrypt(AppKey, 0x01|AppNonce|NetID|DevNonce|pad16)
+		// AppSKey = aes128_encrypt(AppKey, 0x02|AppNonce|NetID|DevNonce|pad16)
+		nonces := append(append(append([]uint8{}, o.appNonce[:]...), o.NetID[:]...), o.devNonce[:]...)
+		s.NwkSKey = deriveKey(rootKey, 0x01, nonces)
+		s.AppSKey = deriveKey(rootKey, 0x02, nonces)
+		s.FNwkSIntKey = [16]uint8{}
+		s.SNwkSIntKey = [16]uint8{}
+		s.NwkSEncKey = [16]uint8{}
+		s.Version = Version10
 	}
-	// Generate NwkSKey
-	// NwkSKey = aes128_encrypt(AppKey, 0x01|AppNonce|NetID|DevNonce|pad16)
-	sKey := []byte{}
-	sKey = append(sKey, 0x01)
-	sKey = append(sKey, o.appNonce[:]...)
-	sKey = append(sKey, o.NetID[:]...)
-	sKey = append(sKey, o.devNonce[:]...)
-	for i := 0; i < 7; i++ {
-		sKey = append(sKey, 0x00) // PAD to 16
-	}
-	block.Encrypt(buf, sKey)
-	copy(s.NwkSKey[:], buf[0:16])
-
-	// Generate AppSKey
-	// AppSKey = aes128_encrypt(AppKey, 0x02|AppNonce|NetID|DevNonce|pad16)
-	sKey[0] = 0x02
-	block.Encrypt(buf, sKey)
-	copy(s.AppSKey[:], buf[0:16])
 
 	// Reset counters
 	s.FCntDown = 0
 	s.FCntUp = 0
+	s.AFCntDown = 0
+	s.NFCntDown = 0
+
+	s.Activation = ActivationOTAA
+
+	// Reset network server settings
+	s.RX2Frequency = 0
+	s.MaxDutyCycle = 0
+	s.pendingMAC = nil
+	s.stickyMAC = nil
+
+	// LoRaWAN 1.1 devices confirm the new keys with RekeyInd
+	s.rekeyInd = optNeg
 
 	return nil
 }
+
+// deriveKey returns aes128_encrypt(key, prefix|data|pad16)
+func deriveKey(key [16]uint8, prefix uint8, data []uint8) [16]uint8 {
+	var in, out [16]uint8
+	in[0] = prefix
+	copy(in[1:], data)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	block.Encrypt(out[:], in[:])
+	return out
+}
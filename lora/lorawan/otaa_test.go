@@ -0,0 +1,278 @@
+package lorawan
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+func testOtaa() *Otaa {
+	o := &Otaa{}
+	o.Set([]uint8{0x70, 0xB3, 0xD5, 0x7E, 0xD0, 0x00, 0x00, 0x01},
+		[]uint8{0x00, 0x04, 0xA3, 0x0B, 0x00, 0x1C, 0x05, 0x30},
+		[]uint8{0x2B, 0x7E, 0x15, 0x16, 0x28, 0xAE, 0xD2, 0xA6, 0xAB, 0xF7, 0x15, 0x88, 0x09, 0xCF, 0x4F, 0x3C})
+	o.Init()
+	return o
+}
+
+func TestOtaaSetErrors(t *testing.T) {
+	o := &Otaa{}
+	if err := o.Set(make([]uint8, 8), make([]uint8, 7), make([]uint8, 16)); err != ErrInvalidEuiLength {
+		t.Errorf("Set() error = %v, want %v", err, ErrInvalidEuiLength)
+	}
+	if err := o.Set(make([]uint8, 8), make([]uint8, 8), make([]uint8, 15)); err != ErrInvalidAppKeyLength {
+		t.Errorf("Set() error = %v, want %v", err, ErrInvalidAppKeyLength)
+	}
+}
+
+// genTestJoinAccept builds a join accept as the join server would: the MIC
+// is computed over micHeader and the message, then the message is encrypted
+// with an AES decrypt operation.
+func genTestJoinAccept(key [16]uint8, micKey [16]uint8, micHeader []uint8, msg []uint8) []uint8 {
+	mhdr := uint8(MTypeJoinAccept << 5)
+	mic := genPayloadMIC(append(append(append([]uint8{}, micHeader...), mhdr), msg...), micKey)
+	plain := append(append([]uint8{}, msg...), mic[:]...)
+
+	block, _ := aes.NewCipher(key[:])
+	phy := make([]uint8, 1+len(plain))
+	phy[0] = mhdr
+	for k := 0; k < len(plain)/aes.BlockSize; k++ {
+		block.Decrypt(phy[1+k*aes.BlockSize:], plain[k*aes.BlockSize:])
+	}
+	return phy
+}
+
+// joinAcceptMsg returns JoinNonce|NetID|DevAddr|DLSettings|RxDelay
+func joinAcceptMsg(joinNonce uint8, dlSettings uint8) []uint8 {
+	return []uint8{joinNonce, 0x00, 0x00, 0x13, 0x00, 0x00, 0x04, 0x03, 0x02, 0x01, dlSettings, 0x01}
+}
+
+func TestGenerateJoinRequest(t *testing.T) {
+	o := testOtaa()
+	o.devNonce = [2]uint8{0x10, 0x00}
+
+	req, err := o.GenerateJoinRequest()
+	if err != nil {
+		t.Fatalf("GenerateJoinRequest() error = %v", err)
+	}
+	if len(req) != 23 {
+		t.Fatalf("len = %d, want 23", len(req))
+	}
+	if !bytes.Equal(req[1:9], reverseBytes(o.AppEUI[:])) || !bytes.Equal(req[9:17], reverseBytes(o.DevEUI[:])) {
+		t.Errorf("JoinEUI/DevEUI = %x, want little endian EUIs", req[1:17])
+	}
+	if req[17] != 0x11 || req[18] != 0x00 {
+		t.Errorf("DevNonce = %x, want 1100", req[17:19])
+	}
+	mic := genPayloadMIC(req[:19], o.AppKey)
+	if !bytes.Equal(mic[:], req[19:]) {
+		t.Errorf("MIC = %x, want %x", req[19:], mic)
+	}
+}
+
+func TestDecodeJoinAccept10(t *testing.T) {
+	o := testOtaa()
+	s := &Session{FCntUp: 12}
+	phy := genTestJoinAccept(o.AppKey, o.AppKey, nil, joinAcceptMsg(0x01, 0x12))
+
+	if err := o.DecodeJoinAccept(phy, s); err != nil {
+		t.Fatalf("DecodeJoinAccept() error = %v", err)
+	}
+	if s.Version != Version10 || s.Activation != ActivationOTAA {
+		t.Errorf("Version = %d, Activation = %d, want 1.0 OTAA session", s.Version, s.Activation)
+	}
+	if s.DevAddr != [4]uint8{0x04, 0x03, 0x02, 0x01} || s.DLSettings != 0x12 || s.RXDelay != 1 {
+		t.Errorf("DevAddr = %x, DLSettings = 0x%02X, RXDelay = %d", s.DevAddr, s.DLSettings, s.RXDelay)
+	}
+	if s.FCntUp != 0 {
+		t.Errorf("FCntUp = %d, want 0", s.FCntUp)
+	}
+	nonces := append(append([]uint8{0x01, 0x00, 0x00}, 0x13, 0x00, 0x00), o.devNonce[:]...)
+	if s.NwkSKey != deriveKey(o.AppKey, 0x01, nonces) || s.AppSKey != deriveKey(o.AppKey, 0x02, nonces) {
+		t.Error("session keys not derived from AppKey, AppNonce, NetID and DevNonce")
+	}
+}
+
+func TestDecodeJoinAcceptInvalidMic(t *testing.T) {
+	o := testOtaa()
+	phy := genTestJoinAccept(o.AppKey, [16]uint8{0x01}, nil, joinAcceptMsg(0x01, 0x00))
+
+	if err := o.DecodeJoinAccept(phy, &Session{}); err != ErrInvalidMic {
+		t.Errorf("DecodeJoinAccept() error = %v, want %v", err, ErrInvalidMic)
+	}
+	if err := o.DecodeJoinAccept(phy[:12], &Session{}); err != ErrInvalidPacketLength {
+		t.Errorf("DecodeJoinAccept() error = %v, want %v", err, ErrInvalidPacketLength)
+	}
+}
+
+func TestDecodeJoinAccept11(t *testing.T) {
+	o := testOtaa()
+	o.SetNwkKey([]uint8{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 0x00})
+	o.devNonce = [2]uint8{0x05, 0x00}
+	s := &Session{}
+
+	jsIntKey := deriveKey(o.NwkKey, 0x06, reverseBytes(o.DevEUI[:]))
+	micHeader := append(append([]uint8{0xFF}, reverseBytes(o.AppEUI[:])...), o.devNonce[:]...)
+	phy := genTestJoinAccept(o.NwkKey, jsIntKey, micHeader, joinAcceptMsg(0x07, 0x80))
+
+	if err := o.DecodeJoinAccept(phy, s); err != nil {
+		t.Fatalf("DecodeJoinAccept() error = %v", err)
+	}
+	if s.Version != Version11 {
+		t.Errorf("Version = %d, want %d", s.Version, Version11)
+	}
+	nonces := append(append([]uint8{0x07, 0x00, 0x00}, reverseBytes(o.AppEUI[:])...), o.devNonce[:]...)
+	if s.AppSKey != deriveKey(o.AppKey, 0x02, nonces) {
+		t.Error("AppSKey not derived from AppKey")
+	}
+	if s.FNwkSIntKey != deriveKey(o.NwkKey, 0x01, nonces) ||
+		s.SNwkSIntKey != deriveKey(o.NwkKey, 0x03, nonces) ||
+		s.NwkSEncKey != deriveKey(o.NwkKey, 0x04, nonces) {
+		t.Error("network session keys not derived from NwkKey")
+	}
+
+	// RekeyInd is sent until RekeyConf is received
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDRekey, 0x01}) {
+		t.Errorf("answers = %x, want 0b01", got)
+	}
+	ProcessMACCommands([]MACCommand{{CIDRekey, []uint8{0x01}}}, s, nil)
+	if got := s.macAnswers(); len(got) != 0 {
+		t.Errorf("answers after RekeyConf = %x, want none", got)
+	}
+
+	// The same JoinNonce cannot be accepted twice
+	if err := o.DecodeJoinAccept(phy, s); err != ErrInvalidJoinNonce {
+		t.Errorf("replayed DecodeJoinAccept() error = %v, want %v", err, ErrInvalidJoinNonce)
+	}
+}
+
+func TestDecodeJoinAccept11With10Server(t *testing.T) {
+	o := testOtaa()
+	o.SetNwkKey([]uint8{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 0x00})
+	s := &Session{}
+	phy := genTestJoinAccept(o.NwkKey, o.NwkKey, nil, joinAcceptMsg(0x01, 0x00))
+
+	if err := o.DecodeJoinAccept(phy, s); err != nil {
+		t.Fatalf("DecodeJoinAccept() error = %v", err)
+	}
+	if s.Version != Version10 {
+		t.Errorf("Version = %d, want %d", s.Version, Version10)
+	}
+	nonces := append(append([]uint8{0x01, 0x00, 0x00}, 0x13, 0x00, 0x00), o.devNonce[:]...)
+	if s.NwkSKey != deriveKey(o.NwkKey, 0x01, nonces) || s.AppSKey != deriveKey(o.NwkKey, 0x02, nonces) {
+		t.Error("session keys not derived from NwkKey")
+	}
+}
+
+func TestJoinAppliesCFList(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	o := testOtaa()
+	// CFListType 0: channels 3 to 7 at 867.1, 867.3, 867.5, 867.7 and 867.9 MHz
+	msg := joinAcceptMsg(0x01, 0x00)
+	for i := uint32(0); i < 5; i++ {
+		freq := (867100000 + i*200000) / 100
+		msg = append(msg, uint8(freq), uint8(freq>>8), uint8(freq>>16))
+	}
+	msg = append(msg, 0x00)
+
+	defaultStack.Radio = &mockRadio{rxResponse: genTestJoinAccept(o.AppKey, o.AppKey, nil, msg)}
+	rs := region.EU868()
+	defaultStack.Region = rs
+	s := &Session{}
+
+	if err := Join(o, s); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+
+	// All 8 channels are defined and can be enabled
+	ProcessMACCommands([]MACCommand{{CIDLinkADR, []uint8{0xFF, 0xFF, 0x00, 0x00}}}, s, rs)
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDLinkADR, 0x07}) {
+		t.Errorf("answers = %x, want 0307", got)
+	}
+}
+
+func TestRegionJoinChannels(t *testing.T) {
+	as923g1, _ := region.AS923(1)
+	as923g3, _ := region.AS923(3)
+	tests := []struct {
+		name     string
+		rs       region.Settings
+		attempts int
+	}{
+		{"AS923-1", as923g1, 2},
+		{"AS923-3", as923g3, 2},
+		{"KR920", region.KR920(), 3},
+		{"IN865", region.IN865(), 3},
+		{"RU864", region.RU864(), 2},
+		{"EU433", region.EU433(), 3},
+		{"CN470", region.CN470(), 12},
+		{"AU915", region.AU915(), 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[uint32]bool{}
+			ch := tt.rs.JoinRequestChannel()
+			for {
+				seen[ch.Frequency()] = true
+				if !tt.rs.ValidDownlinkFrequency(tt.rs.JoinAcceptChannel().Frequency()) {
+					t.Errorf("join accept on %d, not a downlink frequency", tt.rs.JoinAcceptChannel().Frequency())
+				}
+				if !ch.Next() {
+					break
+				}
+			}
+			if len(seen) != tt.attempts {
+				t.Errorf("%d join channels tried, want %d", len(seen), tt.attempts)
+			}
+			if !tt.rs.ValidDownlinkFrequency(tt.rs.RX2Channel().Frequency()) {
+				t.Errorf("RX2 on %d, not a downlink frequency", tt.rs.RX2Channel().Frequency())
+			}
+		})
+	}
+}
+
+func TestRegionAS923Groups(t *testing.T) {
+	for _, group := range []uint8{0, 5} {
+		if rs, err := region.AS923(group); rs != nil || err != region.ErrInvalidAS923Group {
+			t.Errorf("AS923(%d) = %v, %v, want %v", group, rs, err, region.ErrInvalidAS923Group)
+		}
+	}
+	// the default channels of group 2 are 1.8 MHz below group 1
+	rs, err := region.AS923(2)
+	if err != nil {
+		t.Fatalf("AS923(2) error = %v", err)
+	}
+	if got := rs.UplinkChannel().Frequency(); got != 921400000 {
+		t.Errorf("uplink frequency = %d, want 921400000", got)
+	}
+}
+
+func TestRegionRX1DataRates(t *testing.T) {
+	tests := []struct {
+		name string
+		rs   region.Settings
+		dr   uint8
+		want []uint8 // by RX1DROffset
+	}{
+		{"US915 DR3", region.US915(), 3, []uint8{13, 12, 11, 10}},
+		{"US915 DR4", region.US915(), 4, []uint8{13, 13, 12, 11}},
+		{"AU915 DR5", region.AU915(), 5, []uint8{13, 12, 11, 10, 9, 8}},
+		{"AU915 DR6", region.AU915(), 6, []uint8{13, 13, 12, 11, 10, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for offset, want := range tt.want {
+				if got, ok := tt.rs.RX1DataRate(tt.dr, uint8(offset)); !ok || got != want {
+					t.Errorf("RX1DataRate(%d, %d) = %d, %v, want %d", tt.dr, offset, got, ok, want)
+				}
+			}
+			if _, ok := tt.rs.RX1DataRate(tt.dr, uint8(len(tt.want))); ok {
+				t.Errorf("RX1DataRate(%d, %d) is valid", tt.dr, len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"math"
+)
+
+// PHYPayload is a LoRaWAN frame: MHDR | MACPayload | MIC. MACPayload is a
+// *JoinRequest, *JoinAccept, *RejoinRequest or *MACPayload depending on
+// MType, or a *DataPayload for proprietary messages and join accepts not
+// decrypted yet.
+//
+// Marshaling does not compute anything: the MIC and the encryption are
+// applied with the methods taking the keys, before marshaling a frame or
+// after unmarshaling it.
+type PHYPayload struct {
+	MType      uint8 // MTypeJoinRequest to MTypeProprietary
+	Major      uint8 // 0 for LoRaWAN R1
+	MACPayload Payload
+	MIC        [4]uint8 // not present in proprietary messages
+}
+
+// Payload is the MACPayload of a PHYPayload
+type Payload interface {
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(b []byte) error
+}
+
+// JoinRequest is the MACPayload of a join request. EUIs are stored most
+// significant byte first, as in Otaa.
+type JoinRequest struct {
+	JoinEUI  [8]uint8 // AppEUI of LoRaWAN 1.0
+	DevEUI   [8]uint8
+	DevNonce uint16
+}
+
+// JoinAccept is the MACPayload of a decrypted join accept. NetID and
+// DevAddr are stored in frame order, as in Otaa and Session.
+type JoinAccept struct {
+	JoinNonce  uint32 // 24 bits, AppNonce of LoRaWAN 1.0
+	NetID      [3]uint8
+	DevAddr    [4]uint8
+	DLSettings uint8
+	RXDelay    uint8
+	CFList     []uint8 // nil or 16 bytes
+}
+
+// RejoinRequest is the MACPayload of a LoRaWAN 1.1 rejoin request. Type 0
+// and 2 requests carry NetID, type 1 requests JoinEUI.
+type RejoinRequest struct {
+	RejoinType uint8
+	NetID      [3]uint8
+	JoinEUI    [8]uint8
+	DevEUI     [8]uint8
+	RJcount    uint16
+}
+
+// FCtrl is the frame control byte of a data message, the FOpts length is
+// set from FHDR.FOpts
+type FCtrl struct {
+	ADR       bool
+	ADRACKReq bool // uplinks only
+	ACK       bool
+	FPending  bool // FPending in downlinks, Class B in uplinks
+}
+
+// FHDR is the frame header of a data message
+type FHDR struct {
+	DevAddr [4]uint8 // in frame order, as in Session
+	FCtrl   FCtrl
+	FCnt    uint32 // only the 16 least significant bits are transmitted
+	FOpts   []uint8
+}
+
+// MACPayload is the MACPayload of a data message
+type MACPayload struct {
+	FHDR       FHDR
+	FPort      *uint8 // nil when the frame has no FPort and FRMPayload
+	FRMPayload []uint8
+}
+
+// DataPayload holds the raw MACPayload of a proprietary message, or of a
+// join accept until DecryptJoinAccept
+type DataPayload struct {
+	Bytes []uint8
+}
+
+// MarshalBinary encodes the frame
+func (p *PHYPayload) MarshalBinary() ([]byte, error) {
+	if p.MACPayload == nil {
+		return nil, ErrInvalidMessageType
+	}
+	b, err := p.MACPayload.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]uint8{p.mhdr()}, b...)
+	if p.MType == MTypeProprietary {
+		return buf, nil
+	}
+	return append(buf, p.MIC[:]...), nil
+}
+
+// UnmarshalBinary decodes a frame. Join accepts are decoded to a
+// *DataPayload, DecryptJoinAccept decodes their content.
+func (p *PHYPayload) UnmarshalBinary(b []byte) error {
+	if len(b) < 1 {
+		return ErrInvalidPacketLength
+	}
+	p.MType = b[0] >> 5
+	p.Major = b[0] & 0x03
+
+	if p.MType == MTypeProprietary {
+		p.MACPayload = &DataPayload{Bytes: append([]uint8{}, b[1:]...)}
+		p.MIC = [4]uint8{}
+		return nil
+	}
+
+	if len(b) < 5 {
+		return ErrInvalidPacketLength
+	}
+	switch p.MType {
+	case MTypeJoinRequest:
+		p.MACPayload = &JoinRequest{}
+	case MTypeJoinAccept:
+		if n := len(b) - 5; n != 12 && n != 28 {
+			return ErrInvalidPacketLength
+		}
+		p.MACPayload = &DataPayload{}
+	case MTypeRejoinRequest:
+		p.MACPayload = &RejoinRequest{}
+	default:
+		p.MACPayload = &MACPayload{}
+	}
+	if err := p.MACPayload.UnmarshalBinary(b[1 : len(b)-4]); err != nil {
+		return err
+	}
+	copy(p.MIC[:], b[len(b)-4:])
+	return nil
+}
+
+// Uplink reports if the frame is sent by an end-device
+func (p *PHYPayload) Uplink() bool {
+	switch p.MType {
+	case MTypeJoinRequest, MTypeUnconfirmedDataUp, MTypeConfirmedDataUp, MTypeRejoinRequest:
+		return true
+	}
+	return false
+}
+
+func (p *PHYPayload) mhdr() uint8 {
+	return p.MType<<5 | p.Major&0x03
+}
+
+// SetMIC computes the MIC of a join request, a rejoin request or a
+// LoRaWAN 1.0 join accept, before EncryptJoinAccept. key is the NwkKey
+// (AppKey for LoRaWAN 1.0), type 0 and 2 rejoin requests use SNwkSIntKey
+// and type 1 ones JSIntKey.
+func (p *PHYPayload) SetMIC(key [16]uint8) error {
+	mic, err := p.joinMIC(key, nil)
+	if err != nil {
+		return err
+	}
+	p.MIC = mic
+	return nil
+}
+
+// ValidateMIC checks the MIC of a join request, a rejoin request or a
+// LoRaWAN 1.0 join accept, after DecryptJoinAccept, see SetMIC
+func (p *PHYPayload) ValidateMIC(key [16]uint8) (bool, error) {
+	mic, err := p.joinMIC(key, nil)
+	return mic == p.MIC, err
+}
+
+// SetJoinAcceptMIC11 computes the MIC of a join accept answering a
+// LoRaWAN 1.1 device (OptNeg set) with JSIntKey. joinReqType is 0xFF for
+// a join request, or the type of the rejoin request.
+func (p *PHYPayload) SetJoinAcceptMIC11(jsIntKey [16]uint8, joinReqType uint8, joinEUI [8]uint8, devNonce uint16) error {
+	mic, err := p.joinMIC(jsIntKey, joinAcceptMIC11Header(joinReqType, joinEUI, devNonce))
+	if err != nil {
+		return err
+	}
+	p.MIC = mic
+	return nil
+}
+
+// ValidateJoinAcceptMIC11 checks the MIC of a join accept received by a
+// LoRaWAN 1.1 device, see SetJoinAcceptMIC11
+func (p *PHYPayload) ValidateJoinAcceptMIC11(jsIntKey [16]uint8, joinReqType uint8, joinEUI [8]uint8, devNonce uint16) (bool, error) {
+	mic, err := p.joinMIC(jsIntKey, joinAcceptMIC11Header(joinReqType, joinEUI, devNonce))
+	return mic == p.MIC, err
+}
+
+// joinMIC computes the MIC of the join messages over header | MHDR | MACPayload
+func (p *PHYPayload) joinMIC(key [16]uint8, header []uint8) ([4]uint8, error) {
+	switch p.MACPayload.(type) {
+	case *JoinRequest, *JoinAccept, *RejoinRequest:
+	default:
+		return [4]uint8{}, ErrInvalidMessageType
+	}
+	b, err := p.MACPayload.MarshalBinary()
+	if err != nil {
+		return [4]uint8{}, err
+	}
+	msg := append(append(header, p.mhdr()), b...)
+	return genPayloadMIC(msg, key), nil
+}
+
+// joinAcceptMIC11Header returns the fields prepended to a LoRaWAN 1.1 join
+// accept for its MIC: JoinReqType | JoinEUI | DevNonce
+func joinAcceptMIC11Header(joinReqType uint8, joinEUI [8]uint8, devNonce uint16) []uint8 {
+	b := []uint8{joinReqType}
+	b = append(b, reverseBytes(joinEUI[:])...)
+	return binary.LittleEndian.AppendUint16(b, devNonce)
+}
+
+// SetDataMIC computes the MIC of a LoRaWAN 1.0 data message with NwkSKey,
+// or of a LoRaWAN 1.1 downlink with SNwkSIntKey. confFCnt is the frame
+// counter of the confirmed uplink acknowledged by a LoRaWAN 1.1 downlink,
+// 0 otherwise. FHDR.FCnt must hold the 32 bits frame counter.
+func (p *PHYPayload) SetDataMIC(key [16]uint8, confFCnt uint16) error {
+	mic, err := p.dataMIC(key, key, confFCnt, 0, 0, false)
+	if err != nil {
+		return err
+	}
+	p.MIC = mic
+	return nil
+}
+
+// ValidateDataMIC checks the MIC of a LoRaWAN 1.0 data message or of a
+// LoRaWAN 1.1 downlink, see SetDataMIC
+func (p *PHYPayload) ValidateDataMIC(key [16]uint8, confFCnt uint16) (bool, error) {
+	mic, err := p.dataMIC(key, key, confFCnt, 0, 0, false)
+	return mic == p.MIC, err
+}
+
+// SetUplinkDataMIC11 computes the MIC of a LoRaWAN 1.1 uplink, sent at data
+// rate txDR on the channel index txCh. confFCnt is the frame counter of the
+// confirmed downlink acknowledged, 0 otherwise. FHDR.FCnt must hold the
+// 32 bits frame counter.
+func (p *PHYPayload) SetUplinkDataMIC11(fNwkSIntKey [16]uint8, sNwkSIntKey [16]uint8, confFCnt uint16, txDR uint8, txCh uint8) error {
+	mic, err := p.dataMIC(fNwkSIntKey, sNwkSIntKey, confFCnt, txDR, txCh, true)
+	if err != nil {
+		return err
+	}
+	p.MIC = mic
+	return nil
+}
+
+// ValidateUplinkDataMIC11 checks the MIC of a LoRaWAN 1.1 uplink, see
+// SetUplinkDataMIC11
+func (p *PHYPayload) ValidateUplinkDataMIC11(fNwkSIntKey [16]uint8, sNwkSIntKey [16]uint8, confFCnt uint16, txDR uint8, txCh uint8) (bool, error) {
+	mic, err := p.dataMIC(fNwkSIntKey, sNwkSIntKey, confFCnt, txDR, txCh, true)
+	return mic == p.MIC, err
+}
+
+func (p *PHYPayload) dataMIC(fKey [16]uint8, sKey [16]uint8, confFCnt uint16, txDR uint8, txCh uint8, v11 bool) ([4]uint8, error) {
+	mac, ok := p.MACPayload.(*MACPayload)
+	if !ok {
+		return [4]uint8{}, ErrInvalidMessageType
+	}
+	b, err := mac.MarshalBinary()
+	if err != nil {
+		return [4]uint8{}, err
+	}
+	msg := append([]uint8{p.mhdr()}, b...)
+	fhdr := &mac.FHDR
+	if v11 {
+		return calcUplinkMIC11(msg, fKey, sKey, confFCnt, txDR, txCh, fhdr.DevAddr[:], fhdr.FCnt, uint8(len(msg))), nil
+	}
+	return calcMessageMIC11(msg, fKey, confFCnt, p.dir(), fhdr.DevAddr[:], fhdr.FCnt, uint8(len(msg))), nil
+}
+
+// dir is the direction of the frame in the encryption and MIC blocks
+func (p *PHYPayload) dir() uint8 {
+	if p.Uplink() {
+		return 0
+	}
+	return 1
+}
+
+// EncryptFOpts encrypts FOpts with NwkSEncKey, LoRaWAN 1.1 only: LoRaWAN
+// 1.0 FOpts are sent in clear. FHDR.FCnt must hold the 32 bits frame
+// counter.
+func (p *PHYPayload) EncryptFOpts(key [16]uint8) error {
+	mac, ok := p.MACPayload.(*MACPayload)
+	if !ok {
+		return ErrInvalidMessageType
+	}
+	fOpts, err := cryptPayload(key, p.dir(), mac.FHDR.DevAddr, mac.FHDR.FCnt, mac.FHDR.FOpts, true)
+	if err != nil {
+		return err
+	}
+	mac.FHDR.FOpts = fOpts
+	return nil
+}
+
+// DecryptFOpts decrypts FOpts, see EncryptFOpts
+func (p *PHYPayload) DecryptFOpts(key [16]uint8) error {
+	return p.EncryptFOpts(key)
+}
+
+// EncryptFRMPayload encrypts FRMPayload with AppSKey, or with NwkSEncKey
+// (NwkSKey for LoRaWAN 1.0) on FPort 0. FHDR.FCnt must hold the 32 bits
+// frame counter.
+func (p *PHYPayload) EncryptFRMPayload(key [16]uint8) error {
+	mac, ok := p.MACPayload.(*MACPayload)
+	if !ok {
+		return ErrInvalidMessageType
+	}
+	data, err := cryptPayload(key, p.dir(), mac.FHDR.DevAddr, mac.FHDR.FCnt, mac.FRMPayload, false)
+	if err != nil {
+		return err
+	}
+	mac.FRMPayload = data
+	return nil
+}
+
+// DecryptFRMPayload decrypts FRMPayload, see EncryptFRMPayload
+func (p *PHYPayload) DecryptFRMPayload(key [16]uint8) error {
+	return p.EncryptFRMPayload(key)
+}
+
+// EncryptJoinAccept encrypts a join accept and its MIC with the NwkKey
+// (AppKey for LoRaWAN 1.0), as the join server does: MACPayload becomes a
+// *DataPayload
+func (p *PHYPayload) EncryptJoinAccept(key [16]uint8) error {
+	ja, ok := p.MACPayload.(*JoinAccept)
+	if p.MType != MTypeJoinAccept || !ok {
+		return ErrInvalidMessageType
+	}
+	b, err := ja.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	b = append(b, p.MIC[:]...)
+
+	// The join server uses the AES decrypt operation, so that the device
+	// only needs the encrypt one
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	for k := 0; k < len(b); k += aes.BlockSize {
+		block.Decrypt(b[k:], b[k:])
+	}
+	p.MACPayload = &DataPayload{Bytes: b[:len(b)-4]}
+	copy(p.MIC[:], b[len(b)-4:])
+	return nil
+}
+
+// DecryptJoinAccept decrypts a received join accept and its MIC with the
+// NwkKey (AppKey for LoRaWAN 1.0): MACPayload becomes a *JoinAccept
+func (p *PHYPayload) DecryptJoinAccept(key [16]uint8) error {
+	data, ok := p.MACPayload.(*DataPayload)
+	if p.MType != MTypeJoinAccept || !ok {
+		return ErrInvalidMessageType
+	}
+	b := append(append([]uint8{}, data.Bytes...), p.MIC[:]...)
+	if len(b)%aes.BlockSize != 0 {
+		return ErrInvalidPacketLength
+	}
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	for k := 0; k < len(b); k += aes.BlockSize {
+		block.Encrypt(b[k:], b[k:])
+	}
+	ja := &JoinAccept{}
+	if err := ja.UnmarshalBinary(b[:len(b)-4]); err != nil {
+		return err
+	}
+	p.MACPayload = ja
+	copy(p.MIC[:], b[len(b)-4:])
+	return nil
+}
+
+// cryptPayload encrypts or decrypts FOpts or FRMPayload with AES in
+// counter mode
+func cryptPayload(key [16]uint8, dir uint8, devAddr [4]uint8, fCnt uint32, payload []byte, isFOpts bool) ([]byte, error) {
+	k := len(payload) / aes.BlockSize
+	if len(payload)%aes.BlockSize != 0 {
+		k++
+	}
+	if k > math.MaxUint8 {
+		return nil, ErrFrmPayloadTooLarge
+	}
+	encrypted := make([]byte, 0, k*16)
+	cipher, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	var a [aes.BlockSize]byte
+	a[0] = 0x01
+	a[5] = dir
+	copy(a[6:10], devAddr[:])
+	binary.LittleEndian.PutUint32(a[10:14], fCnt)
+	var ss [aes.BlockSize]byte
+	var b [aes.BlockSize]byte
+	for i := uint8(0); i < uint8(k); i++ {
+		copy(b[:], payload[i*aes.BlockSize:])
+		if !isFOpts {
+			a[15] = i + 1
+		}
+		cipher.Encrypt(ss[:], a[:])
+		for j := 0; j < aes.BlockSize; j++ {
+			b[j] = b[j] ^ ss[j]
+		}
+		encrypted = append(encrypted, b[:]...)
+	}
+	return encrypted[:len(payload)], nil
+}
+
+// MarshalBinary encodes the join request
+func (j *JoinRequest) MarshalBinary() ([]byte, error) {
+	b := make([]uint8, 0, 18)
+	b = append(b, reverseBytes(j.JoinEUI[:])...)
+	b = append(b, reverseBytes(j.DevEUI[:])...)
+	return binary.LittleEndian.AppendUint16(b, j.DevNonce), nil
+}
+
+// UnmarshalBinary decodes a join request
+func (j *JoinRequest) UnmarshalBinary(b []byte) error {
+	if len(b) != 18 {
+		return ErrInvalidPacketLength
+	}
+	copy(j.JoinEUI[:], reverseBytes(b[0:8]))
+	copy(j.DevEUI[:], reverseBytes(b[8:16]))
+	j.DevNonce = binary.LittleEndian.Uint16(b[16:18])
+	return nil
+}
+
+// MarshalBinary encodes the join accept, before its encryption
+func (j *JoinAccept) MarshalBinary() ([]byte, error) {
+	if len(j.CFList) != 0 && len(j.CFList) != 16 {
+		return nil, ErrInvalidPacketLength
+	}
+	b := make([]uint8, 0, 28)
+	b = append(b, uint8(j.JoinNonce), uint8(j.JoinNonce>>8), uint8(j.JoinNonce>>16))
+	b = append(b, j.NetID[:]...)
+	b = append(b, j.DevAddr[:]...)
+	b = append(b, j.DLSettings, j.RXDelay)
+	return append(b, j.CFList...), nil
+}
+
+// UnmarshalBinary decodes a decrypted join accept
+func (j *JoinAccept) UnmarshalBinary(b []byte) error {
+	if len(b) != 12 && len(b) != 28 {
+		return ErrInvalidPacketLength
+	}
+	j.JoinNonce = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	copy(j.NetID[:], b[3:6])
+	copy(j.DevAddr[:], b[6:10])
+	j.DLSettings = b[10]
+	j.RXDelay = b[11]
+	j.CFList = nil
+	if len(b) == 28 {
+		j.CFList = append([]uint8{}, b[12:28]...)
+	}
+	return nil
+}
+
+// MarshalBinary encodes the rejoin request
+func (r *RejoinRequest) MarshalBinary() ([]byte, error) {
+	b := make([]uint8, 0, 19)
+	b = append(b, r.RejoinType)
+	switch r.RejoinType {
+	case 0, 2:
+		b = append(b, r.NetID[:]...)
+	case 1:
+		b = append(b, reverseBytes(r.JoinEUI[:])...)
+	default:
+		return nil, ErrInvalidMessageType
+	}
+	b = append(b, reverseBytes(r.DevEUI[:])...)
+	return binary.LittleEndian.AppendUint16(b, r.RJcount), nil
+}
+
+// UnmarshalBinary decodes a rejoin request
+func (r *RejoinRequest) UnmarshalBinary(b []byte) error {
+	if len(b) < 1 {
+		return ErrInvalidPacketLength
+	}
+	r.RejoinType = b[0]
+	switch r.RejoinType {
+	case 0, 2:
+		if len(b) != 14 {
+			return ErrInvalidPacketLength
+		}
+		copy(r.NetID[:], b[1:4])
+		b = b[4:]
+	case 1:
+		if len(b) != 19 {
+			return ErrInvalidPacketLength
+		}
+		copy(r.JoinEUI[:], reverseBytes(b[1:9]))
+		b = b[9:]
+	default:
+		return ErrInvalidMessageType
+	}
+	copy(r.DevEUI[:], reverseBytes(b[0:8]))
+	r.RJcount = binary.LittleEndian.Uint16(b[8:10])
+	return nil
+}
+
+// marshal encodes the frame control byte, with the FOpts length
+func (c FCtrl) marshal(fOptsLen int) uint8 {
+	b := uint8(fOptsLen) & fCtrlFOptsLen
+	if c.ADR {
+		b |= fCtrlUpADR
+	}
+	if c.ADRACKReq {
+		b |= fCtrlUpADRACKReq
+	}
+	if c.ACK {
+		b |= fCtrlUpACK
+	}
+	if c.FPending {
+		b |= fCtrlDownFPending
+	}
+	return b
+}
+
+func (c *FCtrl) unmarshal(b uint8) {
+	c.ADR = b&fCtrlUpADR != 0
+	c.ADRACKReq = b&fCtrlUpADRACKReq != 0
+	c.ACK = b&fCtrlUpACK != 0
+	c.FPending = b&fCtrlDownFPending != 0
+}
+
+// MarshalBinary encodes the MACPayload of a data message
+func (m *MACPayload) MarshalBinary() ([]byte, error) {
+	if len(m.FHDR.FOpts) > FOptsMaxLen {
+		return nil, ErrFOptsTooLarge
+	}
+	if m.FPort == nil && len(m.FRMPayload) > 0 {
+		return nil, ErrInvalidFPort
+	}
+
+	b := make([]uint8, 0, 8+len(m.FHDR.FOpts)+len(m.FRMPayload))
+	b = append(b, m.FHDR.DevAddr[:]...)
+	b = append(b, m.FHDR.FCtrl.marshal(len(m.FHDR.FOpts)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(m.FHDR.FCnt))
+	b = append(b, m.FHDR.FOpts...)
+	if m.FPort != nil {
+		b = append(b, *m.FPort)
+		b = append(b, m.FRMPayload...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes the MACPayload of a data message, FHDR.FCnt
+// only gets the 16 bits transmitted
+func (m *MACPayload) UnmarshalBinary(b []byte) error {
+	// DevAddr(4) + FCtrl(1) + FCnt(2)
+	if len(b) < 7 {
+		return ErrInvalidPacketLength
+	}
+	copy(m.FHDR.DevAddr[:], b[0:4])
+	m.FHDR.FCtrl.unmarshal(b[4])
+	m.FHDR.FCnt = uint32(binary.LittleEndian.Uint16(b[5:7]))
+
+	fOptsLen := int(b[4] & fCtrlFOptsLen)
+	if len(b) < 7+fOptsLen {
+		return ErrInvalidPacketLength
+	}
+	m.FHDR.FOpts = append([]uint8{}, b[7:7+fOptsLen]...)
+
+	m.FPort = nil
+	m.FRMPayload = nil
+	if frm := b[7+fOptsLen:]; len(frm) > 0 {
+		fPort := frm[0]
+		m.FPort = &fPort
+		m.FRMPayload = append([]uint8{}, frm[1:]...)
+	}
+	return nil
+}
+
+// MarshalBinary returns the raw bytes
+func (d *DataPayload) MarshalBinary() ([]byte, error) {
+	return append([]uint8{}, d.Bytes...), nil
+}
+
+// UnmarshalBinary keeps a copy of b
+func (d *DataPayload) UnmarshalBinary(b []byte) error {
+	d.Bytes = append([]uint8{}, b...)
+	return nil
+}
@@ -0,0 +1,365 @@
+package lorawan
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPHYPayloadRoundTrip(t *testing.T) {
+	fPort := uint8(10)
+	fPort0 := uint8(0)
+	tests := []struct {
+		name string
+		p    *PHYPayload
+		len  int
+	}{
+		{"join request", &PHYPayload{
+			MType: MTypeJoinRequest,
+			MACPayload: &JoinRequest{
+				JoinEUI:  [8]uint8{0x70, 0xB3, 0xD5, 0x7E, 0xD0, 0x00, 0x00, 0x01},
+				DevEUI:   [8]uint8{0x00, 0x04, 0xA3, 0x0B, 0x00, 0x1C, 0x05, 0x30},
+				DevNonce: 0x1234,
+			},
+			MIC: [4]uint8{1, 2, 3, 4},
+		}, 23},
+		{"rejoin request type 0", &PHYPayload{
+			MType: MTypeRejoinRequest,
+			MACPayload: &RejoinRequest{
+				RejoinType: 0,
+				NetID:      [3]uint8{0x13, 0x00, 0x00},
+				DevEUI:     [8]uint8{0x00, 0x04, 0xA3, 0x0B, 0x00, 0x1C, 0x05, 0x30},
+				RJcount:    7,
+			},
+			MIC: [4]uint8{1, 2, 3, 4},
+		}, 19},
+		{"rejoin request type 1", &PHYPayload{
+			MType: MTypeRejoinRequest,
+			MACPayload: &RejoinRequest{
+				RejoinType: 1,
+				JoinEUI:    [8]uint8{0x70, 0xB3, 0xD5, 0x7E, 0xD0, 0x00, 0x00, 0x01},
+				DevEUI:     [8]uint8{0x00, 0x04, 0xA3, 0x0B, 0x00, 0x1C, 0x05, 0x30},
+				RJcount:    7,
+			},
+			MIC: [4]uint8{1, 2, 3, 4},
+		}, 24},
+		{"confirmed data up", &PHYPayload{
+			MType: MTypeConfirmedDataUp,
+			MACPayload: &MACPayload{
+				FHDR: FHDR{
+					DevAddr: [4]uint8{0xDE, 0xAD, 0xBE, 0xEF},
+					FCtrl:   FCtrl{ADR: true, ADRACKReq: true, ACK: true, FPending: true},
+					FCnt:    0x0102,
+					FOpts:   []uint8{0x02},
+				},
+				FPort:      &fPort,
+				FRMPayload: []uint8("hello"),
+			},
+			MIC: [4]uint8{1, 2, 3, 4},
+		}, 19},
+		{"unconfirmed data down without FPort", &PHYPayload{
+			MType: MTypeUnconfirmedDataDown,
+			MACPayload: &MACPayload{
+				FHDR: FHDR{
+					DevAddr: [4]uint8{0xDE, 0xAD, 0xBE, 0xEF},
+					FCnt:    3,
+					FOpts:   []uint8{},
+				},
+			},
+			MIC: [4]uint8{1, 2, 3, 4},
+		}, 12},
+		{"MAC commands on FPort 0", &PHYPayload{
+			MType: MTypeUnconfirmedDataDown,
+			MACPayload: &MACPayload{
+				FHDR: FHDR{
+					DevAddr: [4]uint8{0xDE, 0xAD, 0xBE, 0xEF},
+					FOpts:   []uint8{},
+				},
+				FPort:      &fPort0,
+				FRMPayload: []uint8{0x02, 0x05, 0x01},
+			},
+			MIC: [4]uint8{1, 2, 3, 4},
+		}, 16},
+		{"proprietary", &PHYPayload{
+			MType:      MTypeProprietary,
+			MACPayload: &DataPayload{Bytes: []uint8{0xCA, 0xFE}},
+		}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.p.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() error = %v", err)
+			}
+			if len(b) != tt.len {
+				t.Fatalf("MarshalBinary() = % X, want %d bytes", b, tt.len)
+			}
+			got := &PHYPayload{}
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatalf("UnmarshalBinary() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.p) {
+				t.Errorf("UnmarshalBinary() = %+v, want %+v", got, tt.p)
+			}
+		})
+	}
+}
+
+func TestPHYPayloadJoinRequestMatchesOtaa(t *testing.T) {
+	o := testOtaa()
+	phy, err := o.GenerateJoinRequest()
+	if err != nil {
+		t.Fatalf("GenerateJoinRequest() error = %v", err)
+	}
+
+	p := &PHYPayload{}
+	if err := p.UnmarshalBinary(phy); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	jr, ok := p.MACPayload.(*JoinRequest)
+	if !ok || jr.JoinEUI != o.AppEUI || jr.DevEUI != o.DevEUI {
+		t.Fatalf("MACPayload = %+v, want the EUIs of the device", p.MACPayload)
+	}
+	if ok, err := p.ValidateMIC(o.AppKey); err != nil || !ok {
+		t.Errorf("ValidateMIC() = %v, %v, want true", ok, err)
+	}
+	if ok, _ := p.ValidateMIC([16]uint8{}); ok {
+		t.Error("ValidateMIC() with another key = true")
+	}
+}
+
+func TestPHYPayloadJoinAccept(t *testing.T) {
+	key := [16]uint8{0x2B, 0x7E, 0x15, 0x16, 0x28, 0xAE, 0xD2, 0xA6, 0xAB, 0xF7, 0x15, 0x88, 0x09, 0xCF, 0x4F, 0x3C}
+	cfList := []uint8{0x18, 0x4F, 0x84, 0xE8, 0x56, 0x84, 0xB8, 0x5E, 0x84, 0x88, 0x66, 0x84, 0x58, 0x6E, 0x84, 0x00}
+	msg := append(joinAcceptMsg(0x05, 0x00), cfList...)
+
+	ja := &JoinAccept{}
+	if err := ja.UnmarshalBinary(msg); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if ja.JoinNonce != 5 || ja.DevAddr != [4]uint8{0x04, 0x03, 0x02, 0x01} || ja.RXDelay != 1 || !bytes.Equal(ja.CFList, cfList) {
+		t.Fatalf("UnmarshalBinary() = %+v", ja)
+	}
+
+	p := &PHYPayload{MType: MTypeJoinAccept, MACPayload: ja}
+	if err := p.SetMIC(key); err != nil {
+		t.Fatalf("SetMIC() error = %v", err)
+	}
+	if err := p.EncryptJoinAccept(key); err != nil {
+		t.Fatalf("EncryptJoinAccept() error = %v", err)
+	}
+	phy, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+	if want := genTestJoinAccept(key, key, nil, msg); !bytes.Equal(phy, want) {
+		t.Fatalf("MarshalBinary() = % X, want % X", phy, want)
+	}
+
+	got := &PHYPayload{}
+	if err := got.UnmarshalBinary(phy); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if err := got.DecryptJoinAccept(key); err != nil {
+		t.Fatalf("DecryptJoinAccept() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.MACPayload, ja) {
+		t.Errorf("DecryptJoinAccept() = %+v, want %+v", got.MACPayload, ja)
+	}
+	if ok, err := got.ValidateMIC(key); err != nil || !ok {
+		t.Errorf("ValidateMIC() = %v, %v, want true", ok, err)
+	}
+}
+
+func TestPHYPayloadJoinAcceptMIC11(t *testing.T) {
+	key := [16]uint8{0x2B, 0x7E, 0x15, 0x16, 0x28, 0xAE, 0xD2, 0xA6, 0xAB, 0xF7, 0x15, 0x88, 0x09, 0xCF, 0x4F, 0x3C}
+	jsIntKey := [16]uint8{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10}
+	joinEUI := [8]uint8{0x70, 0xB3, 0xD5, 0x7E, 0xD0, 0x00, 0x00, 0x01}
+	msg := joinAcceptMsg(0x05, 0x80)
+
+	header := append([]uint8{0xFF}, reverseBytes(joinEUI[:])...)
+	header = append(header, 0x34, 0x12)
+	phy := genTestJoinAccept(key, jsIntKey, header, msg)
+
+	p := &PHYPayload{}
+	if err := p.UnmarshalBinary(phy); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if err := p.DecryptJoinAccept(key); err != nil {
+		t.Fatalf("DecryptJoinAccept() error = %v", err)
+	}
+	if ok, err := p.ValidateJoinAcceptMIC11(jsIntKey, 0xFF, joinEUI, 0x1234); err != nil || !ok {
+		t.Errorf("ValidateJoinAcceptMIC11() = %v, %v, want true", ok, err)
+	}
+	if ok, _ := p.ValidateJoinAcceptMIC11(jsIntKey, 0xFF, joinEUI, 0x1235); ok {
+		t.Error("ValidateJoinAcceptMIC11() with another DevNonce = true")
+	}
+	if ok, _ := p.ValidateMIC(jsIntKey); ok {
+		t.Error("ValidateMIC() of a LoRaWAN 1.1 join accept = true")
+	}
+}
+
+func TestPHYPayloadUplink(t *testing.T) {
+	s := testDownlinkSession()
+	s.FCntUp = 0x10002
+	phy, err := s.GenUplink(&Uplink{FOpts: []uint8{0x02}, FPort: 5, Payload: []uint8("hello")})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+
+	p := &PHYPayload{}
+	if err := p.UnmarshalBinary(phy); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if !p.Uplink() {
+		t.Error("Uplink() = false")
+	}
+	mac := p.MACPayload.(*MACPayload)
+	if mac.FHDR.FCnt != 2 {
+		t.Fatalf("FCnt = %d, want the 16 bits transmitted 2", mac.FHDR.FCnt)
+	}
+	mac.FHDR.FCnt = 0x10002
+	if ok, err := p.ValidateDataMIC(s.NwkSKey, 0); err != nil || !ok {
+		t.Errorf("ValidateDataMIC() = %v, %v, want true", ok, err)
+	}
+	// LoRaWAN 1.0 FOpts are in clear
+	if !bytes.Equal(mac.FHDR.FOpts, []uint8{0x02}) {
+		t.Errorf("FOpts = % X, want 02", mac.FHDR.FOpts)
+	}
+	if err := p.DecryptFRMPayload(s.AppSKey); err != nil || string(mac.FRMPayload) != "hello" {
+		t.Errorf("DecryptFRMPayload() = %q, %v, want hello", mac.FRMPayload, err)
+	}
+}
+
+func TestPHYPayloadUplink11(t *testing.T) {
+	s := testSession11()
+	phy, err := s.GenUplink(&Uplink{FPort: 1, Payload: []uint8{0x01}, DataRate: 5, Channel: 2})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+
+	p := &PHYPayload{}
+	if err := p.UnmarshalBinary(phy); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if ok, err := p.ValidateUplinkDataMIC11(s.FNwkSIntKey, s.SNwkSIntKey, 0, 5, 2); err != nil || !ok {
+		t.Errorf("ValidateUplinkDataMIC11() = %v, %v, want true", ok, err)
+	}
+	if ok, _ := p.ValidateUplinkDataMIC11(s.FNwkSIntKey, s.SNwkSIntKey, 0, 5, 3); ok {
+		t.Error("ValidateUplinkDataMIC11() on another channel = true")
+	}
+}
+
+func TestPHYPayloadDownlink(t *testing.T) {
+	s := testDownlinkSession()
+	phy := genTestDownlink(s, MTypeConfirmedDataDown, fCtrlDownACK, []uint8{0x02}, 4, 2, []uint8("on"))
+
+	p := &PHYPayload{}
+	if err := p.UnmarshalBinary(phy); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if p.Uplink() {
+		t.Error("Uplink() = true")
+	}
+	mac := p.MACPayload.(*MACPayload)
+	if !mac.FHDR.FCtrl.ACK || mac.FPort == nil || *mac.FPort != 2 {
+		t.Fatalf("MACPayload = %+v, want ACK on FPort 2", mac)
+	}
+	if ok, err := p.ValidateDataMIC(s.NwkSKey, 0); err != nil || !ok {
+		t.Errorf("ValidateDataMIC() = %v, %v, want true", ok, err)
+	}
+	if err := p.DecryptFRMPayload(s.AppSKey); err != nil || string(mac.FRMPayload) != "on" {
+		t.Errorf("DecryptFRMPayload() = %q, %v, want on", mac.FRMPayload, err)
+	}
+
+	// Marshaling the decrypted frame does not encrypt it again
+	if err := p.EncryptFRMPayload(s.AppSKey); err != nil {
+		t.Fatalf("EncryptFRMPayload() error = %v", err)
+	}
+	if b, _ := p.MarshalBinary(); !bytes.Equal(b, phy) {
+		t.Errorf("MarshalBinary() = % X, want % X", b, phy)
+	}
+}
+
+func TestGenMessageDownlinkDecodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		session *Session
+	}{
+		{"LoRaWAN 1.0", testDownlinkSession()},
+		{"LoRaWAN 1.1", testSession11()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.session
+			s.AFCntDown = 5
+			s.NFCntDown = 9
+			phy, err := s.GenMessage(1, []uint8("on"))
+			if err != nil {
+				t.Fatalf("GenMessage() error = %v", err)
+			}
+			dl, err := s.DecodeDownlink(phy)
+			if err != nil {
+				t.Fatalf("DecodeDownlink() error = %v", err)
+			}
+			if dl.FPort != 1 || string(dl.Payload) != "on" {
+				t.Errorf("DecodeDownlink() = %+v, want payload on on FPort 1", dl)
+			}
+		})
+	}
+}
+
+func TestGenMessageDownlinkACK11(t *testing.T) {
+	// The ACK of a confirmed uplink is signed with its counter
+	s := testSession11()
+	s.FCntUp = 3
+	if _, err := s.GenConfirmedMessage([]uint8("up")); err != nil {
+		t.Fatalf("GenConfirmedMessage() error = %v", err)
+	}
+	phy, err := s.genMessage(1, &Uplink{ACK: true})
+	if err != nil {
+		t.Fatalf("genMessage() error = %v", err)
+	}
+	dl, err := s.DecodeDownlink(phy)
+	if err != nil {
+		t.Fatalf("DecodeDownlink() error = %v", err)
+	}
+	if !dl.ACK || s.NFCntDown != 1 {
+		t.Errorf("DecodeDownlink() ACK = %v, NFCntDown = %d, want ACK counted on NFCntDown", dl.ACK, s.NFCntDown)
+	}
+}
+
+func TestPHYPayloadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		phy  []uint8
+		err  error
+	}{
+		{"empty", nil, ErrInvalidPacketLength},
+		{"no MIC", []uint8{MTypeUnconfirmedDataUp << 5, 0x01, 0x02}, ErrInvalidPacketLength},
+		{"short join request", append([]uint8{MTypeJoinRequest << 5}, make([]uint8, 20)...), ErrInvalidPacketLength},
+		{"short join accept", append([]uint8{MTypeJoinAccept << 5}, make([]uint8, 15)...), ErrInvalidPacketLength},
+		{"short data frame", append([]uint8{MTypeUnconfirmedDataDown << 5}, make([]uint8, 10)...), ErrInvalidPacketLength},
+		{"FOpts beyond the frame", []uint8{MTypeUnconfirmedDataDown << 5, 1, 2, 3, 4, 0x0F, 0, 0, 1, 2, 3, 4}, ErrInvalidPacketLength},
+		{"rejoin request type 3", append([]uint8{MTypeRejoinRequest << 5, 3}, make([]uint8, 17)...), ErrInvalidMessageType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&PHYPayload{}).UnmarshalBinary(tt.phy); err != tt.err {
+				t.Errorf("UnmarshalBinary() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	p := &PHYPayload{MType: MTypeUnconfirmedDataUp, MACPayload: &MACPayload{FHDR: FHDR{FOpts: make([]uint8, 16)}}}
+	if _, err := p.MarshalBinary(); err != ErrFOptsTooLarge {
+		t.Errorf("MarshalBinary() error = %v, want %v", err, ErrFOptsTooLarge)
+	}
+	if err := p.SetMIC([16]uint8{}); err != ErrInvalidMessageType {
+		t.Errorf("SetMIC() of a data message error = %v, want %v", err, ErrInvalidMessageType)
+	}
+	if err := p.DecryptJoinAccept([16]uint8{}); err != ErrInvalidMessageType {
+		t.Errorf("DecryptJoinAccept() of a data message error = %v, want %v", err, ErrInvalidMessageType)
+	}
+}
@@ -0,0 +1,215 @@
+package region
+
+import (
+	"errors"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+const (
+	AS923_DEFAULT_PREAMBLE_LEN = 8
+	AS923_DEFAULT_TX_POWER_DBM = 16
+	AS923_MAX_EIRP_DBM         = 16
+	AS923_MAX_CHANNELS         = 16
+)
+
+// dataRatesAS923 is the AS923 data rate table without dwell time limit, DR7
+// (FSK) is not supported
+var dataRatesAS923 = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, true, 115},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_250_0, true, true, 242},
+}
+
+// dataRatesAS923Dwell is the AS923 data rate table when uplinks are limited
+// to a 400 ms dwell time, DR0 and DR1 cannot be used for uplinks
+var dataRatesAS923Dwell = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, false, true, 0},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, false, true, 0},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, true, 11},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, true, 53},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, true, 125},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_250_0, true, true, 242},
+}
+
+// rx1DataRatesAS923 is the RX1 data rate by uplink data rate and RX1DROffset,
+// offsets 6 and 7 raise the data rate
+var rx1DataRatesAS923 = [][]uint8{
+	{0, 0, 0, 0, 0, 0, 1, 2},
+	{1, 0, 0, 0, 0, 0, 2, 3},
+	{2, 1, 0, 0, 0, 0, 3, 4},
+	{3, 2, 1, 0, 0, 0, 4, 5},
+	{4, 3, 2, 1, 0, 0, 5, 5},
+	{5, 4, 3, 2, 1, 0, 5, 5},
+	{5, 5, 4, 3, 2, 1, 5, 5},
+}
+
+// rx1DataRatesAS923Dwell is the RX1 data rate table when downlinks are limited
+// to a 400 ms dwell time, RX1 uses DR2 or more
+var rx1DataRatesAS923Dwell = [][]uint8{
+	{2, 2, 2, 2, 2, 2, 2, 2},
+	{2, 2, 2, 2, 2, 2, 2, 3},
+	{2, 2, 2, 2, 2, 2, 3, 4},
+	{3, 2, 2, 2, 2, 2, 4, 5},
+	{4, 3, 2, 2, 2, 2, 5, 5},
+	{5, 4, 3, 2, 2, 2, 5, 5},
+	{5, 5, 4, 3, 2, 2, 5, 5},
+}
+
+// as923Group is the frequency plan of an AS923 group
+type as923Group struct {
+	channel1     uint32
+	channel2     uint32
+	minFrequency uint32
+	maxFrequency uint32
+}
+
+// as923Groups are the AS923-1 to AS923-4 plans, which only differ by a
+// frequency offset and the band allowed
+var as923Groups = [...]as923Group{
+	{lora.MHz_923_2, lora.MHz_923_4, 915000000, 928000000},
+	{lora.MHz_921_4, lora.MHz_921_6, 920000000, 923000000},
+	{lora.MHz_916_6, lora.MHz_916_8, 915000000, 921000000},
+	{lora.MHz_917_3, lora.MHz_917_5, 917000000, 920000000},
+}
+
+// ChannelAS is a AS923 channel, Next moves it to another channel of the plan
+type ChannelAS struct {
+	channel
+	next func(c *channel) bool
+}
+
+func (c *ChannelAS) Next() bool {
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
+}
+
+type SettingsAS923 struct {
+	settings
+	listenBeforeTalk
+	join              joinDynamic
+	uplinkDwellTime   bool
+	downlinkDwellTime bool
+}
+
+// JoinRequestChannel returns the channel of the next join request, one of
+// the two default channels picked at random. Next returns false once both
+// were tried.
+func (r *SettingsAS923) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
+}
+
+// JoinAcceptChannel returns the RX1 channel of the last join request, on the
+// same frequency and data rate
+func (r *SettingsAS923) JoinAcceptChannel() Channel {
+	return copyChannel(r.joinRequestChannel)
+}
+
+// DwellTime reports if uplinks and downlinks are limited to a 400 ms dwell time
+func (r *SettingsAS923) DwellTime() (uplink bool, downlink bool) {
+	return r.uplinkDwellTime, r.downlinkDwellTime
+}
+
+// SetDwellTime changes the dwell time limits, as requested by TxParamSetupReq.
+// With an uplink dwell time, DR0 and DR1 cannot be used for uplinks and the
+// data rate is raised to DR2 if needed. With a downlink dwell time, RX1 uses
+// DR2 or more.
+func (r *SettingsAS923) SetDwellTime(uplink bool, downlink bool) {
+	r.uplinkDwellTime = uplink
+	r.downlinkDwellTime = downlink
+	r.dataRates = dataRatesAS923
+	if uplink {
+		r.dataRates = dataRatesAS923Dwell
+	}
+	r.rx1DataRates = rx1DataRatesAS923
+	if downlink {
+		r.rx1DataRates = rx1DataRatesAS923Dwell
+	}
+	if !r.dataRates[r.dataRate].uplink {
+		r.SetDataRate(2)
+	}
+}
+
+// TxParamSetup applies the dwell time limits and maximum EIRP of a TxParamSetupReq
+func (r *SettingsAS923) TxParamSetup(uplinkDwellTime bool, downlinkDwellTime bool, maxEIRP uint8) bool {
+	r.SetDwellTime(uplinkDwellTime, downlinkDwellTime)
+	r.setMaxEIRP(maxEIRP)
+	return true
+}
+
+// ErrInvalidAS923Group is returned by AS923 for a group other than 1 to 4
+var ErrInvalidAS923Group = errors.New("invalid AS923 group")
+
+// AS923 returns the settings of AS923 group 1 to 4, ErrInvalidAS923Group
+// for any other group. The two default channels are 923.2 and 923.4 MHz in
+// group 1, the other groups shift them by -1.8, -6.6 and -5.9 MHz. The
+// network server can define up to 14 more channels with the join accept
+// CFList or NewChannelReq.
+//
+// The 400 ms dwell time limit is in effect until SetDwellTime is called.
+// Listen before talk, required in Japan, is off until SetListenBeforeTalk
+// enables it.
+func AS923(group uint8) (*SettingsAS923, error) {
+	if group < 1 || group > 4 {
+		return nil, ErrInvalidAS923Group
+	}
+	g := as923Groups[group-1]
+
+	r := &SettingsAS923{settings: settings{
+		rx2Channel: &ChannelAS{channel: channel{g.channel1,
+			lora.Bandwidth_125_0,
+			lora.SpreadingFactor10,
+			lora.CodingRate4_5,
+			AS923_DEFAULT_PREAMBLE_LEN,
+			AS923_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels: []planChannel{
+				{g.channel1, 0, 5, true},
+				{g.channel2, 0, 5, true},
+			},
+			defaultChannels:      2,
+			maxChannels:          AS923_MAX_CHANNELS,
+			minFrequency:         g.minFrequency,
+			maxFrequency:         g.maxFrequency,
+			minDownlinkFrequency: g.minFrequency,
+			maxDownlinkFrequency: g.maxFrequency,
+			dataRates:            dataRatesAS923Dwell,
+			dataRate:             2,
+			maxEIRP:              AS923_MAX_EIRP_DBM,
+			maxTxPower:           7,
+			chMaskCntl:           chMaskCntlDynamic,
+			rx1DataRates:         rx1DataRatesAS923Dwell,
+			beacon:               fixedBeacon(g.channel2, 3),
+		},
+	}}
+	r.uplinkDwellTime = true
+	r.downlinkDwellTime = true
+
+	r.joinRequestChannel = &ChannelAS{channel: channel{g.channel1,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor10,
+		lora.CodingRate4_5,
+		AS923_DEFAULT_PREAMBLE_LEN,
+		AS923_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelDynamic(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelAS{channel: channel{g.channel1,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor10,
+		lora.CodingRate4_5,
+		AS923_DEFAULT_PREAMBLE_LEN,
+		AS923_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r, nil
+}
@@ -3,45 +3,188 @@ package region
 import "tinygo.org/x/wireless/lora"
 
 const (
-	AU915_DEFAULT_PREAMBLE_LEN = 8
-	AU915_DEFAULT_TX_POWER_DBM = 20
+	AU915_DEFAULT_PREAMBLE_LEN   = 8
+	AU915_DEFAULT_TX_POWER_DBM   = 20
+	AU915_FREQUENCY_BASE_125     = 915200000 // first 125 kHz uplink channel
+	AU915_FREQUENCY_BASE_500     = 915900000 // first 500 kHz uplink channel
+	AU915_MAX_EIRP_DBM           = 30
+	AU915_MIN_FREQUENCY          = 915000000
+	AU915_MAX_FREQUENCY          = 928000000
+	AU915_MIN_DOWNLINK_FREQUENCY = 923300000
+	AU915_MAX_DOWNLINK_FREQUENCY = 927500000
 )
 
+// dataRatesAU915 is the AU915 data rate table, DR0-6 are uplink only and
+// DR8-13 downlink only
+var dataRatesAU915 = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, true, false, 51},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, true, false, 51},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, false, 51},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, false, 115},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, false, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, false, 242},
+	{lora.SpreadingFactor8, lora.Bandwidth_500_0, true, false, 242},
+	{},
+	{lora.SpreadingFactor12, lora.Bandwidth_500_0, false, true, 53},
+	{lora.SpreadingFactor11, lora.Bandwidth_500_0, false, true, 129},
+	{lora.SpreadingFactor10, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor9, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor8, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_500_0, false, true, 242},
+}
+
+// rx1DataRatesAU915 is the RX1 data rate by uplink data rate and RX1DROffset
+var rx1DataRatesAU915 = [][]uint8{
+	{8, 8, 8, 8, 8, 8},
+	{9, 8, 8, 8, 8, 8},
+	{10, 9, 8, 8, 8, 8},
+	{11, 10, 9, 8, 8, 8},
+	{12, 11, 10, 9, 8, 8},
+	{13, 12, 11, 10, 9, 8},
+	{13, 13, 12, 11, 10, 9},
+}
+
+// dataRatesAU915Dwell is the AU915 data rate table when uplinks are limited
+// to a 400 ms dwell time, DR0 and DR1 cannot be used for uplinks
+var dataRatesAU915Dwell = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, false, false, 0},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, false, false, 0},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, false, 11},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, false, 53},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, false, 125},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, false, 242},
+	{lora.SpreadingFactor8, lora.Bandwidth_500_0, true, false, 242},
+	{},
+	{lora.SpreadingFactor12, lora.Bandwidth_500_0, false, true, 53},
+	{lora.SpreadingFactor11, lora.Bandwidth_500_0, false, true, 129},
+	{lora.SpreadingFactor10, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor9, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor8, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_500_0, false, true, 242},
+}
+
+// ChannelAU is a AU915 channel, Next moves it to another channel of the plan
 type ChannelAU struct {
 	channel
+	next func(c *channel) bool
 }
 
 func (c *ChannelAU) Next() bool {
-	return false
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
 }
 
 type SettingsAU915 struct {
 	settings
+	join              joinSubBands
+	uplinkDwellTime   bool
+	downlinkDwellTime bool
+}
+
+// SetSubBand restricts the uplink channels to sub-band fsb (1 to 8): 125 kHz
+// channels 8*(fsb-1) to 8*fsb-1 and 500 kHz channel 64+fsb-1. Most gateways
+// only listen to one sub-band. fsb 0 enables all 72 channels.
+func (r *SettingsAU915) SetSubBand(fsb uint8) bool {
+	return r.setSubBand(8, fsb)
+}
+
+// JoinRequestChannel returns the channel of the next join request, a random
+// 125 kHz channel of each enabled sub-band, at DR0 or DR2 with an uplink
+// dwell time, then a 500 kHz DR6 channel. Next returns false once all of
+// them were tried.
+func (r *SettingsAU915) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
+}
+
+// JoinAcceptChannel returns the RX1 channel of the last join request
+func (r *SettingsAU915) JoinAcceptChannel() Channel {
+	return &ChannelAU{channel: rx1Channel500(r.joinRequestChannel, AU915_FREQUENCY_BASE_125, AU915_FREQUENCY_BASE_500)}
+}
+
+// RX1Channel returns the downlink channel matching the current uplink channel
+func (r *SettingsAU915) RX1Channel() Channel {
+	return &ChannelAU{channel: rx1Channel500(r.uplinkChannel, AU915_FREQUENCY_BASE_125, AU915_FREQUENCY_BASE_500)}
 }
 
+// DwellTime reports if uplinks and downlinks are limited to a 400 ms dwell time
+func (r *SettingsAU915) DwellTime() (uplink bool, downlink bool) {
+	return r.uplinkDwellTime, r.downlinkDwellTime
+}
+
+// SetDwellTime changes the dwell time limits, as requested by TxParamSetupReq.
+// With an uplink dwell time, DR0 and DR1 cannot be used for uplinks: the data
+// rate is raised to DR2 if needed and join requests use DR2. All downlinks
+// are on 500 kHz channels, the downlink dwell time has no effect.
+func (r *SettingsAU915) SetDwellTime(uplink bool, downlink bool) {
+	r.uplinkDwellTime = uplink
+	r.downlinkDwellTime = downlink
+	r.dataRates = dataRatesAU915
+	r.join.dr125 = 0
+	if uplink {
+		r.dataRates = dataRatesAU915Dwell
+		r.join.dr125 = 2
+	}
+	if !r.dataRates[r.dataRate].uplink {
+		r.SetDataRate(2)
+	}
+}
+
+// TxParamSetup applies the dwell time limits and maximum EIRP of a TxParamSetupReq
+func (r *SettingsAU915) TxParamSetup(uplinkDwellTime bool, downlinkDwellTime bool, maxEIRP uint8) bool {
+	r.SetDwellTime(uplinkDwellTime, downlinkDwellTime)
+	r.setMaxEIRP(maxEIRP)
+	return true
+}
+
+// AU915 returns the AU915 settings with all 72 channels enabled, use
+// SetSubBand to select the sub-band of the network. Uplinks hop between the
+// enabled channels supporting the data rate. There is no dwell time limit
+// until the network server sends TxParamSetupReq.
 func AU915() *SettingsAU915 {
-	return &SettingsAU915{settings: settings{
-		joinRequestChannel: &ChannelAU{channel: channel{lora.MHz_916_8,
-			lora.Bandwidth_125_0,
-			lora.SpreadingFactor9,
-			lora.CodingRate4_5,
-			AU915_DEFAULT_PREAMBLE_LEN,
-			AU915_DEFAULT_TX_POWER_DBM}},
-		joinAcceptChannel: &ChannelAU{channel: channel{lora.MHz_923_3,
+	r := &SettingsAU915{settings: settings{
+		rx2Channel: &ChannelAU{channel: channel{lora.MHz_923_3,
 			lora.Bandwidth_500_0,
-			lora.SpreadingFactor9,
-			lora.CodingRate4_5,
-			AU915_DEFAULT_PREAMBLE_LEN,
-			AU915_DEFAULT_TX_POWER_DBM}},
-		uplinkChannel: &ChannelAU{channel: channel{lora.MHz_916_8,
-			lora.Bandwidth_125_0,
-			lora.SpreadingFactor9,
+			lora.SpreadingFactor12,
 			lora.CodingRate4_5,
 			AU915_DEFAULT_PREAMBLE_LEN,
 			AU915_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels:             channels64x8(AU915_FREQUENCY_BASE_125, AU915_FREQUENCY_BASE_500, 5, 6),
+			minFrequency:         AU915_MIN_FREQUENCY,
+			maxFrequency:         AU915_MAX_FREQUENCY,
+			minDownlinkFrequency: AU915_MIN_DOWNLINK_FREQUENCY,
+			maxDownlinkFrequency: AU915_MAX_DOWNLINK_FREQUENCY,
+			dataRates:            dataRatesAU915,
+			dataRate:             3,
+			maxEIRP:              AU915_MAX_EIRP_DBM,
+			maxTxPower:           14,
+			chMaskCntl:           chMaskCntl64x8,
+			beacon:               hoppingBeacon(lora.MHz_923_3, 8),
+			rx1DataRates:         rx1DataRatesAU915,
+		},
 	}}
-}
+	r.join = joinSubBands{count: 8, dr125: 0, dr500: 6}
 
-func Next(c *ChannelAU) bool {
-	return false
+	r.joinRequestChannel = &ChannelAU{channel: channel{AU915_FREQUENCY_BASE_125,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor12,
+		lora.CodingRate4_5,
+		AU915_DEFAULT_PREAMBLE_LEN,
+		AU915_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelSubBands(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelAU{channel: channel{AU915_FREQUENCY_BASE_125,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		AU915_DEFAULT_PREAMBLE_LEN,
+		AU915_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
 }
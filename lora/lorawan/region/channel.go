@@ -40,3 +40,21 @@ func (c *channel) SetSpreadingFactor(v uint8) { c.spreadingFactor = v }
 func (c *channel) SetCodingRate(v uint8)      { c.codingRate = v }
 func (c *channel) SetPreambleLength(v uint16) { c.preambleLength = v }
 func (c *channel) SetTxPowerDBm(v int8)       { c.txPowerDBm = v }
+
+// rxChannel is a receive window channel, there is no other channel to try
+type rxChannel struct {
+	channel
+}
+
+func (c *rxChannel) Next() bool { return false }
+
+// copyChannel returns a receive channel with the settings of ch, which can
+// be modified without changing ch
+func copyChannel(ch Channel) Channel {
+	return &rxChannel{channel: channel{ch.Frequency(),
+		ch.Bandwidth(),
+		ch.SpreadingFactor(),
+		ch.CodingRate(),
+		ch.PreambleLength(),
+		ch.TxPowerDBm()}}
+}
@@ -0,0 +1,110 @@
+package region
+
+const (
+	BEACON_PREAMBLE_LEN = 10
+	BEACON_PERIOD       = 128 // seconds between two beacons
+
+	BEACON_HOP_INCREMENT = 600000 // between the beacon channels of hopping regions
+	BEACON_HOP_CHANNELS  = 8
+)
+
+// beaconPlan holds the Class B beacon and ping slot channels of a region. In
+// regions where frequency is 0 the beacon and the ping slots hop between
+// BEACON_HOP_CHANNELS channels from hopFrequency (US915 like). A zero
+// beaconPlan means Class B is not supported.
+type beaconPlan struct {
+	frequency    uint32
+	hopFrequency uint32
+	dataRate     uint8
+
+	// set by BeaconFreqReq and PingSlotChannelReq, 0 for the default frequency
+	beaconFrequency uint32
+	pingFrequency   uint32
+	pingDataRate    uint8
+}
+
+// fixedBeacon returns the beacon plan of regions with a single beacon channel
+func fixedBeacon(freq uint32, dr uint8) beaconPlan {
+	return beaconPlan{frequency: freq, dataRate: dr, pingDataRate: dr}
+}
+
+// hoppingBeacon returns the beacon plan of regions hopping between the
+// downlink channels from freq
+func hoppingBeacon(freq uint32, dr uint8) beaconPlan {
+	return beaconPlan{hopFrequency: freq, dataRate: dr, pingDataRate: dr}
+}
+
+// BeaconChannel returns the channel of the beacon sent at beaconTime, in
+// seconds since the GPS epoch. ok is false if the region does not support
+// Class B.
+func (r *settings) BeaconChannel(beaconTime uint32) (ch Channel, ok bool) {
+	freq := r.beacon.beaconFrequency
+	if freq == 0 {
+		freq = r.beacon.channelFrequency(r.beacon.frequency, beaconTime/BEACON_PERIOD)
+	}
+	return r.classBChannel(freq, r.beacon.dataRate, BEACON_PREAMBLE_LEN)
+}
+
+// PingSlotChannel returns the channel of the ping slots of devAddr in the
+// beacon period starting at beaconTime. ok is false if the region does not
+// support Class B.
+func (r *settings) PingSlotChannel(devAddr uint32, beaconTime uint32) (ch Channel, ok bool) {
+	freq := r.beacon.pingFrequency
+	if freq == 0 {
+		freq = r.beacon.channelFrequency(r.beacon.frequency, devAddr+beaconTime/BEACON_PERIOD)
+	}
+	return r.classBChannel(freq, r.beacon.pingDataRate, r.rx2Channel.PreambleLength())
+}
+
+// SetBeaconFrequency changes the beacon frequency, as requested by
+// BeaconFreqReq. A zero frequency restores the region default.
+func (r *settings) SetBeaconFrequency(freq uint32) bool {
+	if !r.classB() || (freq != 0 && !r.ValidDownlinkFrequency(freq)) {
+		return false
+	}
+	r.beacon.beaconFrequency = freq
+	return true
+}
+
+// SetPingSlotChannel changes the ping slot frequency and data rate, as
+// requested by PingSlotChannelReq. A zero frequency restores the region
+// default.
+func (r *settings) SetPingSlotChannel(freq uint32, dr uint8) (freqOK bool, drOK bool) {
+	if !r.classB() {
+		return false, false
+	}
+	freqOK = freq == 0 || r.ValidDownlinkFrequency(freq)
+	_, _, drOK = r.DownlinkDataRate(dr)
+	if freqOK && drOK {
+		r.beacon.pingFrequency = freq
+		r.beacon.pingDataRate = dr
+	}
+	return freqOK, drOK
+}
+
+func (r *settings) classB() bool {
+	return r.beacon.frequency != 0 || r.beacon.hopFrequency != 0
+}
+
+// channelFrequency returns freq, or the channel n of the hopping regions
+func (b *beaconPlan) channelFrequency(freq uint32, n uint32) uint32 {
+	if freq != 0 {
+		return freq
+	}
+	return b.hopFrequency + (n%BEACON_HOP_CHANNELS)*BEACON_HOP_INCREMENT
+}
+
+// classBChannel returns a receive channel on freq at data rate dr
+func (r *settings) classBChannel(freq uint32, dr uint8, preambleLength uint16) (Channel, bool) {
+	sf, bw, ok := r.DownlinkDataRate(dr)
+	if !r.classB() || !ok {
+		return nil, false
+	}
+	rx2 := r.rx2Channel
+	return &rxChannel{channel: channel{freq,
+		bw,
+		sf,
+		rx2.CodingRate(),
+		preambleLength,
+		rx2.TxPowerDBm()}}, true
+}
@@ -0,0 +1,131 @@
+package region
+
+import "tinygo.org/x/wireless/lora"
+
+const (
+	CN470_DEFAULT_PREAMBLE_LEN   = 8
+	CN470_DEFAULT_TX_POWER_DBM   = 19
+	CN470_FREQUENCY_INCREMENT    = 200000 // between uplink and between downlink channels
+	CN470_MAX_EIRP_DBM           = 19
+	CN470_MIN_FREQUENCY          = 470000000
+	CN470_MAX_FREQUENCY          = 510000000
+	CN470_MIN_DOWNLINK_FREQUENCY = 500000000
+	CN470_MAX_DOWNLINK_FREQUENCY = 510000000
+)
+
+// dataRatesCN470 is the CN470 data rate table
+var dataRatesCN470 = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, true, 115},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, true, 242},
+}
+
+// ChannelCN is a CN470 channel, Next moves it to another channel of the plan
+type ChannelCN struct {
+	channel
+	next func(c *channel) bool
+}
+
+func (c *ChannelCN) Next() bool {
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
+}
+
+type SettingsCN470 struct {
+	settings
+	join joinSubBands
+}
+
+// SetSubBand restricts the uplink channels to sub-band fsb (1 to 12):
+// channels 8*(fsb-1) to 8*fsb-1. fsb 0 enables all 96 channels.
+func (r *SettingsCN470) SetSubBand(fsb uint8) bool {
+	return r.setSubBand(12, fsb)
+}
+
+// JoinRequestChannel returns the channel of the next join request, a random
+// channel of each enabled sub-band. Next returns false once all of them were
+// tried.
+func (r *SettingsCN470) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
+}
+
+// JoinAcceptChannel returns the RX1 channel of the last join request
+func (r *SettingsCN470) JoinAcceptChannel() Channel {
+	return &ChannelCN{channel: rx1ChannelCN470(r.joinRequestChannel)}
+}
+
+// RX1Channel returns the downlink channel matching the current uplink channel
+func (r *SettingsCN470) RX1Channel() Channel {
+	return &ChannelCN{channel: rx1ChannelCN470(r.uplinkChannel)}
+}
+
+// rx1ChannelCN470 returns the RX1 channel of an uplink: uplink channel n is
+// answered on downlink channel n modulo 48
+func rx1ChannelCN470(up Channel) channel {
+	index := (up.Frequency() - lora.MHz_470_3) / CN470_FREQUENCY_INCREMENT
+	return channel{lora.MHz_500_3 + (index%48)*CN470_FREQUENCY_INCREMENT,
+		up.Bandwidth(),
+		up.SpreadingFactor(),
+		up.CodingRate(),
+		up.PreambleLength(),
+		up.TxPowerDBm()}
+}
+
+// CN470 returns the CN470 settings with all 96 uplink channels enabled, use
+// SetSubBand to select the sub-band of the network. Uplinks hop between the
+// enabled channels.
+func CN470() *SettingsCN470 {
+	channels := make([]planChannel, 96)
+	for i := range channels {
+		channels[i] = planChannel{lora.MHz_470_3 + uint32(i)*CN470_FREQUENCY_INCREMENT, 0, 5, true}
+	}
+
+	r := &SettingsCN470{settings: settings{
+		rx2Channel: &ChannelCN{channel: channel{lora.MHz_505_3,
+			lora.Bandwidth_125_0,
+			lora.SpreadingFactor12,
+			lora.CodingRate4_5,
+			CN470_DEFAULT_PREAMBLE_LEN,
+			CN470_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels:             channels,
+			minFrequency:         CN470_MIN_FREQUENCY,
+			maxFrequency:         CN470_MAX_FREQUENCY,
+			minDownlinkFrequency: CN470_MIN_DOWNLINK_FREQUENCY,
+			maxDownlinkFrequency: CN470_MAX_DOWNLINK_FREQUENCY,
+			dataRates:            dataRatesCN470,
+			dataRate:             3,
+			maxEIRP:              CN470_MAX_EIRP_DBM,
+			maxTxPower:           7,
+			chMaskCntl:           chMaskCntl96,
+			rx1DataRates:         rx1DataRatesEU868[:6],
+		},
+	}}
+	r.join = joinSubBands{count: 12, dr125: 3}
+
+	r.joinRequestChannel = &ChannelCN{channel: channel{lora.MHz_470_3,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		CN470_DEFAULT_PREAMBLE_LEN,
+		CN470_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelSubBands(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelCN{channel: channel{lora.MHz_470_3,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		CN470_DEFAULT_PREAMBLE_LEN,
+		CN470_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
+}
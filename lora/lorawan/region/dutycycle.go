@@ -0,0 +1,56 @@
+package region
+
+import "time"
+
+// band is a regulatory sub-band with a duty cycle limit
+type band struct {
+	minFrequency uint32
+	maxFrequency uint32
+	dutyCycle    uint32 // transmissions limited to 1/dutyCycle of the time
+	availableAt  time.Time
+}
+
+// TransmissionDone records a transmission of airtime on freq, which just
+// ended. The sub-band of freq cannot be used for airtime*(dutyCycle-1).
+func (r *settings) TransmissionDone(freq uint32, airtime time.Duration) {
+	if b := r.band(freq); b != nil {
+		b.availableAt = time.Now().Add(airtime * time.Duration(b.dutyCycle-1))
+	}
+}
+
+// WaitTime returns the time before the sub-band of freq can be used again,
+// 0 if it is available or has no duty cycle limit
+func (r *settings) WaitTime(freq uint32) time.Duration {
+	b := r.band(freq)
+	if b == nil {
+		return 0
+	}
+	return max(time.Until(b.availableAt), 0)
+}
+
+func (r *settings) band(freq uint32) *band {
+	for i := range r.bands {
+		if freq >= r.bands[i].minFrequency && freq < r.bands[i].maxFrequency {
+			return &r.bands[i]
+		}
+	}
+	return nil
+}
+
+// listenBeforeTalk is the flag of regions where a listen before talk channel
+// access can replace or is required in addition to the duty cycle (AS923,
+// KR920). The region only records it, the radio has to sense the channel
+// before transmitting.
+type listenBeforeTalk struct {
+	lbt bool
+}
+
+// ListenBeforeTalk reports if the channel must be sensed free before transmitting
+func (l *listenBeforeTalk) ListenBeforeTalk() bool {
+	return l.lbt
+}
+
+// SetListenBeforeTalk enables or disables listen before talk
+func (l *listenBeforeTalk) SetListenBeforeTalk(on bool) {
+	l.lbt = on
+}
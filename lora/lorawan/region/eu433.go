@@ -0,0 +1,106 @@
+package region
+
+import (
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+const (
+	EU433_DEFAULT_PREAMBLE_LEN = 8
+	EU433_DEFAULT_TX_POWER_DBM = 12
+	EU433_MAX_EIRP_DBM         = 12
+	EU433_MIN_FREQUENCY        = 433175000
+	EU433_MAX_FREQUENCY        = 434665000
+	EU433_MAX_CHANNELS         = 16
+)
+
+// ChannelEU433 is a EU433 channel, Next moves it to another channel of the plan
+type ChannelEU433 struct {
+	channel
+	next func(c *channel) bool
+}
+
+func (c *ChannelEU433) Next() bool {
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
+}
+
+type SettingsEU433 struct {
+	settings
+	join joinDynamic
+}
+
+// JoinRequestChannel returns the channel of the next join request, one of
+// the three default channels picked at random. Next returns false once all
+// of them were tried.
+func (r *SettingsEU433) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
+}
+
+// JoinAcceptChannel returns the RX1 channel of the last join request, on the
+// same frequency and data rate
+func (r *SettingsEU433) JoinAcceptChannel() Channel {
+	return copyChannel(r.joinRequestChannel)
+}
+
+// EU433 returns the EU433 settings with the three default channels, the
+// network server can define up to 13 more with the join accept CFList or
+// NewChannelReq. The data rates are the EU868 ones.
+func EU433() *SettingsEU433 {
+	r := &SettingsEU433{settings: settings{
+		rx2Channel: &ChannelEU433{channel: channel{lora.MHz_434_665,
+			lora.Bandwidth_125_0,
+			lora.SpreadingFactor12,
+			lora.CodingRate4_5,
+			EU433_DEFAULT_PREAMBLE_LEN,
+			EU433_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels: []planChannel{
+				{lora.MHz_433_175, 0, 5, true},
+				{lora.MHz_433_375, 0, 5, true},
+				{lora.MHz_433_575, 0, 5, true},
+			},
+			defaultChannels:      3,
+			maxChannels:          EU433_MAX_CHANNELS,
+			minFrequency:         EU433_MIN_FREQUENCY,
+			maxFrequency:         EU433_MAX_FREQUENCY,
+			minDownlinkFrequency: EU433_MIN_FREQUENCY,
+			maxDownlinkFrequency: EU433_MAX_FREQUENCY,
+			dataRates:            dataRatesEU868,
+			dataRate:             3,
+			maxEIRP:              EU433_MAX_EIRP_DBM,
+			maxTxPower:           5,
+			chMaskCntl:           chMaskCntlDynamic,
+			beacon:               fixedBeacon(lora.MHz_434_665, 3),
+			rx1DataRates:         rx1DataRatesEU868,
+			// ETSI EN 300 220 433.05-434.79 MHz band, LoRaWAN limits it to 1%
+			bands: []band{
+				{433050000, 434790000, 100, time.Time{}},
+			},
+		},
+	}}
+
+	r.joinRequestChannel = &ChannelEU433{channel: channel{lora.MHz_433_175,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		EU433_DEFAULT_PREAMBLE_LEN,
+		EU433_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelDynamic(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelEU433{channel: channel{lora.MHz_433_175,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		EU433_DEFAULT_PREAMBLE_LEN,
+		EU433_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
+}
@@ -1,43 +1,134 @@
 package region
 
-import "tinygo.org/x/wireless/lora"
+import (
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
 
 const (
 	EU868_DEFAULT_PREAMBLE_LEN = 8
 	EU868_DEFAULT_TX_POWER_DBM = 20
+	EU868_MAX_EIRP_DBM         = 16
+	EU868_MIN_FREQUENCY        = 863000000
+	EU868_MAX_FREQUENCY        = 870000000
+	EU868_MAX_CHANNELS         = 16
 )
 
+// dataRatesEU868 is the EU868 data rate table, DR7 (FSK) is not supported
+var dataRatesEU868 = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, true, 115},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_250_0, true, true, 242},
+}
+
+// rx1DataRatesEU868 is the RX1 data rate by uplink data rate and RX1DROffset
+var rx1DataRatesEU868 = [][]uint8{
+	{0, 0, 0, 0, 0, 0},
+	{1, 0, 0, 0, 0, 0},
+	{2, 1, 0, 0, 0, 0},
+	{3, 2, 1, 0, 0, 0},
+	{4, 3, 2, 1, 0, 0},
+	{5, 4, 3, 2, 1, 0},
+	{6, 5, 4, 3, 2, 1},
+}
+
+// ChannelEU is a EU868 channel, Next moves it to another channel of the plan
 type ChannelEU struct {
 	channel
+	next func(c *channel) bool
 }
 
 func (c *ChannelEU) Next() bool {
-	return false
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
 }
 
 type SettingsEU868 struct {
 	settings
+	join joinDynamic
+}
+
+// JoinRequestChannel returns the channel of the next join request, one of
+// the three default channels picked at random. Next returns false once all
+// of them were tried.
+func (r *SettingsEU868) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
 }
 
+// JoinAcceptChannel returns the RX1 channel of the last join request, on the
+// same frequency and data rate
+func (r *SettingsEU868) JoinAcceptChannel() Channel {
+	return copyChannel(r.joinRequestChannel)
+}
+
+// EU868 returns the EU868 settings with the three default channels, the
+// network server can define up to 13 more with the join accept CFList or
+// NewChannelReq. Uplinks hop between the enabled channels supporting the
+// data rate.
 func EU868() *SettingsEU868 {
-	return &SettingsEU868{settings: settings{
-		joinRequestChannel: &ChannelEU{channel: channel{lora.MHz_868_1,
-			lora.Bandwidth_125_0,
-			lora.SpreadingFactor9,
-			lora.CodingRate4_7,
-			EU868_DEFAULT_PREAMBLE_LEN,
-			EU868_DEFAULT_TX_POWER_DBM}},
-		joinAcceptChannel: &ChannelEU{channel: channel{lora.MHz_868_1,
+	r := &SettingsEU868{settings: settings{
+		rx2Channel: &ChannelEU{channel: channel{lora.MHz_869_525,
 			lora.Bandwidth_125_0,
-			lora.SpreadingFactor9,
-			lora.CodingRate4_7,
-			EU868_DEFAULT_PREAMBLE_LEN,
-			EU868_DEFAULT_TX_POWER_DBM}},
-		uplinkChannel: &ChannelEU{channel: channel{lora.MHz_868_1,
-			lora.Bandwidth_125_0,
-			lora.SpreadingFactor9,
-			lora.CodingRate4_7,
+			lora.SpreadingFactor12,
+			lora.CodingRate4_5,
 			EU868_DEFAULT_PREAMBLE_LEN,
 			EU868_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels: []planChannel{
+				{lora.MHz_868_1, 0, 5, true},
+				{lora.MHz_868_3, 0, 5, true},
+				{lora.MHz_868_5, 0, 5, true},
+			},
+			defaultChannels:      3,
+			maxChannels:          EU868_MAX_CHANNELS,
+			minFrequency:         EU868_MIN_FREQUENCY,
+			maxFrequency:         EU868_MAX_FREQUENCY,
+			minDownlinkFrequency: EU868_MIN_FREQUENCY,
+			maxDownlinkFrequency: EU868_MAX_FREQUENCY,
+			dataRates:            dataRatesEU868,
+			dataRate:             3,
+			maxEIRP:              EU868_MAX_EIRP_DBM,
+			maxTxPower:           7,
+			chMaskCntl:           chMaskCntlDynamic,
+			beacon:               fixedBeacon(lora.MHz_869_525, 3),
+			rx1DataRates:         rx1DataRatesEU868,
+			// ETSI EN 300 220 sub-bands, 0.1%, 1% or 10% duty cycle
+			bands: []band{
+				{863000000, 865000000, 1000, time.Time{}},
+				{865000000, 868000000, 100, time.Time{}},
+				{868000000, 868600000, 100, time.Time{}},
+				{868700000, 869200000, 1000, time.Time{}},
+				{869400000, 869650000, 10, time.Time{}},
+				{869700000, 870000000, 100, time.Time{}},
+			},
+		},
 	}}
+
+	r.joinRequestChannel = &ChannelEU{channel: channel{lora.MHz_868_1,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_7,
+		EU868_DEFAULT_PREAMBLE_LEN,
+		EU868_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelDynamic(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelEU{channel: channel{lora.MHz_868_1,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_7,
+		EU868_DEFAULT_PREAMBLE_LEN,
+		EU868_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
 }
@@ -0,0 +1,119 @@
+package region
+
+import "tinygo.org/x/wireless/lora"
+
+const (
+	IN865_DEFAULT_PREAMBLE_LEN = 8
+	IN865_DEFAULT_TX_POWER_DBM = 20
+	IN865_MAX_EIRP_DBM         = 30
+	IN865_MIN_FREQUENCY        = 865000000
+	IN865_MAX_FREQUENCY        = 867000000
+	IN865_MAX_CHANNELS         = 16
+)
+
+// dataRatesIN865 is the IN865 data rate table, DR7 (FSK) is not supported
+var dataRatesIN865 = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, true, 115},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, true, 242},
+}
+
+// rx1DataRatesIN865 is the RX1 data rate by uplink data rate and RX1DROffset,
+// offsets 6 and 7 raise the data rate
+var rx1DataRatesIN865 = [][]uint8{
+	{0, 0, 0, 0, 0, 0, 1, 2},
+	{1, 0, 0, 0, 0, 0, 2, 3},
+	{2, 1, 0, 0, 0, 0, 3, 4},
+	{3, 2, 1, 0, 0, 0, 4, 5},
+	{4, 3, 2, 1, 0, 0, 5, 5},
+	{5, 4, 3, 2, 1, 0, 5, 5},
+}
+
+// ChannelIN is a IN865 channel, Next moves it to another channel of the plan
+type ChannelIN struct {
+	channel
+	next func(c *channel) bool
+}
+
+func (c *ChannelIN) Next() bool {
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
+}
+
+type SettingsIN865 struct {
+	settings
+	join joinDynamic
+}
+
+// JoinRequestChannel returns the channel of the next join request, one of
+// the three default channels picked at random. Next returns false once all
+// of them were tried.
+func (r *SettingsIN865) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
+}
+
+// JoinAcceptChannel returns the RX1 channel of the last join request, on the
+// same frequency and data rate
+func (r *SettingsIN865) JoinAcceptChannel() Channel {
+	return copyChannel(r.joinRequestChannel)
+}
+
+// IN865 returns the IN865 settings with the three default channels, the
+// network server can define up to 13 more with the join accept CFList or
+// NewChannelReq.
+func IN865() *SettingsIN865 {
+	r := &SettingsIN865{settings: settings{
+		rx2Channel: &ChannelIN{channel: channel{lora.MHz_866_55,
+			lora.Bandwidth_125_0,
+			lora.SpreadingFactor10,
+			lora.CodingRate4_5,
+			IN865_DEFAULT_PREAMBLE_LEN,
+			IN865_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels: []planChannel{
+				{lora.MHz_865_0625, 0, 5, true},
+				{lora.MHz_865_4025, 0, 5, true},
+				{lora.MHz_865_985, 0, 5, true},
+			},
+			defaultChannels:      3,
+			maxChannels:          IN865_MAX_CHANNELS,
+			minFrequency:         IN865_MIN_FREQUENCY,
+			maxFrequency:         IN865_MAX_FREQUENCY,
+			minDownlinkFrequency: IN865_MIN_FREQUENCY,
+			maxDownlinkFrequency: IN865_MAX_FREQUENCY,
+			dataRates:            dataRatesIN865,
+			dataRate:             3,
+			maxEIRP:              IN865_MAX_EIRP_DBM,
+			maxTxPower:           10,
+			chMaskCntl:           chMaskCntlDynamic,
+			beacon:               fixedBeacon(lora.MHz_866_55, 4),
+			rx1DataRates:         rx1DataRatesIN865,
+		},
+	}}
+
+	r.joinRequestChannel = &ChannelIN{channel: channel{lora.MHz_865_0625,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		IN865_DEFAULT_PREAMBLE_LEN,
+		IN865_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelDynamic(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelIN{channel: channel{lora.MHz_865_0625,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		IN865_DEFAULT_PREAMBLE_LEN,
+		IN865_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
+}
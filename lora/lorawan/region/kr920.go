@@ -0,0 +1,110 @@
+package region
+
+import "tinygo.org/x/wireless/lora"
+
+const (
+	KR920_DEFAULT_PREAMBLE_LEN = 8
+	KR920_DEFAULT_TX_POWER_DBM = 14
+	KR920_MAX_EIRP_DBM         = 14
+	KR920_MIN_FREQUENCY        = 920900000
+	KR920_MAX_FREQUENCY        = 923300000
+	KR920_MAX_CHANNELS         = 16
+)
+
+// dataRatesKR920 is the KR920 data rate table
+var dataRatesKR920 = []dataRate{
+	{lora.SpreadingFactor12, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor11, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, true, 51},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, true, 115},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, true, 242},
+}
+
+// ChannelKR is a KR920 channel, Next moves it to another channel of the plan
+type ChannelKR struct {
+	channel
+	next func(c *channel) bool
+}
+
+func (c *ChannelKR) Next() bool {
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
+}
+
+type SettingsKR920 struct {
+	settings
+	listenBeforeTalk
+	join joinDynamic
+}
+
+// JoinRequestChannel returns the channel of the next join request, one of
+// the three default channels picked at random. Next returns false once all
+// of them were tried.
+func (r *SettingsKR920) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
+}
+
+// JoinAcceptChannel returns the RX1 channel of the last join request, on the
+// same frequency and data rate
+func (r *SettingsKR920) JoinAcceptChannel() Channel {
+	return copyChannel(r.joinRequestChannel)
+}
+
+// KR920 returns the KR920 settings with the three default channels, the
+// network server can define up to 13 more with the join accept CFList or
+// NewChannelReq. Listen before talk is required in Korea and enabled.
+func KR920() *SettingsKR920 {
+	r := &SettingsKR920{settings: settings{
+		rx2Channel: &ChannelKR{channel: channel{lora.MHz_921_9,
+			lora.Bandwidth_125_0,
+			lora.SpreadingFactor12,
+			lora.CodingRate4_5,
+			KR920_DEFAULT_PREAMBLE_LEN,
+			KR920_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels: []planChannel{
+				{lora.MHz_922_1, 0, 5, true},
+				{lora.MHz_922_3, 0, 5, true},
+				{lora.MHz_922_5, 0, 5, true},
+			},
+			defaultChannels:      3,
+			maxChannels:          KR920_MAX_CHANNELS,
+			minFrequency:         KR920_MIN_FREQUENCY,
+			maxFrequency:         KR920_MAX_FREQUENCY,
+			minDownlinkFrequency: KR920_MIN_FREQUENCY,
+			maxDownlinkFrequency: KR920_MAX_FREQUENCY,
+			dataRates:            dataRatesKR920,
+			dataRate:             3,
+			maxEIRP:              KR920_MAX_EIRP_DBM,
+			maxTxPower:           7,
+			chMaskCntl:           chMaskCntlDynamic,
+			beacon:               fixedBeacon(lora.MHz_923_1, 3),
+			rx1DataRates:         rx1DataRatesEU868[:6],
+		},
+	}}
+	r.lbt = true
+
+	r.joinRequestChannel = &ChannelKR{channel: channel{lora.MHz_922_1,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		KR920_DEFAULT_PREAMBLE_LEN,
+		KR920_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelDynamic(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelKR{channel: channel{lora.MHz_922_1,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		KR920_DEFAULT_PREAMBLE_LEN,
+		KR920_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
+}
@@ -0,0 +1,568 @@
+package region
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// ChannelMask is a ChMaskCntl/ChMask pair of a LinkADRReq MAC command
+type ChannelMask struct {
+	Cntl uint8
+	Mask uint16
+}
+
+// Values of LinkADRReq DataRate and TXPower fields meaning "keep current setting"
+const (
+	DataRateUnchanged = 0x0F
+	TxPowerUnchanged  = 0x0F
+)
+
+// planChannel is an uplink channel of the regional channel plan
+type planChannel struct {
+	frequency uint32
+	minDR     uint8
+	maxDR     uint8
+	enabled   bool
+}
+
+// dataRate is a LoRa modulation of the regional data rate table
+type dataRate struct {
+	spreadingFactor uint8
+	bandwidth       uint8
+	uplink          bool
+	downlink        bool
+	maxPayload      uint8 // N, maximum FRMPayload size without FOpts
+}
+
+// plan holds the regional channel plan and the uplink data rate and power
+// currently in use. It is updated by the network server MAC commands.
+type plan struct {
+	channels        []planChannel
+	defaultChannels int              // first channels defined by the region, cannot be modified
+	maxChannels     int              // size of the channel plan, 0 if NewChannelReq is not supported
+	defaultEnabled  []bool           // channels enabled by EnableDefaultChannels in a fixed plan, nil for all
+	rx1Frequencies  map[uint8]uint32 // RX1 frequency of the channels moved by DlChannelReq
+
+	minFrequency         uint32
+	maxFrequency         uint32
+	minDownlinkFrequency uint32
+	maxDownlinkFrequency uint32
+
+	dataRates []dataRate
+	dataRate  uint8
+
+	maxEIRP    int8
+	maxTxPower uint8
+	txPower    uint8
+
+	bands []band // duty cycle limited sub-bands
+
+	beacon beaconPlan // Class B beacon and ping slots
+
+	chMaskCntl   func(channels []planChannel, enabled []bool, cntl uint8, mask uint16) bool
+	rx1DataRates [][]uint8 // RX1 data rate by uplink data rate and RX1DROffset
+}
+
+// DataRate returns the uplink data rate index in use
+func (r *settings) DataRate() uint8 {
+	return r.dataRate
+}
+
+// SetDataRate changes the uplink data rate, dr must be supported by an enabled channel
+func (r *settings) SetDataRate(dr uint8) bool {
+	if !r.validDataRate(dr, r.enabledChannels()) {
+		return false
+	}
+	sf, bw, _ := r.UplinkDataRate(dr)
+	r.dataRate = dr
+	r.uplinkChannel.SetSpreadingFactor(sf)
+	r.uplinkChannel.SetBandwidth(bw)
+	return true
+}
+
+// UplinkChannelIndex returns the index in the channel plan of the uplink
+// channel in use
+func (r *settings) UplinkChannelIndex() uint8 {
+	freq := r.uplinkChannel.Frequency()
+	for i, c := range r.channels {
+		if c.frequency == freq {
+			return uint8(i)
+		}
+	}
+	return 0
+}
+
+// TxPower returns the uplink TX power index in use
+func (r *settings) TxPower() uint8 {
+	return r.txPower
+}
+
+// SetTxPower changes the uplink TX power, index 0 is the maximum EIRP and each
+// step lowers it by 2 dB
+func (r *settings) SetTxPower(index uint8) bool {
+	if index > r.maxTxPower {
+		return false
+	}
+	r.txPower = index
+	r.uplinkChannel.SetTxPowerDBm(r.maxEIRP - 2*int8(index))
+	return true
+}
+
+// initTxPower starts the join requests and uplinks at TX power index 0, the
+// maximum EIRP of the region
+func (r *settings) initTxPower() {
+	r.SetTxPower(0)
+	r.joinRequestChannel.SetTxPowerDBm(r.maxEIRP)
+}
+
+// DownlinkDataRate returns the modulation of a data rate usable in receive windows
+func (r *settings) DownlinkDataRate(dr uint8) (sf uint8, bw uint8, ok bool) {
+	if int(dr) >= len(r.dataRates) || !r.dataRates[dr].downlink {
+		return 0, 0, false
+	}
+	return r.dataRates[dr].spreadingFactor, r.dataRates[dr].bandwidth, true
+}
+
+// UplinkDataRate returns the modulation of a data rate usable for uplinks
+func (r *settings) UplinkDataRate(dr uint8) (sf uint8, bw uint8, ok bool) {
+	if int(dr) >= len(r.dataRates) || !r.dataRates[dr].uplink {
+		return 0, 0, false
+	}
+	return r.dataRates[dr].spreadingFactor, r.dataRates[dr].bandwidth, true
+}
+
+// MaxPayload returns the maximum size of FRMPayload and FOpts of an uplink
+// at data rate dr, 0 if dr cannot be used for uplinks
+func (r *settings) MaxPayload(dr uint8) uint8 {
+	if int(dr) >= len(r.dataRates) || !r.dataRates[dr].uplink {
+		return 0
+	}
+	return r.dataRates[dr].maxPayload
+}
+
+// RX1DataRate returns the RX1 data rate for an uplink data rate and a RX1DROffset
+func (r *settings) RX1DataRate(dr uint8, offset uint8) (uint8, bool) {
+	if int(dr) >= len(r.rx1DataRates) || int(offset) >= len(r.rx1DataRates[dr]) ||
+		!r.dataRates[dr].uplink {
+		return 0, false
+	}
+	return r.rx1DataRates[dr][offset], true
+}
+
+// ValidDownlinkFrequency reports if freq can be used as RX2 frequency
+func (r *settings) ValidDownlinkFrequency(freq uint32) bool {
+	return freq >= r.minDownlinkFrequency && freq <= r.maxDownlinkFrequency
+}
+
+// NewChannel creates, modifies or (with a zero frequency) disables the uplink
+// channel index, as requested by NewChannelReq.
+func (r *settings) NewChannel(index uint8, freq uint32, minDR uint8, maxDR uint8) (freqOK bool, drOK bool) {
+	if int(index) < r.defaultChannels || int(index) >= r.maxChannels {
+		return false, false
+	}
+
+	freqOK = freq == 0 || (freq >= r.minFrequency && freq <= r.maxFrequency)
+	drOK = minDR <= maxDR && int(maxDR) < len(r.dataRates) &&
+		r.dataRates[minDR].uplink && r.dataRates[maxDR].uplink
+	if !freqOK || !drOK {
+		return freqOK, drOK
+	}
+
+	for len(r.channels) <= int(index) {
+		r.channels = append(r.channels, planChannel{})
+	}
+	r.channels[index] = planChannel{frequency: freq, minDR: minDR, maxDR: maxDR, enabled: freq != 0}
+	delete(r.rx1Frequencies, index)
+	return true, true
+}
+
+// DlChannel moves the RX1 frequency of the uplink channel index away from
+// its uplink frequency, as requested by DlChannelReq. NewChannelReq resets
+// it.
+func (r *settings) DlChannel(index uint8, freq uint32) (freqOK bool, chOK bool) {
+	freqOK = r.ValidDownlinkFrequency(freq)
+	chOK = r.maxChannels > 0 && int(index) < len(r.channels) && r.channels[index].frequency != 0
+	if freqOK && chOK {
+		if r.rx1Frequencies == nil {
+			r.rx1Frequencies = map[uint8]uint32{}
+		}
+		r.rx1Frequencies[index] = freq
+	}
+	return freqOK, chOK
+}
+
+// LinkADR applies the data rate, TX power and channel masks of a block of
+// LinkADRReq commands. Nothing is changed unless all of them are accepted.
+func (r *settings) LinkADR(dr uint8, txPower uint8, masks []ChannelMask) (powerOK bool, drOK bool, maskOK bool) {
+	enabled := r.enabledChannels()
+	maskOK = r.chMaskCntl != nil
+	for _, m := range masks {
+		if !maskOK {
+			break
+		}
+		maskOK = r.chMaskCntl(r.channels, enabled, m.Cntl, m.Mask)
+	}
+	if maskOK {
+		maskOK = false
+		for _, e := range enabled {
+			maskOK = maskOK || e
+		}
+	}
+
+	if !maskOK {
+		// data rate is checked against the channels in use
+		enabled = r.enabledChannels()
+	}
+	drOK = dr == DataRateUnchanged || r.validDataRate(dr, enabled)
+	powerOK = txPower == TxPowerUnchanged || txPower <= r.maxTxPower
+	if !powerOK || !drOK || !maskOK {
+		return
+	}
+
+	for i := range r.channels {
+		r.channels[i].enabled = enabled[i]
+	}
+	if dr != DataRateUnchanged {
+		r.SetDataRate(dr)
+	}
+	if txPower != TxPowerUnchanged {
+		r.SetTxPower(txPower)
+	}
+	return
+}
+
+// EnableDefaultChannels enables back the default uplink channels of the region
+func (r *settings) EnableDefaultChannels() {
+	for i := range r.channels {
+		// regions with a fixed channel plan enable all their channels, or
+		// the selected sub-band
+		if i < r.defaultChannels {
+			r.channels[i].enabled = true
+		} else if r.maxChannels == 0 {
+			r.channels[i].enabled = r.defaultEnabled == nil || r.defaultEnabled[i]
+		}
+	}
+}
+
+// maxEIRPTable maps the MaxEIRP index of TxParamSetupReq to dBm
+var maxEIRPTable = [16]int8{8, 10, 12, 13, 14, 16, 18, 20, 21, 24, 26, 27, 29, 30, 33, 36}
+
+// TxParamSetup applies the dwell time limits and maximum EIRP of a
+// TxParamSetupReq. It returns false, and the command is not answered, in
+// regions that do not support it.
+func (r *settings) TxParamSetup(uplinkDwellTime bool, downlinkDwellTime bool, maxEIRP uint8) bool {
+	return false
+}
+
+// setMaxEIRP changes the EIRP of TX power index 0 to the MaxEIRP index of
+// TxParamSetupReq, the TX power index in use is kept
+func (r *settings) setMaxEIRP(index uint8) {
+	r.maxEIRP = maxEIRPTable[index&0x0F]
+	r.SetTxPower(r.txPower)
+}
+
+// ApplyCFList applies the CFList of a join accept: a list of 5 additional
+// channels (CFListType 0) replacing the channels defined by the network
+// server in dynamic plans, or the channel mask (CFListType 1) of fixed plans.
+func (r *settings) ApplyCFList(cfList [16]uint8) bool {
+	switch {
+	case cfList[15] == 0 && r.maxChannels > 0:
+		r.channels = r.channels[:r.defaultChannels]
+		r.rx1Frequencies = nil
+		minDR, maxDR := r.channels[0].minDR, r.channels[0].maxDR
+		for i := 0; i < 5; i++ {
+			b := cfList[i*3:]
+			freq := (uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16) * 100
+			if freq == 0 {
+				continue
+			}
+			if ok, _ := r.NewChannel(uint8(r.defaultChannels+i), freq, minDR, maxDR); !ok {
+				return false
+			}
+		}
+	case cfList[15] == 1 && r.maxChannels == 0:
+		for i := range r.channels {
+			r.channels[i].enabled = cfList[i/8]&(1<<(i%8)) != 0
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// MinDataRate returns the lowest uplink data rate of the region
+func (r *settings) MinDataRate() uint8 {
+	for i, dr := range r.dataRates {
+		if dr.uplink {
+			return uint8(i)
+		}
+	}
+	return 0
+}
+
+// enabledChannels returns a copy of the channel enabled flags
+func (r *settings) enabledChannels() []bool {
+	enabled := make([]bool, len(r.channels))
+	for i := range r.channels {
+		enabled[i] = r.channels[i].enabled
+	}
+	return enabled
+}
+
+// validDataRate reports if dr is an uplink data rate of one of the enabled channels
+func (r *settings) validDataRate(dr uint8, enabled []bool) bool {
+	if int(dr) >= len(r.dataRates) || !r.dataRates[dr].uplink {
+		return false
+	}
+	for i, c := range r.channels {
+		if enabled[i] && c.frequency != 0 && dr >= c.minDR && dr <= c.maxDR {
+			return true
+		}
+	}
+	return false
+}
+
+// hop moves c to a random enabled channel supporting the uplink data rate.
+// Channels of sub-bands that exhausted their duty cycle are avoided, if all
+// of them did the channel available first is used.
+func (r *settings) hop(c *channel) bool {
+	var candidates []int
+	minWait := time.Duration(-1)
+	for i, ch := range r.channels {
+		if !ch.enabled || ch.frequency == 0 || r.dataRate < ch.minDR || r.dataRate > ch.maxDR {
+			continue
+		}
+		wait := r.WaitTime(ch.frequency)
+		if minWait < 0 || wait < minWait {
+			minWait = wait
+			candidates = candidates[:0]
+		}
+		if wait == minWait {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+	c.frequency = r.channels[candidates[randIntn(len(candidates))]].frequency
+	c.spreadingFactor = r.dataRates[r.dataRate].spreadingFactor
+	c.bandwidth = r.dataRates[r.dataRate].bandwidth
+	return true
+}
+
+// randIntn returns a random number in [0, n)
+func randIntn(n int) int {
+	var b [2]uint8
+	rand.Read(b[:])
+	return int(uint16(b[0])<<8|uint16(b[1])) % n
+}
+
+// chMaskCntlDynamic handles ChMaskCntl of regions with up to 16 channels defined
+// by the network server (EU868 like)
+func chMaskCntlDynamic(channels []planChannel, enabled []bool, cntl uint8, mask uint16) bool {
+	switch cntl {
+	case 0:
+		for i := 0; i < 16; i++ {
+			on := mask&(1<<i) != 0
+			if i >= len(channels) || channels[i].frequency == 0 {
+				// undefined channels cannot be enabled
+				if on {
+					return false
+				}
+				continue
+			}
+			enabled[i] = on
+		}
+	case 6:
+		for i := range channels {
+			enabled[i] = channels[i].frequency != 0
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// chMaskCntl64x8 handles ChMaskCntl of regions with 64 125 kHz and
+// 8 500 kHz uplink channels (US915 like)
+func chMaskCntl64x8(channels []planChannel, enabled []bool, cntl uint8, mask uint16) bool {
+	if len(enabled) < 72 {
+		return false
+	}
+	switch {
+	case cntl <= 4:
+		for i := 0; i < 16; i++ {
+			if ch := int(cntl)*16 + i; ch < 72 {
+				enabled[ch] = mask&(1<<i) != 0
+			}
+		}
+	case cntl == 5:
+		// each bit enables a block of 8 125 kHz channels and the
+		// matching 500 kHz channel
+		for i := 0; i < 8; i++ {
+			on := mask&(1<<i) != 0
+			for j := 0; j < 8; j++ {
+				enabled[i*8+j] = on
+			}
+			enabled[64+i] = on
+		}
+	case cntl == 6 || cntl == 7:
+		for i := 0; i < 64; i++ {
+			enabled[i] = cntl == 6
+		}
+		for i := 0; i < 8; i++ {
+			enabled[64+i] = mask&(1<<i) != 0
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// chMaskCntl96 handles ChMaskCntl of regions with 96 125 kHz uplink
+// channels (CN470)
+func chMaskCntl96(channels []planChannel, enabled []bool, cntl uint8, mask uint16) bool {
+	if len(enabled) < 96 {
+		return false
+	}
+	switch {
+	case cntl <= 5:
+		for i := 0; i < 16; i++ {
+			enabled[int(cntl)*16+i] = mask&(1<<i) != 0
+		}
+	case cntl == 6:
+		for i := 0; i < 96; i++ {
+			enabled[i] = true
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// channels64x8 returns the 64 125 kHz and 8 500 kHz uplink channels of US915
+// like regions
+func channels64x8(base125 uint32, base500 uint32, dr125 uint8, dr500 uint8) []planChannel {
+	channels := make([]planChannel, 72)
+	for i := 0; i < 64; i++ {
+		channels[i] = planChannel{base125 + uint32(i)*US915_FREQUENCY_INCREMENT_DR_0, 0, dr125, true}
+	}
+	for i := 0; i < 8; i++ {
+		channels[64+i] = planChannel{base500 + uint32(i)*US915_FREQUENCY_INCREMENT_DR_4, dr500, dr500, true}
+	}
+	return channels
+}
+
+// setSubBand enables the 8 125 kHz channels and the 500 kHz channel if any
+// of sub-band fsb (1 to count) of regions with a fixed plan, or all channels
+// if fsb is 0. The selection is kept by EnableDefaultChannels.
+func (r *settings) setSubBand(count int, fsb uint8) bool {
+	if int(fsb) > count || len(r.channels) < count*8 {
+		return false
+	}
+	enabled := make([]bool, len(r.channels))
+	for i := range enabled {
+		switch {
+		case fsb == 0:
+			enabled[i] = true
+		case i < count*8:
+			enabled[i] = i/8 == int(fsb)-1
+		default:
+			enabled[i] = i-count*8 == int(fsb)-1
+		}
+	}
+	r.defaultEnabled = enabled
+	r.EnableDefaultChannels()
+	return true
+}
+
+// joinSubBands is the join channel selection of regions with a fixed plan
+// of 8 channel sub-bands (US915 like): each cycle tries a random 125 kHz
+// channel of every enabled sub-band, in a random order, then a random
+// 500 kHz channel if the region has some.
+type joinSubBands struct {
+	attempt  int
+	subBands []int
+	count    int // number of 125 kHz sub-bands
+	dr125    uint8
+	dr500    uint8
+}
+
+// nextJoinChannelSubBands moves c to the channel of the next join attempt,
+// it returns false when a cycle is over
+func (r *settings) nextJoinChannelSubBands(j *joinSubBands, c *channel) bool {
+	if j.attempt == 0 {
+		// random order of the sub-bands having enabled channels
+		j.subBands = j.subBands[:0]
+		for sb := 0; sb < j.count; sb++ {
+			if len(r.enabledIn(sb*8, sb*8+8)) > 0 {
+				j.subBands = append(j.subBands, sb)
+			}
+		}
+		for i := len(j.subBands) - 1; i > 0; i-- {
+			k := randIntn(i + 1)
+			j.subBands[i], j.subBands[k] = j.subBands[k], j.subBands[i]
+		}
+	}
+
+	var candidates []int
+	dr := j.dr125
+	switch {
+	case j.attempt < len(j.subBands):
+		sb := j.subBands[j.attempt]
+		candidates = r.enabledIn(sb*8, sb*8+8)
+	case j.attempt == len(j.subBands):
+		candidates = r.enabledIn(j.count*8, len(r.channels))
+		dr = j.dr500
+	}
+	if len(candidates) == 0 {
+		j.attempt = 0
+		return false
+	}
+
+	c.frequency = r.channels[candidates[randIntn(len(candidates))]].frequency
+	c.spreadingFactor = r.dataRates[dr].spreadingFactor
+	c.bandwidth = r.dataRates[dr].bandwidth
+	j.attempt++
+	return true
+}
+
+// enabledIn returns the enabled channels with an index in [from, to)
+func (r *settings) enabledIn(from int, to int) []int {
+	var list []int
+	for i := from; i < to && i < len(r.channels); i++ {
+		if r.channels[i].enabled {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+// joinDynamic is the join channel selection of regions with default channels
+// (EU868 like): each cycle tries the default channels in a random order.
+type joinDynamic struct {
+	attempt int
+	order   []int
+}
+
+// nextJoinChannelDynamic moves c to the channel of the next join attempt, it
+// returns false when a cycle is over
+func (r *settings) nextJoinChannelDynamic(j *joinDynamic, c *channel) bool {
+	if j.attempt == 0 {
+		j.order = j.order[:0]
+		for i := 0; i < r.defaultChannels; i++ {
+			j.order = append(j.order, i)
+		}
+		for i := len(j.order) - 1; i > 0; i-- {
+			k := randIntn(i + 1)
+			j.order[i], j.order[k] = j.order[k], j.order[i]
+		}
+	}
+	if j.attempt >= len(j.order) {
+		j.attempt = 0
+		return false
+	}
+	c.frequency = r.channels[j.order[j.attempt]].frequency
+	j.attempt++
+	return true
+}
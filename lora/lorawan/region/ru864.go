@@ -0,0 +1,105 @@
+package region
+
+import (
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+const (
+	RU864_DEFAULT_PREAMBLE_LEN = 8
+	RU864_DEFAULT_TX_POWER_DBM = 16
+	RU864_MAX_EIRP_DBM         = 16
+	RU864_MIN_FREQUENCY        = 864000000
+	RU864_MAX_FREQUENCY        = 870000000
+	RU864_MAX_CHANNELS         = 16
+)
+
+// ChannelRU is a RU864 channel, Next moves it to another channel of the plan
+type ChannelRU struct {
+	channel
+	next func(c *channel) bool
+}
+
+func (c *ChannelRU) Next() bool {
+	if c.next == nil {
+		return false
+	}
+	return c.next(&c.channel)
+}
+
+type SettingsRU864 struct {
+	settings
+	join joinDynamic
+}
+
+// JoinRequestChannel returns the channel of the next join request, one of
+// the two default channels picked at random. Next returns false once both
+// were tried.
+func (r *SettingsRU864) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
+	}
+	return r.joinRequestChannel
+}
+
+// JoinAcceptChannel returns the RX1 channel of the last join request, on the
+// same frequency and data rate
+func (r *SettingsRU864) JoinAcceptChannel() Channel {
+	return copyChannel(r.joinRequestChannel)
+}
+
+// RU864 returns the RU864 settings with the two default channels, the
+// network server can define up to 14 more with the join accept CFList or
+// NewChannelReq. The data rates are the EU868 ones.
+func RU864() *SettingsRU864 {
+	r := &SettingsRU864{settings: settings{
+		rx2Channel: &ChannelRU{channel: channel{lora.MHz_869_1,
+			lora.Bandwidth_125_0,
+			lora.SpreadingFactor12,
+			lora.CodingRate4_5,
+			RU864_DEFAULT_PREAMBLE_LEN,
+			RU864_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels: []planChannel{
+				{lora.MHz_868_9, 0, 5, true},
+				{lora.MHz_869_1, 0, 5, true},
+			},
+			defaultChannels:      2,
+			maxChannels:          RU864_MAX_CHANNELS,
+			minFrequency:         RU864_MIN_FREQUENCY,
+			maxFrequency:         RU864_MAX_FREQUENCY,
+			minDownlinkFrequency: RU864_MIN_FREQUENCY,
+			maxDownlinkFrequency: RU864_MAX_FREQUENCY,
+			dataRates:            dataRatesEU868,
+			dataRate:             3,
+			maxEIRP:              RU864_MAX_EIRP_DBM,
+			maxTxPower:           7,
+			chMaskCntl:           chMaskCntlDynamic,
+			beacon:               fixedBeacon(lora.MHz_869_1, 3),
+			rx1DataRates:         rx1DataRatesEU868,
+			// 1% duty cycle on the whole band
+			bands: []band{
+				{RU864_MIN_FREQUENCY, RU864_MAX_FREQUENCY, 100, time.Time{}},
+			},
+		},
+	}}
+
+	r.joinRequestChannel = &ChannelRU{channel: channel{lora.MHz_868_9,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		RU864_DEFAULT_PREAMBLE_LEN,
+		RU864_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelDynamic(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelRU{channel: channel{lora.MHz_868_9,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor9,
+		lora.CodingRate4_5,
+		RU864_DEFAULT_PREAMBLE_LEN,
+		RU864_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
+}
@@ -1,15 +1,45 @@
 package region
 
+import "time"
+
 type Settings interface {
 	JoinRequestChannel() Channel
 	JoinAcceptChannel() Channel
 	UplinkChannel() Channel
+	UplinkChannelIndex() uint8
+	RX1Channel() Channel
+	RX2Channel() Channel
+
+	DataRate() uint8
+	SetDataRate(dr uint8) bool
+	MinDataRate() uint8
+	TxPower() uint8
+	SetTxPower(index uint8) bool
+	UplinkDataRate(dr uint8) (sf uint8, bw uint8, ok bool)
+	DownlinkDataRate(dr uint8) (sf uint8, bw uint8, ok bool)
+	MaxPayload(dr uint8) uint8
+	RX1DataRate(dr uint8, offset uint8) (uint8, bool)
+	ValidDownlinkFrequency(freq uint32) bool
+	NewChannel(index uint8, freq uint32, minDR uint8, maxDR uint8) (freqOK bool, drOK bool)
+	DlChannel(index uint8, freq uint32) (freqOK bool, chOK bool)
+	LinkADR(dr uint8, txPower uint8, masks []ChannelMask) (powerOK bool, drOK bool, maskOK bool)
+	EnableDefaultChannels()
+	ApplyCFList(cfList [16]uint8) bool
+	TxParamSetup(uplinkDwellTime bool, downlinkDwellTime bool, maxEIRP uint8) bool
+	TransmissionDone(freq uint32, airtime time.Duration)
+	WaitTime(freq uint32) time.Duration
+	BeaconChannel(beaconTime uint32) (ch Channel, ok bool)
+	PingSlotChannel(devAddr uint32, beaconTime uint32) (ch Channel, ok bool)
+	SetBeaconFrequency(freq uint32) bool
+	SetPingSlotChannel(freq uint32, dr uint8) (freqOK bool, drOK bool)
 }
 
 type settings struct {
 	joinRequestChannel Channel
 	joinAcceptChannel  Channel
 	uplinkChannel      Channel
+	rx2Channel         Channel
+	plan
 }
 
 func (r *settings) JoinRequestChannel() Channel {
@@ -23,3 +53,19 @@ func (r *settings) JoinAcceptChannel() Channel {
 func (r *settings) UplinkChannel() Channel {
 	return r.uplinkChannel
 }
+
+// RX1Channel returns the channel of the first receive window that follows
+// an uplink. By default RX1 uses the same frequency and data rate as the
+// uplink, unless DlChannelReq set another frequency for the channel.
+func (r *settings) RX1Channel() Channel {
+	ch := copyChannel(r.uplinkChannel)
+	if freq, ok := r.rx1Frequencies[r.UplinkChannelIndex()]; ok {
+		ch.SetFrequency(freq)
+	}
+	return ch
+}
+
+// RX2Channel returns the default channel of the second receive window
+func (r *settings) RX2Channel() Channel {
+	return copyChannel(r.rx2Channel)
+}
@@ -7,76 +7,152 @@ const (
 	US915_DEFAULT_TX_POWER_DBM     = 20
 	US915_FREQUENCY_INCREMENT_DR_0 = 200000  // only for 125 kHz Bandwidth
 	US915_FREQUENCY_INCREMENT_DR_4 = 1600000 // only for 500 kHz Bandwidth
+	US915_FREQUENCY_INCREMENT_RX1  = 600000  // between the 8 downlink channels
+	US915_MAX_EIRP_DBM             = 30
+	US915_MIN_FREQUENCY            = 902000000
+	US915_MAX_FREQUENCY            = 928000000
+	US915_MIN_DOWNLINK_FREQUENCY   = 923300000
+	US915_MAX_DOWNLINK_FREQUENCY   = 927500000
 )
 
+// dataRatesUS915 is the US915 data rate table, DR0-4 are uplink only and
+// DR8-13 downlink only
+var dataRatesUS915 = []dataRate{
+	{lora.SpreadingFactor10, lora.Bandwidth_125_0, true, false, 11},
+	{lora.SpreadingFactor9, lora.Bandwidth_125_0, true, false, 53},
+	{lora.SpreadingFactor8, lora.Bandwidth_125_0, true, false, 125},
+	{lora.SpreadingFactor7, lora.Bandwidth_125_0, true, false, 242},
+	{lora.SpreadingFactor8, lora.Bandwidth_500_0, true, false, 242},
+	{}, {}, {},
+	{lora.SpreadingFactor12, lora.Bandwidth_500_0, false, true, 53},
+	{lora.SpreadingFactor11, lora.Bandwidth_500_0, false, true, 129},
+	{lora.SpreadingFactor10, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor9, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor8, lora.Bandwidth_500_0, false, true, 242},
+	{lora.SpreadingFactor7, lora.Bandwidth_500_0, false, true, 242},
+}
+
+// rx1DataRatesUS915 is the RX1 data rate by uplink data rate and RX1DROffset
+var rx1DataRatesUS915 = [][]uint8{
+	{10, 9, 8, 8},
+	{11, 10, 9, 8},
+	{12, 11, 10, 9},
+	{13, 12, 11, 10},
+	{13, 13, 12, 11},
+}
+
+// ChannelUS is a US915 channel, Next moves it to another channel of the plan
 type ChannelUS struct {
 	channel
+	next func(c *channel) bool
 }
 
 func (c *ChannelUS) Next() bool {
-	switch c.Bandwidth() {
-	case lora.Bandwidth_125_0:
-		freq, ok := stepFrequency125(c.frequency)
-		if ok {
-			c.frequency = freq
-		} else {
-			c.frequency = lora.Mhz_903_0
-			c.bandwidth = lora.Bandwidth_500_0
-		}
-	case lora.Bandwidth_500_0:
-		freq, ok := stepFrequency500(c.frequency)
-		if ok {
-			c.frequency = freq
-		} else {
-			// there are no more frequencies to check after sweeping all 8 500 kHz channels
-			return false
-		}
+	if c.next == nil {
+		return false
 	}
-
-	return true
+	return c.next(&c.channel)
 }
 
-func stepFrequency125(freq uint32) (uint32, bool) {
-	f := freq + US915_FREQUENCY_INCREMENT_DR_0
-	if f >= lora.MHZ_915_0 {
-		return 0, false
-	}
+type SettingsUS915 struct {
+	settings
+	join joinSubBands
+}
 
-	return f, true
+// SetSubBand restricts the uplink channels to sub-band fsb (1 to 8): 125 kHz
+// channels 8*(fsb-1) to 8*fsb-1 and 500 kHz channel 64+fsb-1. Most gateways
+// only listen to one sub-band. fsb 0 enables all 72 channels.
+func (r *SettingsUS915) SetSubBand(fsb uint8) bool {
+	return r.setSubBand(8, fsb)
 }
 
-func stepFrequency500(freq uint32) (uint32, bool) {
-	f := freq + US915_FREQUENCY_INCREMENT_DR_4
-	if f >= lora.MHZ_915_0 {
-		return 0, false
+// JoinRequestChannel returns the channel of the next join request, a random
+// 125 kHz DR0 channel of each enabled sub-band then a 500 kHz DR4 channel
+// (8+1 strategy). Next returns false once all of them were tried.
+func (r *SettingsUS915) JoinRequestChannel() Channel {
+	if r.join.attempt == 0 {
+		r.joinRequestChannel.Next()
 	}
+	return r.joinRequestChannel
+}
 
-	return f, true
+// JoinAcceptChannel returns the RX1 channel of the last join request
+func (r *SettingsUS915) JoinAcceptChannel() Channel {
+	return &ChannelUS{channel: rx1Channel500(r.joinRequestChannel, lora.MHz_902_3, lora.Mhz_903_0)}
 }
 
-type SettingsUS915 struct {
-	settings
+// RX1Channel returns the downlink channel matching the current uplink channel.
+// Downlink channel is the uplink channel number modulo 8, all downlinks
+// use 500 kHz bandwidth.
+func (r *SettingsUS915) RX1Channel() Channel {
+	return &ChannelUS{channel: rx1Channel500(r.uplinkChannel, lora.MHz_902_3, lora.Mhz_903_0)}
 }
 
+// rx1Channel500 computes the RX1 channel of the US915/AU915 style plans
+// having 64 125 kHz + 8 500 kHz uplink channels and 8 500 kHz downlink channels.
+func rx1Channel500(up Channel, base125, base500 uint32) channel {
+	var index uint32
+	sf := up.SpreadingFactor()
+	switch up.Bandwidth() {
+	case lora.Bandwidth_500_0:
+		index = 64 + (up.Frequency()-base500)/US915_FREQUENCY_INCREMENT_DR_4
+		// The 500 kHz uplink data rate is answered on DR13
+		sf = lora.SpreadingFactor7
+	default:
+		index = (up.Frequency() - base125) / US915_FREQUENCY_INCREMENT_DR_0
+	}
+
+	return channel{lora.MHz_923_3 + (index%8)*US915_FREQUENCY_INCREMENT_RX1,
+		lora.Bandwidth_500_0,
+		sf,
+		up.CodingRate(),
+		up.PreambleLength(),
+		up.TxPowerDBm()}
+}
+
+// US915 returns the US915 settings with all 72 channels enabled, use
+// SetSubBand to select the sub-band of the network. Uplinks start at DR3 and
+// hop between the enabled channels supporting the data rate.
 func US915() *SettingsUS915 {
-	return &SettingsUS915{settings: settings{
-		joinRequestChannel: &ChannelUS{channel: channel{lora.MHz_902_3,
-			lora.Bandwidth_125_0,
-			lora.SpreadingFactor10,
-			lora.CodingRate4_5,
-			US915_DEFAULT_PREAMBLE_LEN,
-			US915_DEFAULT_TX_POWER_DBM}},
-		joinAcceptChannel: &ChannelUS{channel: channel{0,
-			lora.Bandwidth_500_0,
-			lora.SpreadingFactor9,
-			lora.CodingRate4_5,
-			US915_DEFAULT_PREAMBLE_LEN,
-			US915_DEFAULT_TX_POWER_DBM}},
-		uplinkChannel: &ChannelUS{channel: channel{lora.Mhz_903_0,
+	r := &SettingsUS915{settings: settings{
+		rx2Channel: &ChannelUS{channel: channel{lora.MHz_923_3,
 			lora.Bandwidth_500_0,
-			lora.SpreadingFactor9,
+			lora.SpreadingFactor12,
 			lora.CodingRate4_5,
 			US915_DEFAULT_PREAMBLE_LEN,
 			US915_DEFAULT_TX_POWER_DBM}},
+		plan: plan{
+			channels:             channels64x8(lora.MHz_902_3, lora.Mhz_903_0, 3, 4),
+			minFrequency:         US915_MIN_FREQUENCY,
+			maxFrequency:         US915_MAX_FREQUENCY,
+			minDownlinkFrequency: US915_MIN_DOWNLINK_FREQUENCY,
+			maxDownlinkFrequency: US915_MAX_DOWNLINK_FREQUENCY,
+			dataRates:            dataRatesUS915,
+			dataRate:             3,
+			maxEIRP:              US915_MAX_EIRP_DBM,
+			maxTxPower:           14,
+			chMaskCntl:           chMaskCntl64x8,
+			beacon:               hoppingBeacon(lora.MHz_923_3, 8),
+			rx1DataRates:         rx1DataRatesUS915,
+		},
 	}}
+	r.join = joinSubBands{count: 8, dr125: 0, dr500: 4}
+
+	r.joinRequestChannel = &ChannelUS{channel: channel{lora.MHz_902_3,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor10,
+		lora.CodingRate4_5,
+		US915_DEFAULT_PREAMBLE_LEN,
+		US915_DEFAULT_TX_POWER_DBM},
+		next: func(c *channel) bool { return r.nextJoinChannelSubBands(&r.join, c) }}
+	r.joinAcceptChannel = r.JoinAcceptChannel()
+	r.uplinkChannel = &ChannelUS{channel: channel{lora.MHz_902_3,
+		lora.Bandwidth_125_0,
+		lora.SpreadingFactor7,
+		lora.CodingRate4_5,
+		US915_DEFAULT_PREAMBLE_LEN,
+		US915_DEFAULT_TX_POWER_DBM},
+		next: r.hop}
+	r.initTxPower()
+	return r
 }
@@ -1,10 +1,26 @@
 package lorawan
 
 import (
-	"crypto/aes"
-	"encoding/binary"
 	"encoding/hex"
-	"math"
+	"time"
+)
+
+// LoRaWAN message types, MHDR bits 7..5
+const (
+	MTypeJoinRequest         = 0x00
+	MTypeJoinAccept          = 0x01
+	MTypeUnconfirmedDataUp   = 0x02
+	MTypeUnconfirmedDataDown = 0x03
+	MTypeConfirmedDataUp     = 0x04
+	MTypeConfirmedDataDown   = 0x05
+	MTypeRejoinRequest       = 0x06
+	MTypeProprietary         = 0x07
+)
+
+// LoRaWAN versions of a session
+const (
+	Version10 = iota // LoRaWAN 1.0.x, a single NwkSKey
+	Version11        // LoRaWAN 1.1, FNwkSIntKey, SNwkSIntKey and NwkSEncKey
 )
 
 // Session is used to store session data of a LoRaWAN session
@@ -17,6 +33,86 @@ type Session struct {
 	CFList     [16]uint8
 	RXDelay    uint8
 	DLSettings uint8
+	Activation uint8 // ActivationNone, ActivationOTAA or ActivationABP
+	Version    uint8 // Version10 or Version11
+	Class      uint8 // ClassA, ClassB or ClassC, the receive windows opened by the device
+
+	// LoRaWAN 1.1 network session keys, replacing NwkSKey
+	FNwkSIntKey [16]uint8 // uplink MIC
+	SNwkSIntKey [16]uint8 // uplink and downlink MIC
+	NwkSEncKey  [16]uint8 // FOpts and FPort 0 FRMPayload encryption
+
+	// LoRaWAN 1.1 downlink frame counters, replacing FCntDown
+	AFCntDown uint32 // application downlinks, FPort > 0
+	NFCntDown uint32 // MAC only downlinks, FPort 0 or no FPort
+
+	// Adaptive Data Rate
+	ADR       bool   // Data rate and TX power are controlled by the network server
+	ADRAckCnt uint32 // ADR_ACK_CNT, uplinks sent since the last downlink
+
+	// Set by the network server MAC commands
+	RX2Frequency uint32 // RX2 frequency, 0 for the region default
+	MaxDutyCycle uint8  // aggregated duty cycle limit is 1/2^MaxDutyCycle
+	LinkMargin   uint8  // LinkCheckAns demodulation margin, in dB
+	GatewayCount uint8  // LinkCheckAns number of gateways
+
+	// Link quality of the last downlink received
+	RSSI int16 // in dBm
+	SNR  int8  // in dB
+
+	// last downlink was confirmed, next uplink must carry an ACK
+	pendingACK bool
+
+	// MAC commands answers to send in the next uplink. Sticky answers are
+	// repeated until a downlink is received.
+	pendingMAC []uint8
+	stickyMAC  []uint8
+
+	// the last uplink generated carries pendingMAC, dequeued once sent
+	macInFlight bool
+
+	// end of the last uplink transmission, receive windows are timed from it
+	lastUplinkEnd time.Time
+
+	// LoRaWAN 1.1 frame counters of the last confirmed uplink and downlink,
+	// for the MIC of the frame acknowledging them
+	confFCntUp   uint32
+	confFCntDown uint32
+
+	// LoRaWAN 1.1 RekeyInd is sent until RekeyConf is received
+	rekeyInd bool
+
+	// Class B ping slots are opened every 2^PingPeriodicity seconds, 0 to 7
+	PingPeriodicity uint8
+
+	// Class B time synchronization, by DeviceTimeAns or beacons
+	gpsOffset  time.Duration // GPS time minus the GPS time of the device clock
+	timeSynced bool
+	lastBeacon uint32 // GPS time of the last beacon received, 0 if none
+}
+
+// fNwkSIntKey returns the key of the uplink MIC computed over B0
+func (s *Session) fNwkSIntKey() [16]uint8 {
+	if s.Version == Version11 {
+		return s.FNwkSIntKey
+	}
+	return s.NwkSKey
+}
+
+// sNwkSIntKey returns the key of the downlink MIC
+func (s *Session) sNwkSIntKey() [16]uint8 {
+	if s.Version == Version11 {
+		return s.SNwkSIntKey
+	}
+	return s.NwkSKey
+}
+
+// nwkSEncKey returns the key encrypting MAC commands
+func (s *Session) nwkSEncKey() [16]uint8 {
+	if s.Version == Version11 {
+		return s.NwkSEncKey
+	}
+	return s.NwkSKey
 }
 
 // SetDevAddr configures the Session DevAddr
@@ -67,71 +163,20 @@ func (s *Session) GetAppSKey() string {
 	return hex.EncodeToString(s.AppSKey[:])
 }
 
-// GenMessage generates an uplink message.
+// GenMessage generates an uplink message on FPort 1. With dir 1 it generates
+// the downlink a network server would send, signed with SNwkSIntKey and
+// counted on AFCntDown for a LoRaWAN 1.1 session, FCntUp is left unchanged.
 func (s *Session) GenMessage(dir uint8, payload []uint8) ([]uint8, error) {
-	var buf []uint8
-	buf = append(buf, 0b01000000) // FHDR Unconfirmed up
-	buf = append(buf, s.DevAddr[:]...)
-
-	// FCtl : No ADR, No RFU, No ACK, No FPending, No FOpt
-	buf = append(buf, 0x00)
-
-	// FCnt Up
-	buf = append(buf, uint8(s.FCntUp&0xFF), uint8((s.FCntUp>>8)&0xFF))
-
-	// FPort=1
-	buf = append(buf, 0x01)
-
-	fCnt := uint32(0)
-	if dir == 0 {
-		fCnt = s.FCntUp
-		s.FCntUp++
-	} else {
-		fCnt = s.FCntDown
-	}
-	data, err := s.genFRMPayload(dir, fCnt, payload, false)
-	if err != nil {
-		return nil, err
-	}
-	buf = append(buf, data[:]...)
-
-	mic := calcMessageMIC(buf, s.NwkSKey, dir, s.DevAddr[:], fCnt, uint8(len(buf)))
-	buf = append(buf, mic[:]...)
-
-	return buf, nil
+	return s.genMessage(dir, &Uplink{FPort: 1, Payload: payload})
 }
 
-func (s *Session) genFRMPayload(dir uint8, fCnt uint32, payload []byte, isFOpts bool) ([]byte, error) {
-	k := len(payload) / aes.BlockSize
-	if len(payload)%aes.BlockSize != 0 {
-		k++
-	}
-	if k > math.MaxUint8 {
-		return nil, ErrFrmPayloadTooLarge
-	}
-	encrypted := make([]byte, 0, k*16)
-	cipher, err := aes.NewCipher(s.AppSKey[:])
-	if err != nil {
-		panic(err)
-	}
+// GenConfirmedMessage generates a confirmed uplink message, the network server
+// must acknowledge it in a downlink.
+func (s *Session) GenConfirmedMessage(payload []uint8) ([]uint8, error) {
+	return s.genMessage(0, &Uplink{Confirmed: true, FPort: 1, Payload: payload})
+}
 
-	var a [aes.BlockSize]byte
-	a[0] = 0x01
-	a[5] = dir
-	copy(a[6:10], s.DevAddr[:])
-	binary.LittleEndian.PutUint32(a[10:14], fCnt)
-	var ss [aes.BlockSize]byte
-	var b [aes.BlockSize]byte
-	for i := uint8(0); i < uint8(k); i++ {
-		copy(b[:], payload[i*aes.BlockSize:])
-		if !isFOpts {
-			a[15] = i + 1
-		}
-		cipher.Encrypt(ss[:], a[:])
-		for j := 0; j < aes.BlockSize; j++ {
-			b[j] = b[j] ^ ss[j]
-		}
-		encrypted = append(encrypted, b[:]...)
-	}
-	return encrypted[:len(payload)], nil
+// genFRMPayload encrypts or decrypts payload using the given session key
+func (s *Session) genFRMPayload(key [16]uint8, dir uint8, fCnt uint32, payload []byte, isFOpts bool) ([]byte, error) {
+	return cryptPayload(key, dir, s.DevAddr, fCnt, payload, isFOpts)
 }
@@ -239,6 +239,31 @@ func TestGenMessageUplink(t *testing.T) {
 	}
 }
 
+func TestGenConfirmedMessage(t *testing.T) {
+	s := &Session{
+		NwkSKey: [16]uint8{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
+		AppSKey: [16]uint8{0xA1, 0xA2, 0xA3, 0xA4, 0xA5, 0xA6, 0xA7, 0xA8, 0xA9, 0xAA, 0xAB, 0xAC, 0xAD, 0xAE, 0xAF, 0xB0},
+		DevAddr: [4]uint8{0xDE, 0xAD, 0xBE, 0xEF},
+		FCntUp:  7,
+	}
+
+	msg, err := s.GenConfirmedMessage([]uint8{0x01})
+	if err != nil {
+		t.Fatalf("GenConfirmedMessage() error = %v", err)
+	}
+
+	// Check MHDR (first byte should be 0x80 for confirmed uplink)
+	if msg[0] != 0x80 {
+		t.Errorf("MHDR = 0x%02X, want 0x80", msg[0])
+	}
+	if msg[6] != 7 || msg[7] != 0 {
+		t.Errorf("FCnt = 0x%02X%02X, want 0x0007", msg[7], msg[6])
+	}
+	if s.FCntUp != 8 {
+		t.Errorf("FCntUp = %d, want 8", s.FCntUp)
+	}
+}
+
 func TestGenMessageIncrementsFCntUp(t *testing.T) {
 	s := &Session{
 		NwkSKey: [16]uint8{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
@@ -0,0 +1,97 @@
+package lorawan
+
+import (
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+// Stack is a LoRaWAN end-device: it owns the radio, the regional settings,
+// the OTAA and session state and the duty cycle timings of one device.
+// Several stacks, on different radios, can be used at the same time.
+//
+// The package level functions, such as Join and SendUplink, use the Stack
+// returned by DefaultStack.
+type Stack struct {
+	Radio   lora.Radio
+	Region  region.Settings
+	Store   Store // persists nonces and frame counters, nil disables persistence
+	Otaa    *Otaa
+	Session *Session
+
+	// Transmissions of a confirmed uplink without ACK
+	Retries int
+
+	// end of the aggregated duty cycle off time set by DutyCycleReq
+	aggregatedAvailableAt time.Time
+
+	// first join request since the last successful join, and end of the
+	// join requests back-off off time
+	joinStart       time.Time
+	joinAvailableAt time.Time
+}
+
+// NewStack returns a Stack sending on radio with the regional settings rs,
+// with an empty OTAA and session state
+func NewStack(radio lora.Radio, rs region.Settings) *Stack {
+	return &Stack{
+		Radio:   radio,
+		Region:  rs,
+		Otaa:    &Otaa{},
+		Session: &Session{},
+		Retries: DEFAULT_RETRIES,
+	}
+}
+
+// SetPublicNetwork defines Lora Sync Word according to network type (public/private)
+func (st *Stack) SetPublicNetwork(enabled bool) {
+	st.Radio.SetPublicNetwork(enabled)
+}
+
+// Join activates the session of the stack with its OTAA state, see Join
+func (st *Stack) Join() error {
+	return st.join(st.Otaa, st.Session)
+}
+
+// SendUplink sends data on FPort 1, see SendUplink
+func (st *Stack) SendUplink(data []uint8) error {
+	return st.sendUplinkMessage(&Uplink{FPort: 1, Payload: data}, st.Session)
+}
+
+// SendUplinkMessage sends an uplink message built from u, see SendUplinkMessage
+func (st *Stack) SendUplinkMessage(u *Uplink) error {
+	return st.sendUplinkMessage(u, st.Session)
+}
+
+// SendConfirmedUplink sends data on FPort 1 and waits for the ACK, see
+// SendConfirmedUplinkMessage
+func (st *Stack) SendConfirmedUplink(data []uint8) (*Downlink, error) {
+	return st.sendConfirmedUplinkMessage(&Uplink{FPort: 1, Payload: data}, st.Session)
+}
+
+// SendConfirmedUplinkMessage sends u as a confirmed uplink message and waits
+// for the ACK, see SendConfirmedUplinkMessage
+func (st *Stack) SendConfirmedUplinkMessage(u *Uplink) (*Downlink, error) {
+	return st.sendConfirmedUplinkMessage(u, st.Session)
+}
+
+// ListenDownlink opens the receive windows of the last uplink, see ListenDownlink
+func (st *Stack) ListenDownlink() (*Downlink, error) {
+	return st.listenDownlink(st.Session)
+}
+
+// ListenClassC listens for downlinks as a Class C device, see ListenClassC
+func (st *Stack) ListenClassC(duration time.Duration, handler func(*Downlink)) error {
+	return st.listenClassC(st.Session, duration, handler)
+}
+
+// AcquireBeacon waits for the next Class B beacon, see AcquireBeacon
+func (st *Stack) AcquireBeacon() (*Beacon, error) {
+	return st.acquireBeacon(st.Session)
+}
+
+// ListenClassB opens the Class B ping slots, see ListenClassB
+func (st *Stack) ListenClassB(duration time.Duration, handler func(*Downlink)) error {
+	return st.listenClassB(st.Session, duration, handler)
+}
@@ -0,0 +1,55 @@
+package lorawan
+
+import (
+	"testing"
+
+	"tinygo.org/x/wireless/lora/lorawan/region"
+)
+
+func TestNewStack(t *testing.T) {
+	radio := &mockRadio{}
+	rs := region.EU868()
+	st := NewStack(radio, rs)
+
+	if st.Radio != radio || st.Region != rs {
+		t.Error("NewStack() did not attach the radio and region")
+	}
+	if st.Otaa == nil || st.Session == nil || st.Session.Activated() {
+		t.Error("NewStack() session is not empty")
+	}
+	if st.Retries != DEFAULT_RETRIES {
+		t.Errorf("Retries = %d, want %d", st.Retries, DEFAULT_RETRIES)
+	}
+}
+
+func TestStacksAreIndependent(t *testing.T) {
+	t.Parallel()
+
+	radio1, radio2 := &mockRadio{}, &mockRadio{}
+	st1 := NewStack(radio1, &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}})
+	st2 := NewStack(radio2, &mockSettings{uplinkCh: &mockChannel{frequency: 868300000}})
+	st1.Session = testDownlinkSession()
+	st2.Session = testDownlinkSession()
+	st2.Session.MaxDutyCycle = 15
+
+	if err := st2.SendUplink([]uint8("two")); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	// the aggregated duty cycle of st2 does not block st1
+	if err := st1.SendUplink([]uint8("one")); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+	if err := st2.SendUplink([]uint8("two")); err == nil {
+		t.Error("SendUplink() on st2 not limited by its duty cycle")
+	}
+
+	if radio1.frequency != 868100000 || radio1.txCount != 1 {
+		t.Errorf("radio1 sent %d frames on %d, want 1 on 868100000", radio1.txCount, radio1.frequency)
+	}
+	if radio2.frequency != 868300000 || radio2.txCount != 1 {
+		t.Errorf("radio2 sent %d frames on %d, want 1 on 868300000", radio2.txCount, radio2.frequency)
+	}
+	if st1.Session.FCntUp != 1 || st2.Session.FCntUp != 1 {
+		t.Errorf("FCntUp = %d and %d, want 1 and 1", st1.Session.FCntUp, st2.Session.FCntUp)
+	}
+}
@@ -0,0 +1,184 @@
+package lorawan
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Store persists the state that must survive a device reset: the DevNonce
+// and JoinNonce of the join procedure, which must never be reused, and the
+// session with its frame counters.
+// Join and SendUplink save the state to the store attached with UseStore,
+// or to Stack.Store, before each transmission.
+type Store interface {
+	LoadNonces(o *Otaa) error
+	SaveNonces(o *Otaa) error
+	LoadSession(s *Session) error
+	SaveSession(s *Session) error
+}
+
+const (
+	nonceStateLen   = 6
+	sessionStateVer = 1
+	sessionStateLen = 127
+)
+
+// MarshalNonces returns the DevNonce and JoinNonce state of the device
+func (o *Otaa) MarshalNonces() []uint8 {
+	b := make([]uint8, 0, nonceStateLen)
+	b = append(b, o.devNonce[:]...)
+	return binary.LittleEndian.AppendUint32(b, o.minJoinNonce)
+}
+
+// UnmarshalNonces restores the DevNonce and JoinNonce state saved by MarshalNonces
+func (o *Otaa) UnmarshalNonces(b []uint8) error {
+	if len(b) != nonceStateLen {
+		return ErrInvalidStoredState
+	}
+	copy(o.devNonce[:], b[0:2])
+	o.minJoinNonce = binary.LittleEndian.Uint32(b[2:6])
+	return nil
+}
+
+// MarshalBinary returns the session keys, frame counters and network server
+// settings
+func (s *Session) MarshalBinary() ([]byte, error) {
+	b := make([]uint8, 0, sessionStateLen)
+	b = append(b, sessionStateVer, s.Activation, s.Version)
+	b = append(b, s.DevAddr[:]...)
+	b = append(b, s.NwkSKey[:]...)
+	b = append(b, s.AppSKey[:]...)
+	b = append(b, s.FNwkSIntKey[:]...)
+	b = append(b, s.SNwkSIntKey[:]...)
+	b = append(b, s.NwkSEncKey[:]...)
+	b = binary.LittleEndian.AppendUint32(b, s.FCntUp)
+	b = binary.LittleEndian.AppendUint32(b, s.FCntDown)
+	b = binary.LittleEndian.AppendUint32(b, s.AFCntDown)
+	b = binary.LittleEndian.AppendUint32(b, s.NFCntDown)
+	b = append(b, s.CFList[:]...)
+	b = append(b, s.RXDelay, s.DLSettings, s.MaxDutyCycle)
+	b = binary.LittleEndian.AppendUint32(b, s.RX2Frequency)
+	var flags uint8
+	if s.ADR {
+		flags |= 0x01
+	}
+	if s.rekeyInd {
+		flags |= 0x02
+	}
+	b = append(b, flags)
+	return b, nil
+}
+
+// UnmarshalBinary restores a session saved by MarshalBinary
+func (s *Session) UnmarshalBinary(b []byte) error {
+	if len(b) != sessionStateLen || b[0] != sessionStateVer {
+		return ErrInvalidStoredState
+	}
+	s.Activation, s.Version = b[1], b[2]
+	b = b[3:]
+	b = b[copy(s.DevAddr[:], b):]
+	b = b[copy(s.NwkSKey[:], b):]
+	b = b[copy(s.AppSKey[:], b):]
+	b = b[copy(s.FNwkSIntKey[:], b):]
+	b = b[copy(s.SNwkSIntKey[:], b):]
+	b = b[copy(s.NwkSEncKey[:], b):]
+	s.FCntUp = binary.LittleEndian.Uint32(b[0:])
+	s.FCntDown = binary.LittleEndian.Uint32(b[4:])
+	s.AFCntDown = binary.LittleEndian.Uint32(b[8:])
+	s.NFCntDown = binary.LittleEndian.Uint32(b[12:])
+	b = b[16:]
+	b = b[copy(s.CFList[:], b):]
+	s.RXDelay, s.DLSettings, s.MaxDutyCycle = b[0], b[1], b[2]
+	s.RX2Frequency = binary.LittleEndian.Uint32(b[3:])
+	s.ADR = b[7]&0x01 != 0
+	s.rekeyInd = b[7]&0x02 != 0
+	return nil
+}
+
+// MemoryStore keeps the state in RAM, it does not survive a reset but can
+// back a state copied to and from another memory (e.g. an EEPROM).
+type MemoryStore struct {
+	Nonces  []uint8
+	Session []uint8
+}
+
+func (m *MemoryStore) LoadNonces(o *Otaa) error {
+	if m.Nonces == nil {
+		return ErrNoStoredState
+	}
+	return o.UnmarshalNonces(m.Nonces)
+}
+
+func (m *MemoryStore) SaveNonces(o *Otaa) error {
+	m.Nonces = o.MarshalNonces()
+	return nil
+}
+
+func (m *MemoryStore) LoadSession(s *Session) error {
+	if m.Session == nil {
+		return ErrNoStoredState
+	}
+	return s.UnmarshalBinary(m.Session)
+}
+
+func (m *MemoryStore) SaveSession(s *Session) error {
+	b, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	m.Session = b
+	return nil
+}
+
+// FileStore keeps the state in the "nonces" and "session" files of Dir
+type FileStore struct {
+	Dir string
+}
+
+func (f *FileStore) LoadNonces(o *Otaa) error {
+	b, err := f.read("nonces")
+	if err != nil {
+		return err
+	}
+	return o.UnmarshalNonces(b)
+}
+
+func (f *FileStore) SaveNonces(o *Otaa) error {
+	return f.write("nonces", o.MarshalNonces())
+}
+
+func (f *FileStore) LoadSession(s *Session) error {
+	b, err := f.read("session")
+	if err != nil {
+		return err
+	}
+	return s.UnmarshalBinary(b)
+}
+
+func (f *FileStore) SaveSession(s *Session) error {
+	b, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return f.write("session", b)
+}
+
+func (f *FileStore) read(name string) ([]uint8, error) {
+	b, err := os.ReadFile(filepath.Join(f.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoStoredState
+	}
+	return b, err
+}
+
+// write replaces the file atomically, a reset while writing must not lose
+// the previous state
+func (f *FileStore) write(name string, b []uint8) error {
+	path := filepath.Join(f.Dir, name)
+	if err := os.WriteFile(path+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,146 @@
+package lorawan
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSessionMarshalBinary(t *testing.T) {
+	s := testSession11()
+	s.Activation = ActivationOTAA
+	s.FCntUp = 0x01020304
+	s.AFCntDown = 17
+	s.NFCntDown = 3
+	s.RX2Frequency = 869525000
+	s.ADR = true
+	s.rekeyInd = true
+	s.CFList[0] = 0x18
+
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+	if len(b) != sessionStateLen {
+		t.Fatalf("len = %d, want %d", len(b), sessionStateLen)
+	}
+
+	got := &Session{}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if got.DevAddr != s.DevAddr || got.AppSKey != s.AppSKey || got.FNwkSIntKey != s.FNwkSIntKey ||
+		got.SNwkSIntKey != s.SNwkSIntKey || got.NwkSEncKey != s.NwkSEncKey {
+		t.Error("keys not restored")
+	}
+	if got.FCntUp != s.FCntUp || got.AFCntDown != 17 || got.NFCntDown != 3 {
+		t.Errorf("counters = %d/%d/%d, want %d/17/3", got.FCntUp, got.AFCntDown, got.NFCntDown, s.FCntUp)
+	}
+	if got.Activation != ActivationOTAA || got.Version != Version11 || !got.ADR || !got.rekeyInd ||
+		got.RX2Frequency != 869525000 || got.CFList != s.CFList {
+		t.Errorf("session = %+v, want %+v", got, s)
+	}
+
+	if err := got.UnmarshalBinary(b[1:]); err != ErrInvalidStoredState {
+		t.Errorf("UnmarshalBinary() truncated error = %v, want %v", err, ErrInvalidStoredState)
+	}
+}
+
+func testStore(t *testing.T, st Store) {
+	if err := st.LoadSession(&Session{}); err != ErrNoStoredState {
+		t.Errorf("LoadSession() empty error = %v, want %v", err, ErrNoStoredState)
+	}
+	if err := st.LoadNonces(&Otaa{}); err != ErrNoStoredState {
+		t.Errorf("LoadNonces() empty error = %v, want %v", err, ErrNoStoredState)
+	}
+
+	o := testOtaa()
+	o.devNonce = [2]uint8{0x34, 0x12}
+	o.minJoinNonce = 9
+	if err := st.SaveNonces(o); err != nil {
+		t.Fatalf("SaveNonces() error = %v", err)
+	}
+	restored := testOtaa()
+	if err := st.LoadNonces(restored); err != nil {
+		t.Fatalf("LoadNonces() error = %v", err)
+	}
+	if restored.devNonce != o.devNonce || restored.minJoinNonce != 9 {
+		t.Errorf("nonces = %x/%d, want %x/9", restored.devNonce, restored.minJoinNonce, o.devNonce)
+	}
+
+	s := testDownlinkSession()
+	s.FCntUp = 1000
+	if err := st.SaveSession(s); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+	got := &Session{}
+	if err := st.LoadSession(got); err != nil {
+		t.Fatalf("LoadSession() error = %v", err)
+	}
+	if got.FCntUp != 1000 || got.NwkSKey != s.NwkSKey {
+		t.Errorf("FCntUp = %d, want 1000", got.FCntUp)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, &MemoryStore{})
+}
+
+func TestFileStore(t *testing.T) {
+	testStore(t, &FileStore{Dir: t.TempDir()})
+}
+
+func TestSendUplinkSavesSession(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	st := &MemoryStore{}
+	defaultStack.Radio = &mockRadio{}
+	defaultStack.Region = &mockSettings{uplinkCh: &mockChannel{frequency: 868100000}}
+	UseStore(st)
+
+	s := testDownlinkSession()
+	s.FCntUp = 41
+	if err := SendUplink([]byte("test"), s); err != nil {
+		t.Fatalf("SendUplink() error = %v", err)
+	}
+
+	// After a reset, an ABP device restores its counters before activation
+	restored := &Session{}
+	if err := st.LoadSession(restored); err != nil {
+		t.Fatalf("LoadSession() error = %v", err)
+	}
+	abp := &Abp{DevAddr: s.DevAddr, NwkSKey: s.NwkSKey, AppSKey: s.AppSKey}
+	if err := abp.Activate(restored); err != nil {
+		t.Fatalf("Activate() error = %v", err)
+	}
+	if restored.FCntUp != 42 {
+		t.Errorf("restored FCntUp = %d, want 42", restored.FCntUp)
+	}
+}
+
+func TestJoinContinuesStoredDevNonce(t *testing.T) {
+	resetGlobalState()
+	defer resetGlobalState()
+
+	st := &MemoryStore{}
+	defaultStack.Radio = &mockRadio{}
+	defaultStack.Region = &mockSettings{
+		joinRequestCh: &mockChannel{frequency: 868100000},
+		joinAcceptCh:  &mockChannel{frequency: 868100000},
+	}
+	UseStore(st)
+
+	o := testOtaa()
+	o.devNonce = [2]uint8{0xFF, 0x00}
+	st.SaveNonces(o)
+
+	// No join accept is received, the DevNonce sent must still be saved
+	if err := Join(testOtaa(), &Session{}); !errors.Is(err, ErrNoJoinAcceptReceived) {
+		t.Fatalf("Join() error = %v, want %v", err, ErrNoJoinAcceptReceived)
+	}
+	restored := &Otaa{}
+	st.LoadNonces(restored)
+	if restored.devNonce != [2]uint8{0x00, 0x01} {
+		t.Errorf("stored DevNonce = %x, want 0001", restored.devNonce)
+	}
+}
@@ -0,0 +1,211 @@
+package lorawan
+
+import "math"
+
+// FCtrl bits of an uplink frame
+const (
+	fCtrlUpADR       = 0x80
+	fCtrlUpADRACKReq = 0x40
+	fCtrlUpACK       = 0x20
+	fCtrlUpClassB    = 0x10
+)
+
+const (
+	// FOptsMaxLen is the maximum size of MAC commands carried in FOpts
+	FOptsMaxLen = 15
+)
+
+// Uplink describes a data up message built by Session.GenUplink
+type Uplink struct {
+	Confirmed bool    // Confirmed data up, the network server must acknowledge it
+	ADR       bool    // Device accepts ADR control from the network server
+	ADRACKReq bool    // Request a downlink to validate ADR settings
+	ACK       bool    // Acknowledge the last confirmed downlink
+	FOpts     []uint8 // MAC commands piggybacked in the frame header
+	FPort     uint8   // 0 is reserved to MAC commands, 1..223 are application ports
+	Payload   []uint8 // FRMPayload, sent in clear, encrypted by GenUplink
+
+	// Data rate and channel index of the transmission, part of the
+	// LoRaWAN 1.1 MIC
+	DataRate uint8
+	Channel  uint8
+
+	// MaxPayload is the maximum size of FOpts and Payload at the data rate,
+	// 0 for no limit
+	MaxPayload int
+}
+
+// GenUplink generates an uplink message with the given FPort, FCtrl flags
+// and FOpts. Answers to the network server MAC commands are appended to
+// FOpts. FOpts are sent in clear, FRMPayload is encrypted with AppSKey
+// (or NwkSKey on FPort 0). LoRaWAN 1.1 sessions encrypt FOpts with
+// NwkSEncKey, use it in place of NwkSKey and compute the MIC with
+// FNwkSIntKey and SNwkSIntKey.
+// When both FPort and Payload are zero the message carries no FPort.
+func (s *Session) GenUplink(u *Uplink) ([]uint8, error) {
+	return s.genMessage(0, u)
+}
+
+func (s *Session) genMessage(dir uint8, u *Uplink) ([]uint8, error) {
+	if len(u.FOpts) > FOptsMaxLen {
+		return nil, ErrFOptsTooLarge
+	}
+	if u.MaxPayload > 0 && len(u.FOpts)+len(u.Payload) > u.MaxPayload {
+		return nil, ErrFrmPayloadTooLarge
+	}
+	// A frame counter value cannot be reused, the device must rejoin
+	if dir == 0 && s.FCntUp == math.MaxUint32 {
+		return nil, ErrFCntUpExhausted
+	}
+	// MAC commands are either in FOpts or in FRMPayload on FPort 0
+	if u.FPort == 0 && len(u.FOpts) > 0 && len(u.Payload) > 0 {
+		return nil, ErrInvalidFPort
+	}
+
+	// Queued MAC commands answers go in FOpts when there is room for them,
+	// or in the FRMPayload of a MAC only uplink on FPort 0
+	fOpts := u.FOpts
+	payload := u.Payload
+	macSent := false
+	if mac := s.macAnswers(); dir == 0 && len(mac) > 0 {
+		switch {
+		case (u.FPort != 0 || len(u.Payload) == 0) && len(fOpts)+len(mac) <= FOptsMaxLen &&
+			(u.MaxPayload == 0 || len(fOpts)+len(mac)+len(u.Payload) <= u.MaxPayload):
+			fOpts = append(append([]uint8{}, fOpts...), mac...)
+			macSent = true
+		case u.FPort == 0 && len(u.Payload) == 0 && len(fOpts) == 0 &&
+			(u.MaxPayload == 0 || len(mac) <= u.MaxPayload):
+			payload = mac
+			macSent = true
+		}
+	}
+
+	// dir 1 builds the data down frame a network server would send
+	mType := uint8(MTypeUnconfirmedDataUp)
+	if u.Confirmed {
+		mType = MTypeConfirmedDataUp
+	}
+	fCnt := s.FCntUp
+	if dir != 0 {
+		mType++
+		fCnt = s.FCntDown
+		// LoRaWAN 1.1 counts application and MAC commands downlinks apart
+		if s.Version == Version11 {
+			fCnt = s.NFCntDown
+			if u.FPort != 0 {
+				fCnt = s.AFCntDown
+			}
+		}
+	}
+
+	mac := &MACPayload{
+		FHDR: FHDR{
+			DevAddr: s.DevAddr,
+			FCtrl: FCtrl{
+				ADR:       u.ADR,
+				ADRACKReq: u.ADRACKReq,
+				ACK:       u.ACK || s.pendingACK,
+				FPending:  dir == 0 && s.Class == ClassB,
+			},
+			FCnt:  fCnt,
+			FOpts: fOpts,
+		},
+	}
+	if u.FPort != 0 || len(payload) > 0 {
+		fPort := u.FPort
+		mac.FPort = &fPort
+		mac.FRMPayload = payload
+	}
+	p := &PHYPayload{MType: mType, MACPayload: mac}
+
+	// FOpts are sent in clear by LoRaWAN 1.0
+	if s.Version == Version11 {
+		if err := p.EncryptFOpts(s.NwkSEncKey); err != nil {
+			return nil, err
+		}
+	}
+	key := s.AppSKey
+	if u.FPort == 0 {
+		key = s.nwkSEncKey()
+	}
+	if err := p.EncryptFRMPayload(key); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch {
+	case dir != 0:
+		// Downlinks are signed with SNwkSIntKey, a LoRaWAN 1.1 ACK with
+		// the counter of the confirmed uplink
+		confFCnt := uint16(0)
+		if s.Version == Version11 && mac.FHDR.FCtrl.ACK {
+			confFCnt = uint16(s.confFCntUp)
+		}
+		err = p.SetDataMIC(s.sNwkSIntKey(), confFCnt)
+	case s.Version == Version11:
+		confFCnt := uint16(0)
+		if mac.FHDR.FCtrl.ACK {
+			confFCnt = uint16(s.confFCntDown)
+		}
+		err = p.SetUplinkDataMIC11(s.FNwkSIntKey, s.SNwkSIntKey, confFCnt, u.DataRate, u.Channel)
+	default:
+		err = p.SetDataMIC(s.fNwkSIntKey(), 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == 0 {
+		if u.Confirmed {
+			s.confFCntUp = s.FCntUp
+		}
+		s.FCntUp++
+		s.pendingACK = false
+		s.macInFlight = macSent
+	}
+
+	return buf, nil
+}
+
+// UplinkSent tells the session the last uplink it generated was
+// transmitted: the MAC commands answers it carries are dequeued. The stack
+// calls it once the radio Tx succeeded, answers of a frame that was not
+// sent are kept for the next uplink.
+func (s *Session) UplinkSent() {
+	if s.macInFlight {
+		s.pendingMAC = nil
+		s.macInFlight = false
+	}
+}
+
+// macOverflow reports if the queued MAC commands answers are too long for
+// FOpts, they must be sent on FPort 0
+func (s *Session) macOverflow() bool {
+	return len(s.macAnswers()) > FOptsMaxLen
+}
+
+// uplinkMIC11 computes the LoRaWAN 1.1 MIC of the uplink msg
+func (s *Session) uplinkMIC11(msg []uint8, fCnt uint32, txDR uint8, txCh uint8) [4]uint8 {
+	confFCnt := uint16(0)
+	if msg[5]&fCtrlUpACK != 0 {
+		confFCnt = uint16(s.confFCntDown)
+	}
+	return calcUplinkMIC11(msg, s.FNwkSIntKey, s.SNwkSIntKey, confFCnt, txDR, txCh,
+		s.DevAddr[:], fCnt, uint8(len(msg)))
+}
+
+// SignUplink updates the MIC of the last uplink generated by the session for
+// its retransmission with another data rate or channel. Only the LoRaWAN 1.1
+// MIC depends on them, phyPload is unchanged for LoRaWAN 1.0 sessions.
+func (s *Session) SignUplink(phyPload []uint8, txDR uint8, txCh uint8) {
+	if s.Version != Version11 || len(phyPload) < 12 {
+		return
+	}
+	msg := phyPload[:len(phyPload)-4]
+	mic := s.uplinkMIC11(msg, s.FCntUp-1, txDR, txCh)
+	copy(phyPload[len(msg):], mic[:])
+}
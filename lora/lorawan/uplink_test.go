@@ -0,0 +1,218 @@
+package lorawan
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGenUplink(t *testing.T) {
+	s := testDownlinkSession()
+	s.FCntUp = 3
+	fOpts := []uint8{0x02} // LinkCheckReq
+	payload := []uint8{0x01, 0x02, 0x03}
+
+	msg, err := s.GenUplink(&Uplink{ADR: true, ADRACKReq: true, FOpts: fOpts, FPort: 42, Payload: payload})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+
+	if msg[0] != MTypeUnconfirmedDataUp<<5 {
+		t.Errorf("MHDR = 0x%02X, want 0x40", msg[0])
+	}
+	if msg[5] != fCtrlUpADR|fCtrlUpADRACKReq|1 {
+		t.Errorf("FCtrl = 0x%02X, want 0xC1", msg[5])
+	}
+	if msg[6] != 3 || msg[7] != 0 {
+		t.Errorf("FCnt = 0x%02X%02X, want 0x0003", msg[7], msg[6])
+	}
+
+	// LoRaWAN 1.0 FOpts are sent in clear
+	if !bytes.Equal(msg[8:9], fOpts) {
+		t.Errorf("FOpts = %x, want %x", msg[8:9], fOpts)
+	}
+	if msg[9] != 42 {
+		t.Errorf("FPort = %d, want 42", msg[9])
+	}
+	clear, _ := s.genFRMPayload(s.AppSKey, 0, 3, msg[10:13], false)
+	if !bytes.Equal(clear, payload) {
+		t.Errorf("decrypted FRMPayload = %x, want %x", clear, payload)
+	}
+
+	mic := calcMessageMIC(msg[:13], s.NwkSKey, 0, s.DevAddr[:], 3, 13)
+	if !bytes.Equal(mic[:], msg[13:]) {
+		t.Errorf("MIC = %x, want %x", msg[13:], mic)
+	}
+	if s.FCntUp != 4 {
+		t.Errorf("FCntUp = %d, want 4", s.FCntUp)
+	}
+}
+
+func TestGenUplinkFOptsVector(t *testing.T) {
+	s := &Session{
+		DevAddr: [4]uint8{0xF1, 0x7D, 0xBE, 0x49},
+		NwkSKey: [16]uint8{0x44, 0x02, 0x42, 0x41, 0xED, 0x4C, 0xE9, 0xA6, 0x8C, 0x6A, 0x8B, 0xC0, 0x55, 0x23, 0x3F, 0xD3},
+		AppSKey: [16]uint8{0xEC, 0x92, 0x58, 0x02, 0xAE, 0x43, 0x0C, 0xA7, 0x7F, 0xD3, 0xDD, 0x73, 0xCB, 0x2C, 0xC5, 0x88},
+		FCntUp:  2,
+	}
+	// LoRaWAN 1.0 LinkCheckReq in clear FOpts, "test" on FPort 1
+	want := []uint8{0x40, 0xF1, 0x7D, 0xBE, 0x49, 0x01, 0x02, 0x00, 0x02, 0x01,
+		0x95, 0x43, 0x78, 0x76, 0x38, 0xF9, 0xD4, 0xDB}
+
+	msg, err := s.GenUplink(&Uplink{FOpts: []uint8{CIDLinkCheck}, FPort: 1, Payload: []uint8("test")})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	if !bytes.Equal(msg, want) {
+		t.Errorf("GenUplink() = % X, want % X", msg, want)
+	}
+}
+
+func TestGenUplinkFPort0UsesNwkSKey(t *testing.T) {
+	s := testDownlinkSession()
+	payload := []uint8{0x02}
+
+	msg, err := s.GenUplink(&Uplink{FPort: 0, Payload: payload})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	if msg[8] != 0 {
+		t.Errorf("FPort = %d, want 0", msg[8])
+	}
+	clear, _ := s.genFRMPayload(s.NwkSKey, 0, 0, msg[9:10], false)
+	if !bytes.Equal(clear, payload) {
+		t.Errorf("decrypted FRMPayload = %x, want %x", clear, payload)
+	}
+}
+
+func TestGenUplinkWithoutFPort(t *testing.T) {
+	s := testDownlinkSession()
+
+	msg, err := s.GenUplink(&Uplink{ACK: true})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	// MHDR(1) + DevAddr(4) + FCtrl(1) + FCnt(2) + MIC(4)
+	if len(msg) != 12 {
+		t.Errorf("message length = %d, want 12", len(msg))
+	}
+	if msg[5] != fCtrlUpACK {
+		t.Errorf("FCtrl = 0x%02X, want 0x20", msg[5])
+	}
+}
+
+func TestGenUplinkErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		uplink  Uplink
+		wantErr error
+	}{
+		{"FOpts too large", Uplink{FPort: 1, FOpts: make([]uint8, 16)}, ErrFOptsTooLarge},
+		{"MAC commands in FOpts and FPort 0", Uplink{FPort: 0, FOpts: []uint8{0x02}, Payload: []uint8{0x02}}, ErrInvalidFPort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testDownlinkSession()
+			_, err := s.GenUplink(&tt.uplink)
+			if err != tt.wantErr {
+				t.Errorf("GenUplink() error = %v, want %v", err, tt.wantErr)
+			}
+			if s.FCntUp != 0 {
+				t.Errorf("FCntUp = %d, want 0", s.FCntUp)
+			}
+		})
+	}
+}
+
+func testSession11() *Session {
+	s := testDownlinkSession()
+	s.Version = Version11
+	s.NwkSKey = [16]uint8{}
+	s.FNwkSIntKey = [16]uint8{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F, 0x20}
+	s.SNwkSIntKey = [16]uint8{0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29, 0x2A, 0x2B, 0x2C, 0x2D, 0x2E, 0x2F, 0x30}
+	s.NwkSEncKey = [16]uint8{0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3A, 0x3B, 0x3C, 0x3D, 0x3E, 0x3F, 0x40}
+	return s
+}
+
+func TestGenUplink11(t *testing.T) {
+	s := testSession11()
+	s.FCntUp = 7
+	fOpts := []uint8{0x02}
+
+	msg, err := s.GenUplink(&Uplink{FOpts: fOpts, FPort: 1, Payload: []uint8{0xAA}, DataRate: 5, Channel: 2})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+
+	clear, _ := s.genFRMPayload(s.NwkSEncKey, 0, 7, msg[8:9], true)
+	if !bytes.Equal(clear, fOpts) {
+		t.Errorf("FOpts = %x, want %x encrypted with NwkSEncKey", clear, fOpts)
+	}
+
+	n := len(msg) - 4
+	cmacS := genPayloadMIC(append(micBlock(0, 5, 2, 0, s.DevAddr[:], 7, uint8(n)), msg[:n]...), s.SNwkSIntKey)
+	cmacF := genPayloadMIC(append(micBlock(0, 0, 0, 0, s.DevAddr[:], 7, uint8(n)), msg[:n]...), s.FNwkSIntKey)
+	want := []uint8{cmacS[0], cmacS[1], cmacF[0], cmacF[1]}
+	if !bytes.Equal(msg[n:], want) {
+		t.Errorf("MIC = %x, want %x", msg[n:], want)
+	}
+
+	// A retransmission on another channel changes the SNwkSIntKey half only
+	retry := append([]uint8{}, msg...)
+	s.SignUplink(retry, 5, 3)
+	if bytes.Equal(retry[n:n+2], msg[n:n+2]) || !bytes.Equal(retry[n+2:], msg[n+2:]) {
+		t.Errorf("retransmission MIC = %x, first MIC = %x", retry[n:], msg[n:])
+	}
+}
+
+func TestSignUplink10(t *testing.T) {
+	s := testDownlinkSession()
+	msg, _ := s.GenUplink(&Uplink{FPort: 1, Payload: []uint8{0xAA}})
+	retry := append([]uint8{}, msg...)
+
+	s.SignUplink(retry, 1, 3)
+	if !bytes.Equal(retry, msg) {
+		t.Errorf("SignUplink() changed a LoRaWAN 1.0 uplink: %x, want %x", retry, msg)
+	}
+}
+
+func TestGenUplinkFCntUpExhausted(t *testing.T) {
+	s := testDownlinkSession()
+	s.FCntUp = 0xFFFFFFFE
+
+	msg, err := s.GenUplink(&Uplink{FPort: 1})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	if msg[6] != 0xFE || msg[7] != 0xFF {
+		t.Errorf("FCnt = 0x%02X%02X, want 0xFFFE", msg[7], msg[6])
+	}
+
+	if _, err := s.GenUplink(&Uplink{FPort: 1}); err != ErrFCntUpExhausted {
+		t.Errorf("GenUplink() error = %v, want %v", err, ErrFCntUpExhausted)
+	}
+	if s.FCntUp != 0xFFFFFFFF {
+		t.Errorf("FCntUp = 0x%08X, want unchanged 0xFFFFFFFF", s.FCntUp)
+	}
+}
+
+func TestGenUplinkMaxPayload(t *testing.T) {
+	s := testDownlinkSession()
+	s.pendingMAC = []uint8{CIDDutyCycle}
+
+	if _, err := s.GenUplink(&Uplink{FPort: 1, Payload: make([]uint8, 12), MaxPayload: 11}); err != ErrFrmPayloadTooLarge {
+		t.Errorf("GenUplink() error = %v, want %v", err, ErrFrmPayloadTooLarge)
+	}
+
+	// MAC answers are kept for the next uplink when there is no room for them
+	msg, err := s.GenUplink(&Uplink{FPort: 1, Payload: make([]uint8, 11), MaxPayload: 11})
+	if err != nil {
+		t.Fatalf("GenUplink() error = %v", err)
+	}
+	if fOptsLen := msg[5] & 0x0F; fOptsLen != 0 {
+		t.Errorf("FOpts length = %d, want 0", fOptsLen)
+	}
+	if got := s.macAnswers(); !bytes.Equal(got, []uint8{CIDDutyCycle}) {
+		t.Errorf("answers = %x, want 04", got)
+	}
+}
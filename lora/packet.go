@@ -0,0 +1,60 @@
+package lora
+
+import "time"
+
+// RxPacket is a received packet with the link quality measured by the radio
+type RxPacket struct {
+	Payload   []uint8
+	RSSI      int16     // in dBm
+	SNR       int8      // in dB
+	FreqError int32     // offset of the transmitter frequency, in Hz
+	Time      time.Time // of the RxDone interrupt, the end of the packet
+}
+
+// PacketRadio is a Radio reporting the link quality of the packets it
+// receives. RxPacket returns a nil packet, with a nil error or
+// ErrRxTimeout, when nothing was received.
+type PacketRadio interface {
+	Radio
+	RxPacket(timeoutMs uint32) (*RxPacket, error)
+}
+
+// Receive listens with r for timeoutMs and returns the packet received
+// with its metadata, from RxPacket, the RxDone event or, for radios only
+// implementing Rx, without link quality and timestamped on return.
+func Receive(r Radio, timeoutMs uint32) (*RxPacket, error) {
+	switch r := r.(type) {
+	case AsyncRadio:
+		return AsyncReceive(r, timeoutMs)
+	case PacketRadio:
+		return r.RxPacket(timeoutMs)
+	}
+	pkt, err := r.Rx(timeoutMs)
+	if err != nil || pkt == nil {
+		return nil, err
+	}
+	return &RxPacket{Payload: pkt, Time: time.Now()}, nil
+}
+
+// AsyncReceive is AsyncRx returning the metadata the driver sent with the
+// RxDone event, or the packet timestamped on the event if it sent none
+func AsyncReceive(r AsyncRadio, timeoutMs uint32) (*RxPacket, error) {
+	drainEvents(r)
+	if err := r.StartRx(timeoutMs); err != nil {
+		return nil, err
+	}
+	ev := WaitEvent(r, guardTimeout(timeoutMs))
+	if err := EventError(ev, false); err != nil {
+		return nil, err
+	}
+	return ev.RxPacket(), nil
+}
+
+// RxPacket returns the packet received with a RxDone event, with the
+// metadata sent by the driver or timestamped now if it sent none
+func (ev RadioEvent) RxPacket() *RxPacket {
+	if ev.Packet != nil {
+		return ev.Packet
+	}
+	return &RxPacket{Payload: ev.EventData, Time: time.Now()}
+}
@@ -0,0 +1,53 @@
+package lora
+
+import (
+	"testing"
+	"time"
+)
+
+// rxRadio only implements the blocking Rx
+type rxRadio struct {
+	Radio
+	pkt []uint8
+	err error
+}
+
+func (r *rxRadio) Rx(timeoutMs uint32) ([]uint8, error) { return r.pkt, r.err }
+
+// packetRadio reports the link quality of its packets
+type packetRadio struct {
+	rxRadio
+}
+
+func (r *packetRadio) RxPacket(timeoutMs uint32) (*RxPacket, error) {
+	return &RxPacket{Payload: r.pkt, RSSI: -90, SNR: -3, FreqError: 1200}, nil
+}
+
+func TestReceive(t *testing.T) {
+	before := time.Now()
+	pkt, err := Receive(&rxRadio{pkt: []uint8("hello")}, 100)
+	if err != nil || string(pkt.Payload) != "hello" || pkt.Time.Before(before) {
+		t.Errorf("Receive() = %+v, %v, want hello timestamped on return", pkt, err)
+	}
+
+	pkt, err = Receive(&packetRadio{rxRadio{pkt: []uint8("hello")}}, 100)
+	if err != nil || pkt.RSSI != -90 || pkt.SNR != -3 || pkt.FreqError != 1200 {
+		t.Errorf("Receive() = %+v, %v, want the metadata of RxPacket", pkt, err)
+	}
+
+	ev := NewRadioEvent(RadioEventRxDone, 0, []uint8("hello"))
+	ev.Packet = &RxPacket{Payload: ev.EventData, RSSI: -100, SNR: 2}
+	pkt, err = Receive(newAsyncRadio(&ev), 100)
+	if err != nil || pkt.RSSI != -100 || pkt.SNR != 2 {
+		t.Errorf("Receive() = %+v, %v, want the metadata of the RxDone event", pkt, err)
+	}
+}
+
+func TestReceiveNothing(t *testing.T) {
+	if pkt, err := Receive(&rxRadio{}, 100); pkt != nil || err != nil {
+		t.Errorf("Receive() = %+v, %v, want nothing", pkt, err)
+	}
+	if pkt, err := Receive(&rxRadio{err: ErrRxTimeout}, 100); pkt != nil || err != ErrRxTimeout {
+		t.Errorf("Receive() = %+v, %v, want %v", pkt, err, ErrRxTimeout)
+	}
+}
@@ -1,5 +1,20 @@
 package lora
 
+import "errors"
+
+// Errors returned by Radio Tx and Rx for the RadioEventTimeout and
+// RadioEventCrcError events. Drivers may wrap them, callers tell them apart
+// with errors.Is.
+var (
+	ErrTxTimeout = errors.New("radio Tx timeout")
+	ErrRxTimeout = errors.New("radio Rx timeout")
+	ErrCrcError  = errors.New("radio CRC error")
+)
+
+// Radio is a LoRa radio driver. Rx returns a nil packet, with a nil error
+// or ErrRxTimeout, when nothing was received. Drivers able to run Tx and Rx
+// in the background also implement AsyncRadio, drivers measuring the link
+// quality of the packets received PacketRadio.
 type Radio interface {
 	Reset()
 	Tx(pkt []uint8, timeoutMs uint32) error
@@ -14,6 +14,7 @@ type RadioEvent struct {
 	EventType int
 	IRQStatus uint16
 	EventData []byte
+	Packet    *RxPacket // RxDone packet metadata, nil if not measured
 }
 
 // NewRadioEvent() returns a new RadioEvent that can be used in the RadioChannel
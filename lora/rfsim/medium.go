@@ -0,0 +1,287 @@
+package rfsim
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+// Medium is the virtual air shared by simulated radios. It runs on a
+// virtual clock: time only advances when every node started with Run or Go
+// waits in a radio Tx or Rx, or in Sleep, and it jumps to the next event.
+// A simulation gives the same results whatever the speed of the host.
+//
+// A packet is received by the radios listening, when it starts, on the same
+// frequency, spreading factor, bandwidth, sync word and IQ polarity, with a
+// signal to noise ratio above the demodulation floor of the spreading
+// factor. Packets on the same frequency and spreading factor overlapping
+// in time collide: the received one is lost with a CRC error, unless it is
+// CaptureThreshold dB stronger than the others.
+type Medium struct {
+	// PathLoss returns the attenuation in dB between two radios at freq, nil
+	// uses a log-distance model from their positions with PathLossExponent
+	PathLoss         func(from *Radio, to *Radio, freq uint32) float64
+	PathLossExponent float64
+
+	NoiseFigure      float64 // of the receivers, in dB
+	CaptureThreshold float64 // in dB
+
+	mu      sync.Mutex
+	now     time.Duration
+	active  int // nodes running
+	waiters []*waiter
+	txs     []*transmission
+	wg      sync.WaitGroup
+}
+
+// transmission is a packet in the air
+type transmission struct {
+	from       *Radio
+	cfg        lora.Config
+	pkt        []uint8
+	start, end time.Duration
+}
+
+// waiter is a node blocked in Tx, Rx or Sleep until a virtual time
+type waiter struct {
+	radio  *Radio // nil for Sleep
+	rx     bool
+	until  time.Duration // forever if negative
+	locked *transmission // packet being received
+	rssi   float64
+	snr    float64
+
+	pkt  []uint8
+	err  error
+	wake chan struct{}
+}
+
+// NewMedium returns an empty medium at virtual time 0, with a suburban path
+// loss exponent of 2.7, a 6 dB receiver noise figure and a 6 dB capture
+// threshold
+func NewMedium() *Medium {
+	return &Medium{
+		PathLossExponent: 2.7,
+		NoiseFigure:      6,
+		CaptureThreshold: 6,
+	}
+}
+
+// NewRadio adds a radio at position x, y (in meters) to the medium. Its
+// default configuration is 868.1 MHz, SF7, 125 kHz, CR 4/5, 8 symbols
+// preamble, explicit header, CRC on, standard IQ, private sync word and
+// 14 dBm.
+func (m *Medium) NewRadio(x float64, y float64) *Radio {
+	r := &Radio{X: x, Y: y, medium: m}
+	r.Reset()
+	return r
+}
+
+// Now returns the virtual time elapsed since the medium was created
+func (m *Medium) Now() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// Run runs the nodes, functions using the radios of the medium, each in its
+// goroutine, and returns when all of them have returned
+func (m *Medium) Run(nodes ...func()) {
+	m.mu.Lock()
+	m.active += len(nodes)
+	m.mu.Unlock()
+	for _, f := range nodes {
+		m.wg.Add(1)
+		go m.node(f)
+	}
+	m.wg.Wait()
+}
+
+// Go starts another node from a running node, Run returns once it returns
+func (m *Medium) Go(f func()) {
+	m.mu.Lock()
+	m.active++
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go m.node(f)
+}
+
+func (m *Medium) node(f func()) {
+	defer m.wg.Done()
+	f()
+	m.mu.Lock()
+	m.active--
+	m.advance()
+	m.mu.Unlock()
+}
+
+// Sleep blocks the calling node for d of virtual time
+func (m *Medium) Sleep(d time.Duration) {
+	m.mu.Lock()
+	m.block(&waiter{until: m.now + d})
+}
+
+// block waits for w to be woken up, m.mu must be held and is released
+func (m *Medium) block(w *waiter) ([]uint8, error) {
+	if m.active == 0 {
+		m.mu.Unlock()
+		panic("rfsim: radios must be used by nodes started with Medium.Run or Medium.Go")
+	}
+	w.wake = make(chan struct{})
+	m.waiters = append(m.waiters, w)
+	m.advance()
+	m.mu.Unlock()
+	<-w.wake
+	return w.pkt, w.err
+}
+
+// advance moves the virtual time to the next event while all nodes wait
+func (m *Medium) advance() {
+	for m.active > 0 && len(m.waiters) == m.active {
+		next := time.Duration(-1)
+		for _, w := range m.waiters {
+			if t := w.deadline(); t >= 0 && (next < 0 || t < next) {
+				next = t
+			}
+		}
+		if next < 0 {
+			panic("rfsim: all nodes wait forever")
+		}
+		m.now = next
+		m.wakeDue()
+	}
+	m.prune()
+}
+
+// deadline returns the time w is woken up at, negative for never
+func (w *waiter) deadline() time.Duration {
+	if w.locked != nil {
+		return w.locked.end
+	}
+	return w.until
+}
+
+// wakeDue wakes up the waiters whose deadline is reached
+func (m *Medium) wakeDue() {
+	waiters := m.waiters[:0]
+	for _, w := range m.waiters {
+		if t := w.deadline(); t < 0 || t > m.now {
+			waiters = append(waiters, w)
+			continue
+		}
+		if w.rx {
+			m.endReception(w)
+		}
+		close(w.wake)
+	}
+	m.waiters = waiters
+}
+
+// endReception sets the result of a Rx
+func (m *Medium) endReception(w *waiter) {
+	tx := w.locked
+	if tx == nil {
+		w.err = lora.ErrRxTimeout
+		return
+	}
+	w.radio.rssi = int16(math.Round(w.rssi))
+	w.radio.snr = int8(math.Round(w.snr))
+	for _, other := range m.txs {
+		if other == tx || other.end <= tx.start || other.start >= tx.end ||
+			other.cfg.Freq != tx.cfg.Freq || other.cfg.Sf != tx.cfg.Sf || other.cfg.Bw != tx.cfg.Bw {
+			continue
+		}
+		rssi, _ := m.link(other.from, w.radio, other.cfg)
+		if w.rssi-rssi < m.CaptureThreshold {
+			w.err = lora.ErrCrcError
+			return
+		}
+	}
+	w.pkt = append([]uint8{}, tx.pkt...)
+}
+
+// startTransmission puts tx in the air, listening radios able to demodulate
+// it start receiving it
+func (m *Medium) startTransmission(tx *transmission) {
+	m.txs = append(m.txs, tx)
+	for _, w := range m.waiters {
+		m.lock(w, tx)
+	}
+}
+
+// startReception makes w receive a transmission starting at the same
+// virtual time, whatever the order the nodes called Tx and Rx in
+func (m *Medium) startReception(w *waiter) {
+	for _, tx := range m.txs {
+		if tx.start == m.now {
+			m.lock(w, tx)
+		}
+	}
+}
+
+// lock makes the Rx waiter w receive tx, if its radio is listening on the
+// same channel and can demodulate it
+func (m *Medium) lock(w *waiter, tx *transmission) {
+	if !w.rx || w.locked != nil || w.radio == tx.from {
+		return
+	}
+	cfg := w.radio.cfg
+	if cfg.Freq != tx.cfg.Freq || cfg.Sf != tx.cfg.Sf || cfg.Bw != tx.cfg.Bw ||
+		cfg.SyncWord != tx.cfg.SyncWord || cfg.Iq != tx.cfg.Iq {
+		return
+	}
+	rssi, snr := m.link(tx.from, w.radio, tx.cfg)
+	if snr < demodulationFloor(tx.cfg.Sf) {
+		return
+	}
+	w.locked = tx
+	w.rssi = rssi
+	w.snr = snr
+}
+
+// prune forgets the transmissions that can no longer collide with a
+// reception
+func (m *Medium) prune() {
+	from := m.now
+	for _, w := range m.waiters {
+		if w.locked != nil && w.locked.start < from {
+			from = w.locked.start
+		}
+	}
+	txs := m.txs[:0]
+	for _, tx := range m.txs {
+		if tx.end > from {
+			txs = append(txs, tx)
+		}
+	}
+	m.txs = txs
+}
+
+// link returns the RSSI and SNR of a transmission of from received by to
+func (m *Medium) link(from *Radio, to *Radio, cfg lora.Config) (rssi float64, snr float64) {
+	var loss float64
+	if m.PathLoss != nil {
+		loss = m.PathLoss(from, to, cfg.Freq)
+	} else {
+		loss = m.logDistance(math.Hypot(from.X-to.X, from.Y-to.Y), cfg.Freq)
+	}
+	rssi = float64(cfg.LoraTxPowerDBm) - loss
+	// Thermal noise in the bandwidth: -174 dBm/Hz
+	noise := -174 + 10*math.Log10(float64(lora.BandwidthHz(cfg.Bw))) + m.NoiseFigure
+	return rssi, rssi - noise
+}
+
+// logDistance returns the path loss at distance (in meters), free space
+// loss up to 1 meter and PathLossExponent beyond
+func (m *Medium) logDistance(distance float64, freq uint32) float64 {
+	fspl1m := 20*math.Log10(float64(freq)) - 147.55
+	return fspl1m + 10*m.PathLossExponent*math.Log10(max(distance, 1))
+}
+
+// demodulationFloor returns the lowest SNR a LoRa packet of spreading
+// factor sf can be received at: -7.5 dB at SF7, 2.5 dB less per SF
+func demodulationFloor(sf uint8) float64 {
+	return -2.5 * (float64(sf) - 4)
+}
@@ -0,0 +1,196 @@
+package rfsim
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+type rxResult struct {
+	pkt []uint8
+	err error
+	at  time.Duration
+}
+
+// listen returns a node receiving one packet on r
+func listen(m *Medium, r *Radio, timeoutMs uint32, res *rxResult) func() {
+	return func() {
+		res.pkt, res.err = r.Rx(timeoutMs)
+		res.at = m.Now()
+	}
+}
+
+// send returns a node transmitting pkt on r after delay
+func send(m *Medium, r *Radio, delay time.Duration, pkt string) func() {
+	return func() {
+		m.Sleep(delay)
+		r.Tx([]uint8(pkt), 0)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	m := NewMedium()
+	tx := m.NewRadio(0, 0)
+	rx := m.NewRadio(100, 0)
+
+	var res rxResult
+	m.Run(send(m, tx, 10*time.Millisecond, "hello"), listen(m, rx, 1000, &res))
+
+	if res.err != nil || string(res.pkt) != "hello" {
+		t.Fatalf("Rx() = %q, %v, want hello", res.pkt, res.err)
+	}
+	cfg := tx.Config()
+	if want := 10*time.Millisecond + cfg.TimeOnAir(5); res.at != want {
+		t.Errorf("received at %v, want the end of the packet %v", res.at, want)
+	}
+	rssi, snr := m.link(tx, rx, cfg)
+	if rx.RSSI() != int16(math.Round(rssi)) || rx.SNR() != int8(math.Round(snr)) || rx.RSSI() > 0 {
+		t.Errorf("RSSI %d dBm SNR %d dB, want %.1f and %.1f", rx.RSSI(), rx.SNR(), rssi, snr)
+	}
+}
+
+func TestRxPacket(t *testing.T) {
+	m := NewMedium()
+	tx := m.NewRadio(0, 0)
+	rx := m.NewRadio(100, 0)
+
+	var pkt *lora.RxPacket
+	var err error
+	m.Run(send(m, tx, 0, "hello"), func() { pkt, err = lora.Receive(rx, 1000) })
+	if err != nil || pkt == nil || string(pkt.Payload) != "hello" {
+		t.Fatalf("Receive() = %+v, %v, want hello", pkt, err)
+	}
+	if pkt.RSSI != rx.RSSI() || pkt.SNR != rx.SNR() {
+		t.Errorf("RSSI %d dBm SNR %d dB, want %d and %d", pkt.RSSI, pkt.SNR, rx.RSSI(), rx.SNR())
+	}
+	cfg := tx.Config()
+	if want := (time.Time{}).Add(cfg.TimeOnAir(5)); !pkt.Time.Equal(want) {
+		t.Errorf("received at %v, want the end of the packet %v", pkt.Time, want)
+	}
+}
+
+func TestFiltering(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(r *Radio)
+	}{
+		{"frequency", func(r *Radio) { r.SetFrequency(lora.MHz_868_3) }},
+		{"spreading factor", func(r *Radio) { r.SetSpreadingFactor(lora.SpreadingFactor9) }},
+		{"bandwidth", func(r *Radio) { r.SetBandwidth(lora.Bandwidth_250_0) }},
+		{"sync word", func(r *Radio) { r.SetPublicNetwork(true) }},
+		{"IQ polarity", func(r *Radio) { r.SetIqMode(lora.IQInverted) }},
+		{"out of range", func(r *Radio) { r.X = 100000 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMedium()
+			tx := m.NewRadio(0, 0)
+			rx := m.NewRadio(100, 0)
+			tt.set(rx)
+
+			var res rxResult
+			m.Run(send(m, tx, 0, "hello"), listen(m, rx, 500, &res))
+			if res.err != lora.ErrRxTimeout || res.at != 500*time.Millisecond {
+				t.Errorf("Rx() = %q, %v at %v, want a timeout at 500ms", res.pkt, res.err, res.at)
+			}
+		})
+	}
+}
+
+func TestLateListener(t *testing.T) {
+	m := NewMedium()
+	tx := m.NewRadio(0, 0)
+	rx := m.NewRadio(100, 0)
+
+	// The preamble was missed, the packet cannot be received
+	var res rxResult
+	m.Run(send(m, tx, 0, "hello"), func() {
+		m.Sleep(time.Millisecond)
+		res.pkt, res.err = rx.Rx(100)
+	})
+	if res.err != lora.ErrRxTimeout {
+		t.Errorf("Rx() = %q, %v, want %v", res.pkt, res.err, lora.ErrRxTimeout)
+	}
+}
+
+func TestCollision(t *testing.T) {
+	tests := []struct {
+		name    string
+		x2      float64
+		sf2     uint8
+		want    string
+		wantErr error
+	}{
+		{"same power", -100, lora.SpreadingFactor7, "", lora.ErrCrcError},
+		{"captured", -3000, lora.SpreadingFactor7, "near", nil},
+		{"other spreading factor", -100, lora.SpreadingFactor8, "near", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMedium()
+			near := m.NewRadio(100, 0)
+			far := m.NewRadio(tt.x2, 0)
+			far.SetSpreadingFactor(tt.sf2)
+			rx := m.NewRadio(0, 0)
+
+			var res rxResult
+			m.Run(send(m, near, 0, "near"), send(m, far, 5*time.Millisecond, "far"), listen(m, rx, 1000, &res))
+			if res.err != tt.wantErr || string(res.pkt) != tt.want {
+				t.Errorf("Rx() = %q, %v, want %q, %v", res.pkt, res.err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeterministicExchange(t *testing.T) {
+	// A node answers each packet received, the exchange ends at the same
+	// virtual time whatever the host scheduling
+	run := func() time.Duration {
+		m := NewMedium()
+		a := m.NewRadio(0, 0)
+		b := m.NewRadio(500, 0)
+		m.Run(func() {
+			for i := 0; i < 3; i++ {
+				a.Tx([]uint8("ping"), 0)
+				if _, err := a.Rx(1000); err != nil {
+					t.Errorf("ping %d: Rx() error = %v", i, err)
+				}
+			}
+		}, func() {
+			for i := 0; i < 3; i++ {
+				if _, err := b.Rx(0); err != nil {
+					t.Errorf("pong %d: Rx() error = %v", i, err)
+				}
+				m.Sleep(10 * time.Millisecond)
+				b.Tx([]uint8("pong"), 0)
+			}
+		})
+		return m.Now()
+	}
+
+	first := run()
+	toa := (&lora.Config{Sf: lora.SpreadingFactor7, Bw: lora.Bandwidth_125_0, Cr: lora.CodingRate4_5,
+		Preamble: 8, Crc: lora.CRCOn}).TimeOnAir(4)
+	if want := 3 * (2*toa + 10*time.Millisecond); first != want {
+		t.Errorf("exchange ended at %v, want %v", first, want)
+	}
+	for i := 0; i < 5; i++ {
+		if got := run(); got != first {
+			t.Fatalf("exchange ended at %v, then at %v", first, got)
+		}
+	}
+}
+
+func TestPathLoss(t *testing.T) {
+	m := NewMedium()
+	m.PathLoss = func(from *Radio, to *Radio, freq uint32) float64 { return 100 }
+	a := m.NewRadio(0, 0)
+	b := m.NewRadio(0, 0)
+
+	rssi, _ := m.link(a, b, a.Config())
+	if rssi != 14-100 {
+		t.Errorf("RSSI = %.1f dBm, want -86", rssi)
+	}
+}
@@ -0,0 +1,149 @@
+package rfsim
+
+import (
+	"time"
+
+	"tinygo.org/x/wireless/lora"
+)
+
+// Sync words of the public (LoRaWAN) and private networks, as set by
+// SetPublicNetwork
+const (
+	SyncWordPublic  = 0x3444
+	SyncWordPrivate = 0x1424
+)
+
+// Radio is a simulated LoRa radio implementing lora.PacketRadio on a Medium.
+// Tx blocks for the time on air of the packet, Rx until a packet is
+// received or timeoutMs of virtual time, 0 waits forever.
+type Radio struct {
+	X, Y float64 // position in meters, set before running the nodes
+
+	medium *Medium
+	cfg    lora.Config
+
+	// last packet received
+	rssi int16
+	snr  int8
+}
+
+// Tx transmits pkt and returns at the end of its time on air
+func (r *Radio) Tx(pkt []uint8, timeoutMs uint32) error {
+	m := r.medium
+	m.mu.Lock()
+	tx := &transmission{
+		from:  r,
+		cfg:   r.cfg,
+		pkt:   append([]uint8{}, pkt...),
+		start: m.now,
+		end:   m.now + r.cfg.TimeOnAir(len(pkt)),
+	}
+	m.startTransmission(tx)
+	_, err := m.block(&waiter{radio: r, until: tx.end})
+	return err
+}
+
+// Rx listens for a packet. It returns lora.ErrRxTimeout if none started
+// within timeoutMs, and lora.ErrCrcError if the packet was lost in a
+// collision.
+func (r *Radio) Rx(timeoutMs uint32) ([]uint8, error) {
+	m := r.medium
+	m.mu.Lock()
+	w := &waiter{radio: r, rx: true, until: -1}
+	if timeoutMs > 0 {
+		w.until = m.now + time.Duration(timeoutMs)*time.Millisecond
+	}
+	m.startReception(w)
+	return m.block(w)
+}
+
+// RxPacket is Rx returning the packet with its RSSI and SNR. Its Time is
+// the virtual time of the end of the packet, from the zero time.Time.
+func (r *Radio) RxPacket(timeoutMs uint32) (*lora.RxPacket, error) {
+	pkt, err := r.Rx(timeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	m := r.medium
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &lora.RxPacket{Payload: pkt, RSSI: r.rssi, SNR: r.snr, Time: time.Time{}.Add(m.now)}, nil
+}
+
+// RSSI returns the RSSI in dBm of the last packet received
+func (r *Radio) RSSI() int16 {
+	r.medium.mu.Lock()
+	defer r.medium.mu.Unlock()
+	return r.rssi
+}
+
+// SNR returns the signal to noise ratio in dB of the last packet received
+func (r *Radio) SNR() int8 {
+	r.medium.mu.Lock()
+	defer r.medium.mu.Unlock()
+	return r.snr
+}
+
+// Config returns the current configuration of the radio
+func (r *Radio) Config() lora.Config {
+	r.medium.mu.Lock()
+	defer r.medium.mu.Unlock()
+	return r.cfg
+}
+
+// Reset restores the default configuration, see Medium.NewRadio
+func (r *Radio) Reset() {
+	r.LoraConfig(lora.Config{
+		Freq:           lora.MHz_868_1,
+		Cr:             lora.CodingRate4_5,
+		Sf:             lora.SpreadingFactor7,
+		Bw:             lora.Bandwidth_125_0,
+		Preamble:       8,
+		SyncWord:       SyncWordPrivate,
+		HeaderType:     lora.HeaderExplicit,
+		Crc:            lora.CRCOn,
+		Iq:             lora.IQStandard,
+		LoraTxPowerDBm: 14,
+	})
+}
+
+// LoraConfig sets the whole configuration of the radio
+func (r *Radio) LoraConfig(cnf lora.Config) {
+	r.set(func(c *lora.Config) { *c = cnf })
+}
+
+func (r *Radio) set(f func(c *lora.Config)) {
+	r.medium.mu.Lock()
+	defer r.medium.mu.Unlock()
+	f(&r.cfg)
+}
+
+func (r *Radio) SetFrequency(freq uint32)      { r.set(func(c *lora.Config) { c.Freq = freq }) }
+func (r *Radio) SetIqMode(mode uint8)          { r.set(func(c *lora.Config) { c.Iq = mode }) }
+func (r *Radio) SetCodingRate(cr uint8)        { r.set(func(c *lora.Config) { c.Cr = cr }) }
+func (r *Radio) SetBandwidth(bw uint8)         { r.set(func(c *lora.Config) { c.Bw = bw }) }
+func (r *Radio) SetSpreadingFactor(sf uint8)   { r.set(func(c *lora.Config) { c.Sf = sf }) }
+func (r *Radio) SetPreambleLength(pLen uint16) { r.set(func(c *lora.Config) { c.Preamble = pLen }) }
+func (r *Radio) SetTxPower(txPower int8)       { r.set(func(c *lora.Config) { c.LoraTxPowerDBm = txPower }) }
+func (r *Radio) SetSyncWord(syncWord uint16)   { r.set(func(c *lora.Config) { c.SyncWord = syncWord }) }
+func (r *Radio) SetHeaderType(headerType uint8) {
+	r.set(func(c *lora.Config) { c.HeaderType = headerType })
+}
+
+func (r *Radio) SetCrc(enable bool) {
+	r.set(func(c *lora.Config) {
+		c.Crc = lora.CRCOff
+		if enable {
+			c.Crc = lora.CRCOn
+		}
+	})
+}
+
+func (r *Radio) SetPublicNetwork(enable bool) {
+	r.set(func(c *lora.Config) {
+		c.SyncWord = SyncWordPrivate
+		if enable {
+			c.SyncWord = SyncWordPublic
+		}
+	})
+}